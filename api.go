@@ -30,8 +30,13 @@ import (
 
 // An APIClient holds state and credentials related to uploading Asset
 // information to a REST API endpoint.
+//
+// AssetEvents are uploaded to eventURL, which is the same as url unless the
+// user says otherwise.  They can be told apart from Assets by their
+// "event_type" field.
 type APIClient struct {
 	url       string
+	eventURL  string
 	authToken string
 	clientID  string
 	enabled   bool
@@ -48,6 +53,7 @@ func NewAPIClient(
 ) *APIClient {
 	apiClient := new(APIClient)
 	apiClient.url = apiURL
+	apiClient.eventURL = apiURL
 	apiClient.authToken = apiToken
 	apiClient.clientID = clientID
 	apiClient.enabled = enabled
@@ -63,8 +69,23 @@ func NewAPIClient(
 //
 // Returns response data, if any, and error, either of which may be nil.
 func (apiClient *APIClient) Upload(asset *Asset) (map[string]interface{}, error) {
-	asset.ClientID = apiClient.clientID
+	// The asset may be shared with other listeners, so leave it alone.
+	sent := *asset
+	sent.ClientID = apiClient.clientID
+	return apiClient.post(apiClient.url, &sent)
+}
+
+// UploadEvent sends an asset change event to a REST API.
+//
+// Returns response data, if any, and error, either of which may be nil.
+func (apiClient *APIClient) UploadEvent(event *AssetEvent) (map[string]interface{}, error) {
+	sent := *event
+	sent.ClientID = apiClient.clientID
+	return apiClient.post(apiClient.eventURL, &sent)
+}
 
+// post sends a JSON representation of v to a URL.
+func (apiClient *APIClient) post(url string, v interface{}) (map[string]interface{}, error) {
 	// Handle API throttling.  If the number of outstanding requests exceeds the
 	// limit, return an error.
 	if len(apiClient.semaphore) == cap(apiClient.semaphore) {
@@ -75,7 +96,7 @@ func (apiClient *APIClient) Upload(asset *Asset) (map[string]interface{}, error)
 	defer func() { <-apiClient.semaphore }()
 
 	// Build JSON string
-	bytesRepresentation, err := json.Marshal(asset)
+	bytesRepresentation, err := json.Marshal(v)
 	if err != nil {
 		return nil, fmt.Errorf("Error marshalling JSON: %s", err)
 	}
@@ -86,7 +107,7 @@ func (apiClient *APIClient) Upload(asset *Asset) (map[string]interface{}, error)
 	}
 	request, err := http.NewRequest(
 		http.MethodPost,
-		apiClient.url,
+		url,
 		bytes.NewBuffer(bytesRepresentation),
 	)
 	if err != nil {
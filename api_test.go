@@ -7,6 +7,7 @@ https://www.markphelps.me/testing-api-clients-in-go/
 package main
 
 import (
+	"encoding/json"
 	"net/http"
 	"net/http/httptest"
 	"testing"
@@ -60,15 +61,15 @@ func TestAPISimple(t *testing.T) {
 
 	// Make a test request
 	result, err := apiClient.Upload(&Asset{
-		"10.0.0.1",
-		"0000:0000:0000:0000:0000:FFFF:0A00:0001",
-		"8000",
-		"2575",
-		"11:22:33:44:55:66",
-		"Hospira Plum A+",
-		"HL7",
-		time.Time{},
-		"ID0",
+		IPv4Address:    "10.0.0.1",
+		IPv6Address:    "0000:0000:0000:0000:0000:FFFF:0A00:0001",
+		ListensOnPort:  "8000",
+		ConnectsToPort: "2575",
+		MACAddress:     "11:22:33:44:55:66",
+		Identifier:     "Hospira Plum A+",
+		Provenance:     "HL7",
+		LastSeen:       time.Time{},
+		ClientID:       "ID0",
 	})
 
 	// Check output and errors
@@ -121,3 +122,29 @@ func TestAPIThrottling(t *testing.T) {
 		t.Errorf("Expected exactly 1 throttling failure")
 	}
 }
+
+func TestAPIUploadEvent(t *testing.T) {
+	// Upload one event to a separate endpoint and check what arrives.
+	teardown := setup()
+	defer teardown()
+	apiClient.eventURL = server.URL + "/events"
+
+	var body map[string]interface{}
+	mux.HandleFunc("/events", func(w http.ResponseWriter, r *http.Request) {
+		json.NewDecoder(r.Body).Decode(&body)
+		w.Header().Set("Content-Type", "application/json")
+		w.WriteHeader(http.StatusOK)
+		w.Write([]byte(`{"message": "Dummy message."}`))
+	})
+
+	_, err := apiClient.UploadEvent(&AssetEvent{
+		Type:  EventNewDevice,
+		Asset: &Asset{IPv4Address: "10.0.0.1"},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if body["event_type"] != EventNewDevice {
+		t.Errorf("Expected event_type %q, got %v", EventNewDevice, body["event_type"])
+	}
+}
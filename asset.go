@@ -3,23 +3,72 @@ package main
 import (
 	"encoding/csv"
 	"os"
+	"strconv"
+	"strings"
 	"sync"
 	"time"
 )
 
-// An Asset represents an observation of one endpoint seen in network traffic.
+// An Asset represents an observation of one endpoint seen in network traffic,
+// or, once merged into an Inventory, everything known about one device.
+//
+// Some facts have a singular and a plural field, such as ListensOnPort and
+// ListensOnPorts, Interface and Interfaces, or CaptureComment and
+// CaptureComments.  An observation fills in only the singular field.  A merged
+// record keeps the latest value seen there, for consumers of the original
+// output, and every value seen in the plural field, which is the one to use.
 //
 // Each field is annotated with its JSON field name.
 type Asset struct {
-	IPv4Address    string    `json:"ipv4_address"`
-	IPv6Address    string    `json:"ipv6_address"`
-	ListensOnPort  string    `json:"open_port_tcp"`
-	ConnectsToPort string    `json:"connect_port_tcp"`
-	MACAddress     string    `json:"mac_address"`
-	Identifier     string    `json:"identifier"`
-	Provenance     string    `json:"provenance"`
-	LastSeen       time.Time `json:"last_seen"`
-	ClientID       string    `json:"client_id"`
+	IPv4Address        string     `json:"ipv4_address"`
+	IPv6Address        string     `json:"ipv6_address"`
+	ListensOnPort      string     `json:"open_port_tcp"`
+	ConnectsToPort     string     `json:"connect_port_tcp"`
+	MACAddress         string     `json:"mac_address"`
+	Identifier         string     `json:"identifier"`
+	Provenance         string     `json:"provenance"`
+	Attributes         Attributes `json:"attributes"`
+	LastSeen           time.Time  `json:"last_seen"`
+	ClientID           string     `json:"client_id"`
+	FirstSeen          time.Time  `json:"first_seen"`
+	ObservationCount   uint64     `json:"observation_count"`
+	Identifiers        []string   `json:"identifiers"`
+	ListensOnPorts     []string   `json:"open_ports_tcp"`
+	ConnectsToPorts    []string   `json:"connect_ports_tcp"`
+	Missing            bool       `json:"missing"`
+	VLANID             string     `json:"vlan_id"`
+	OuterVLANID        string     `json:"outer_vlan_id"`
+	Tunnel             string     `json:"tunnel"`
+	TunnelID           string     `json:"tunnel_id"`
+	ListensOnPortUDP   string     `json:"open_port_udp"`
+	ConnectsToPortUDP  string     `json:"connect_port_udp"`
+	ListensOnPortsUDP  []string   `json:"open_ports_udp"`
+	ConnectsToPortsUDP []string   `json:"connect_ports_udp"`
+	Interface          string     `json:"interface"`
+	Interfaces         []string   `json:"interfaces"`
+	CaptureComment     string     `json:"capture_comment"`
+	CaptureComments    []string   `json:"capture_comments"`
+	MessageTypes       []string   `json:"message_types"`
+}
+
+// AddObservation merges what a decoder learned into an Asset.  The Asset's
+// identifier is the most specific identifying attribute known.
+//
+// The Asset gets a fresh Attributes map, so copies of an Asset never share one.
+func (asset *Asset) AddObservation(obs *Observation) {
+	merged := make(Attributes, len(asset.Attributes)+len(obs.Attributes))
+	for name, attr := range asset.Attributes {
+		merged[name] = attr
+	}
+	for name, attr := range obs.Attributes {
+		merged.Merge(name, attr)
+	}
+	asset.Attributes = merged
+	addToSet(&asset.MessageTypes, obs.MessageType)
+	if ident, ok := asset.Attributes.Identifier(); ok {
+		asset.Identifier = ident.Value
+		asset.Provenance = ident.Provenance
+	}
 }
 
 // AssetCSVWriter contains the state needed to write to a CSV file
@@ -63,7 +112,26 @@ func NewAssetCSVWriter(filename string) (*AssetCSVWriter, error) {
 		"provenance",
 		"last_seen",
 		"client_id",
+		"first_seen",
+		"observation_count",
+		"identifiers",
+		"open_ports_tcp",
+		"connect_ports_tcp",
+		"vlan_id",
+		"outer_vlan_id",
+		"tunnel",
+		"tunnel_id",
+		"open_port_udp",
+		"connect_port_udp",
+		"open_ports_udp",
+		"connect_ports_udp",
+		"interface",
+		"interfaces",
+		"capture_comment",
+		"capture_comments",
+		"message_types",
 	}
+	header = append(header, attributeNames...)
 	if err := w.csvWriter.Write(header); err != nil {
 		return nil, err
 	}
@@ -97,12 +165,34 @@ func (w *AssetCSVWriter) Append(asset *Asset) error {
 	row := []string{
 		asset.IPv4Address,
 		asset.IPv6Address,
+		asset.ListensOnPort,
 		asset.ConnectsToPort,
 		asset.MACAddress,
 		asset.Identifier,
 		asset.Provenance,
 		asset.LastSeen.String(),
 		asset.ClientID,
+		asset.FirstSeen.String(),
+		strconv.FormatUint(asset.ObservationCount, 10),
+		strings.Join(asset.Identifiers, ";"),
+		strings.Join(asset.ListensOnPorts, ";"),
+		strings.Join(asset.ConnectsToPorts, ";"),
+		asset.VLANID,
+		asset.OuterVLANID,
+		asset.Tunnel,
+		asset.TunnelID,
+		asset.ListensOnPortUDP,
+		asset.ConnectsToPortUDP,
+		strings.Join(asset.ListensOnPortsUDP, ";"),
+		strings.Join(asset.ConnectsToPortsUDP, ";"),
+		asset.Interface,
+		strings.Join(asset.Interfaces, ";"),
+		asset.CaptureComment,
+		strings.Join(asset.CaptureComments, ";"),
+		strings.Join(asset.MessageTypes, ";"),
+	}
+	for _, name := range attributeNames {
+		row = append(row, asset.Attributes[name].Value)
 	}
 	if err := w.csvWriter.Write(row); err != nil {
 		return err
@@ -16,15 +16,28 @@ import (
 //real file.
 func TestAssetCSV(t *testing.T) {
 	asset := &Asset{
-		"10.0.0.1",
-		"0000:0000:0000:0000:0000:FFFF:0A00:0001",
-		"8000",
-		"2575",
-		"11:22:33:44:55:66",
-		"Hospira Plum A+",
-		"HL7",
-		time.Time{},
-		"ID0",
+		IPv4Address:     "10.0.0.1",
+		IPv6Address:     "0000:0000:0000:0000:0000:FFFF:0A00:0001",
+		ListensOnPort:   "8000",
+		ConnectsToPort:  "2575",
+		MACAddress:      "11:22:33:44:55:66",
+		Identifier:      "Hospira Plum A+",
+		Provenance:      "HL7",
+		LastSeen:        time.Time{},
+		ClientID:        "ID0",
+		Identifiers:     []string{"Hospira Plum A+", "PUMP-1"},
+		ListensOnPorts:  []string{"8000"},
+		VLANID:          "10",
+		Tunnel:          "VXLAN",
+		TunnelID:        "5001",
+		Interface:       "eth1",
+		Interfaces:      []string{"eth1", "eth2"},
+		CaptureComment:  "Pump on bed 4",
+		CaptureComments: []string{"Pump on bed 4", "Spare pump"},
+		MessageTypes:    []string{"ADT^A01", "ORU^R01"},
+		Attributes: Attributes{
+			AttrManufacturer: {Value: "Hospira", Provenance: "HL7 PRT-10", Confidence: 0.9},
+		},
 	}
 
 	// Write file
@@ -42,9 +55,9 @@ func TestAssetCSV(t *testing.T) {
 	if err != nil {
 		panic(err)
 	}
-	expected := `ipv4_address,ipv6_address,open_port_tcp,connect_port_tcp,mac_address,identifier,provenance,last_seen,client_id
-10.0.0.1,0000:0000:0000:0000:0000:FFFF:0A00:0001,2575,11:22:33:44:55:66,Hospira Plum A+,HL7,0001-01-01 00:00:00 +0000 UTC,ID0
-10.0.0.1,0000:0000:0000:0000:0000:FFFF:0A00:0001,2575,11:22:33:44:55:66,Hospira Plum A+,HL7,0001-01-01 00:00:00 +0000 UTC,ID0
+	expected := `ipv4_address,ipv6_address,open_port_tcp,connect_port_tcp,mac_address,identifier,provenance,last_seen,client_id,first_seen,observation_count,identifiers,open_ports_tcp,connect_ports_tcp,vlan_id,outer_vlan_id,tunnel,tunnel_id,open_port_udp,connect_port_udp,open_ports_udp,connect_ports_udp,interface,interfaces,capture_comment,capture_comments,message_types,udi_di,equipment_id,serial_number,manufacturer,model,software_version,ae_title,hostname,lot_number,manufacture_date,expiry_date,donation_id,device_type,udi_issuer,eui64,equipment_namespace,sending_application,sending_facility,receiving_application,receiving_facility,hl7_version,hl7_character_set,hl7_role
+10.0.0.1,0000:0000:0000:0000:0000:FFFF:0A00:0001,8000,2575,11:22:33:44:55:66,Hospira Plum A+,HL7,0001-01-01 00:00:00 +0000 UTC,ID0,0001-01-01 00:00:00 +0000 UTC,0,Hospira Plum A+;PUMP-1,8000,,10,,VXLAN,5001,,,,,eth1,eth1;eth2,Pump on bed 4,Pump on bed 4;Spare pump,ADT^A01;ORU^R01,,,,Hospira,,,,,,,,,,,,,,,,,,,
+10.0.0.1,0000:0000:0000:0000:0000:FFFF:0A00:0001,8000,2575,11:22:33:44:55:66,Hospira Plum A+,HL7,0001-01-01 00:00:00 +0000 UTC,ID0,0001-01-01 00:00:00 +0000 UTC,0,Hospira Plum A+;PUMP-1,8000,,10,,VXLAN,5001,,,,,eth1,eth1;eth2,Pump on bed 4,Pump on bed 4;Spare pump,ADT^A01;ORU^R01,,,,Hospira,,,,,,,,,,,,,,,,,,,
 `
 	if string(actual) != expected {
 		t.Errorf("CSV file actual %s does not match expected: %s\n", actual, expected)
@@ -0,0 +1,114 @@
+// Copyright 2019 Virta Laboratories, Inc.  All rights reserved.
+
+//go:build !purego
+// +build !purego
+
+/*
+Capture with libpcap.
+
+By default Tapirx captures packets, reads capture files and compiles BPF filter
+expressions with libpcap (or WinPcap), which requires cgo.  Build with the
+"purego" tag to do without it.
+*/
+
+package main
+
+import (
+	"fmt"
+	"runtime"
+
+	"github.com/google/gopacket"
+	"github.com/google/gopacket/layers"
+	"github.com/google/gopacket/pcap"
+)
+
+// captureBackend names the way packets are captured.
+const captureBackend = "libpcap"
+
+// openLive starts capturing on a network interface, applying a BPF filter
+// expression if one is given.
+func openLive(name string, bpfExpr string, config captureConfig) (*gopacket.PacketSource, captureCounter, error) {
+	inactive, err := pcap.NewInactiveHandle(name)
+	if err != nil {
+		return nil, nil, err
+	}
+	defer inactive.CleanUp()
+	if err := inactive.SetSnapLen(config.snaplen); err != nil {
+		return nil, nil, err
+	}
+	if err := inactive.SetPromisc(config.promisc); err != nil {
+		return nil, nil, err
+	}
+	if err := inactive.SetTimeout(pcap.BlockForever); err != nil {
+		return nil, nil, err
+	}
+	if config.bufferSize > 0 {
+		if err := inactive.SetBufferSize(config.bufferSize); err != nil {
+			return nil, nil, err
+		}
+	}
+	if err := inactive.SetImmediateMode(config.immediate); err != nil {
+		return nil, nil, err
+	}
+	handle, err := inactive.Activate()
+	if err != nil {
+		return nil, nil, err
+	}
+	if bpfExpr != "" {
+		if err := handle.SetBPFFilter(bpfExpr); err != nil {
+			handle.Close()
+			return nil, nil, err
+		}
+	}
+
+	counter := func() (CaptureCounts, error) {
+		s, err := handle.Stats()
+		if err != nil {
+			return CaptureCounts{}, err
+		}
+		return CaptureCounts{
+			Received:  uint64(s.PacketsReceived),
+			Dropped:   uint64(s.PacketsDropped),
+			IfDropped: uint64(s.PacketsIfDropped),
+		}, nil
+	}
+	return gopacket.NewPacketSource(handle, handle.LinkType()), counter, nil
+}
+
+// openOffline opens an uncompressed capture file, applying a BPF filter
+// expression if one is given.
+func openOffline(name string, bpfExpr string) (packetStreamReader, func(), error) {
+	handle, err := pcap.OpenOffline(name)
+	if err != nil {
+		return nil, nil, err
+	}
+	if bpfExpr != "" {
+		if err := handle.SetBPFFilter(bpfExpr); err != nil {
+			handle.Close()
+			return nil, nil, err
+		}
+	}
+	return handle, handle.Close, nil
+}
+
+// compileFilter compiles a BPF filter expression for packets of a link type.
+func compileFilter(linkType layers.LinkType, expr string) (packetFilter, error) {
+	return pcap.NewBPF(linkType, streamSnaplen, expr)
+}
+
+func listInterfaces() {
+	ifaces, err := pcap.FindAllDevs()
+	if err != nil {
+		panic(err)
+	}
+	for _, iface := range ifaces {
+		if runtime.GOOS == "windows" {
+			// On Windows, device names are ugly, like
+			// "\Device\NPF_{XXXXXXXX-XXXX-XXXX-XXXX-XXXXXXXXXXXX}",
+			// so display a more descriptive name too.
+			fmt.Printf("%s\t(%s)\n", iface.Name, iface.Description)
+		} else {
+			fmt.Println(iface.Name)
+		}
+	}
+}
@@ -0,0 +1,18 @@
+//go:build !purego
+// +build !purego
+
+/*
+Unit tests for capture with libpcap.
+*/
+package main
+
+import (
+	"testing"
+)
+
+// TestLibpcapFilter runs the expressions that filters compiled in Go are
+// tested with through libpcap, so the two backends are held to the same
+// results.
+func TestLibpcapFilter(t *testing.T) {
+	checkFilters(t, compileFilter)
+}
@@ -0,0 +1,59 @@
+// Copyright 2019 Virta Laboratories, Inc.  All rights reserved.
+
+//go:build purego
+// +build purego
+
+/*
+Capture without libpcap.
+
+Built with the "purego" tag, Tapirx needs neither cgo nor libpcap, so static
+and cross-compiled binaries are easy to make.  Capture files are read in Go,
+live capture uses AF_PACKET sockets (on Linux only), and filter expressions are
+compiled in Go (see filter.go).
+*/
+
+package main
+
+import (
+	"fmt"
+	"net"
+	"os"
+
+	"github.com/google/gopacket/layers"
+)
+
+// captureBackend names the way packets are captured.
+const captureBackend = "purego"
+
+// openOffline opens an uncompressed capture file, applying a filter expression
+// if one is given.
+func openOffline(name string, bpfExpr string) (packetStreamReader, func(), error) {
+	f, err := os.Open(name)
+	if err != nil {
+		return nil, nil, err
+	}
+	reader, err := newPacketStreamReader(f)
+	if err == nil {
+		reader, err = filterPacketStream(reader, bpfExpr)
+	}
+	if err != nil {
+		f.Close()
+		return nil, nil, err
+	}
+	return reader, func() { f.Close() }, nil
+}
+
+// compileFilter compiles a filter expression for packets of a link type.
+func compileFilter(linkType layers.LinkType, expr string) (packetFilter, error) {
+	return compileGoFilter(linkType, expr)
+}
+
+func listInterfaces() {
+	ifaces, err := net.Interfaces()
+	if err != nil {
+		panic(err)
+	}
+	for _, iface := range ifaces {
+		fmt.Println(iface.Name)
+	}
+}
@@ -0,0 +1,69 @@
+// Copyright 2019 Virta Laboratories, Inc.  All rights reserved.
+
+//go:build purego
+// +build purego
+
+package main
+
+import (
+	"github.com/google/gopacket"
+	"github.com/google/gopacket/layers"
+	"github.com/google/gopacket/pcapgo"
+)
+
+// openLive starts capturing on a network interface through an AF_PACKET
+// socket, attaching a filter expression to it if one is given.  The socket
+// hands over each packet as it arrives, so there is no immediate mode to set,
+// and its buffer size cannot be changed.
+func openLive(name string, bpfExpr string, config captureConfig) (*gopacket.PacketSource, captureCounter, error) {
+	if config.bufferSize > 0 {
+		logger.Printf("Capture buffer size for %s ignored without libpcap\n", name)
+	}
+	handle, err := pcapgo.NewEthernetHandle(name)
+	if err != nil {
+		return nil, nil, err
+	}
+	if config.promisc {
+		if err := handle.SetPromiscuous(true); err != nil {
+			handle.Close()
+			return nil, nil, err
+		}
+	}
+	if err := handle.SetCaptureLength(config.snaplen); err != nil {
+		handle.Close()
+		return nil, nil, err
+	}
+	if bpfExpr != "" {
+		filter, err := compileGoFilter(layers.LinkTypeEthernet, bpfExpr)
+		if err == nil {
+			err = handle.SetBPF(filter.program)
+		}
+		if err != nil {
+			handle.Close()
+			return nil, nil, err
+		}
+	}
+	reader := &ethernetReader{handle}
+
+	// The socket counts packets since it was last asked, so keep totals.
+	var total CaptureCounts
+	counter := func() (CaptureCounts, error) {
+		s, err := handle.Stats()
+		if err != nil {
+			return total, err
+		}
+		total.Received += uint64(s.Packets)
+		total.Dropped += uint64(s.Drops)
+		return total, nil
+	}
+	return gopacket.NewPacketSource(reader, layers.LinkTypeEthernet), counter, nil
+}
+
+// An ethernetReader reads Ethernet frames from an AF_PACKET socket.
+type ethernetReader struct {
+	*pcapgo.EthernetHandle
+}
+
+func (r *ethernetReader) LinkType() layers.LinkType {
+	return layers.LinkTypeEthernet
+}
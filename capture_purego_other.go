@@ -0,0 +1,18 @@
+// Copyright 2019 Virta Laboratories, Inc.  All rights reserved.
+
+//go:build purego && !linux
+// +build purego,!linux
+
+package main
+
+import (
+	"fmt"
+
+	"github.com/google/gopacket"
+)
+
+// openLive fails, since live capture without libpcap needs Linux's AF_PACKET
+// sockets.
+func openLive(name string, bpfExpr string, config captureConfig) (*gopacket.PacketSource, captureCounter, error) {
+	return nil, nil, fmt.Errorf("Live capture without libpcap is only supported on Linux")
+}
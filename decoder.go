@@ -8,9 +8,53 @@ package main
 import "github.com/google/gopacket"
 
 // PayloadDecoder defines a struct that can accept a packet payload (application layer).
+//
+// DecodePayload returns an Observation of whatever the payload revealed about
+// the device that sent it, which may be empty, or an error if the decoder does
+// not understand the payload.  A message may also describe other devices, which
+// are listed in the Observation's Devices.
 type PayloadDecoder interface {
 	Name() string
 	Initialize() error
-	DecodePayload(app *gopacket.ApplicationLayer) (string, string, error)
+	DecodePayload(app *gopacket.ApplicationLayer) (*Observation, error)
 	String() string
 }
+
+// StreamDecoder defines a PayloadDecoder that can find message boundaries in a
+// reassembled TCP byte stream.
+//
+// MessageLength returns the length of the message at the start of buf.  The
+// length may exceed len(buf) if the protocol announces it up front.  It returns
+// 0 if more data is needed to find the end of the message, and an error if buf
+// does not start with a message the decoder understands.  If final is set, no
+// more data will arrive.
+type StreamDecoder interface {
+	PayloadDecoder
+	MessageLength(buf []byte, final bool) (int, error)
+}
+
+// MessageSplitter defines a PayloadDecoder whose payloads may hold several
+// messages.  SplitMessages returns each message so that it can be passed to
+// DecodePayload on its own, or nothing if the payload holds no messages the
+// decoder understands.
+type MessageSplitter interface {
+	PayloadDecoder
+	SplitMessages(payload []byte) [][]byte
+}
+
+// DatagramDecoder defines a PayloadDecoder that may accept the payloads of UDP
+// datagrams.  Decoders that do not implement it, or whose DecodesUDP returns
+// false, are only given TCP payloads.
+type DatagramDecoder interface {
+	PayloadDecoder
+	DecodesUDP() bool
+}
+
+// CorrelatingDecoder defines a PayloadDecoder that pairs messages with the
+// replies to them, such as acknowledgments.  Correlate is given the
+// Observation of every message the decoder understood, along with what lower
+// layers revealed about the message's sender.
+type CorrelatingDecoder interface {
+	PayloadDecoder
+	Correlate(obs *Observation, sender *Asset)
+}
@@ -0,0 +1,59 @@
+// Copyright 2019 Virta Laboratories, Inc.  All rights reserved.
+/*
+Decompression of capture files and streams.
+
+Archived captures are usually compressed, and may be far larger than the disk
+of the machine analyzing them once decompressed.  Captures compressed with
+gzip, bzip2 or xz are recognized by their magic bytes rather than by their
+names, and are decompressed as they are read.
+*/
+
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"compress/bzip2"
+	"compress/gzip"
+	"io"
+
+	"github.com/ulikunitz/xz"
+)
+
+// Magic bytes at the start of compressed data
+var (
+	gzipMagic  = []byte{0x1f, 0x8b}
+	bzip2Magic = []byte("BZh")
+	xzMagic    = []byte{0xfd, '7', 'z', 'X', 'Z', 0x00}
+)
+
+// compression returns the name of the compression used by the data in a
+// buffered reader, or "" if it is not compressed.
+func compression(br *bufio.Reader) string {
+	// A short stream is simply not compressed, so ignore errors.
+	magic, _ := br.Peek(len(xzMagic))
+	switch {
+	case bytes.HasPrefix(magic, gzipMagic):
+		return "gzip"
+	case bytes.HasPrefix(magic, bzip2Magic):
+		return "bzip2"
+	case bytes.HasPrefix(magic, xzMagic):
+		return "xz"
+	}
+	return ""
+}
+
+// decompress returns a reader of the decompressed contents of a buffered
+// reader if it holds gzip, bzip2 or xz data, or the buffered reader itself if
+// not.
+func decompress(br *bufio.Reader) (io.Reader, error) {
+	switch compression(br) {
+	case "gzip":
+		return gzip.NewReader(br)
+	case "bzip2":
+		return bzip2.NewReader(br), nil
+	case "xz":
+		return xz.NewReader(br)
+	}
+	return br, nil
+}
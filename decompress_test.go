@@ -0,0 +1,71 @@
+/*
+Unit tests for decompression of capture files and streams.
+*/
+package main
+
+import (
+	"bytes"
+	"compress/gzip"
+	"io"
+	"io/ioutil"
+	"testing"
+
+	"github.com/google/gopacket"
+)
+
+const uncompressedCapture = "testdata/HL7-ADT-UDI-PRT.pcap"
+
+// readCaptureFile returns the data of every packet in a capture file.
+func readCaptureFile(t *testing.T, name string) [][]byte {
+	merger, err := NewCaptureFileMerger([]string{name}, "", nil)
+	if err != nil {
+		t.Fatalf("%s: %v", name, err)
+	}
+	var packets [][]byte
+	for packet := range merger.Packets() {
+		packets = append(packets, packet.Data())
+	}
+	return packets
+}
+
+func TestCompressedCaptureFiles(t *testing.T) {
+	setupLogging(false)
+	stats = *NewStats()
+	expected := readCaptureFile(t, uncompressedCapture)
+	if len(expected) == 0 {
+		t.Fatalf("No packets in %s", uncompressedCapture)
+	}
+	for _, suffix := range []string{".gz", ".bz2", ".xz"} {
+		actual := readCaptureFile(t, uncompressedCapture+suffix)
+		if len(actual) != len(expected) {
+			t.Errorf("%s: expected %d packets, got %d", suffix, len(expected), len(actual))
+			continue
+		}
+		for i := range actual {
+			if !bytes.Equal(actual[i], expected[i]) {
+				t.Errorf("%s: packet %d differs", suffix, i)
+			}
+		}
+	}
+	if len(stats.Errors) != 0 {
+		t.Errorf("Unexpected errors %v", stats.Errors)
+	}
+}
+
+func TestCompressedStream(t *testing.T) {
+	setupLogging(false)
+	data, err := ioutil.ReadFile(uncompressedCapture)
+	if err != nil {
+		t.Fatal(err)
+	}
+	var stream bytes.Buffer
+	w := gzip.NewWriter(&stream)
+	w.Write(data)
+	w.Close()
+
+	c := make(chan gopacket.Packet, 100)
+	n, err := readPacketStream(&stream, "", c)
+	if err != io.EOF || n != len(readCaptureFile(t, uncompressedCapture)) {
+		t.Errorf("Read %d packets from gzip stream, error %v", n, err)
+	}
+}
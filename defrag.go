@@ -0,0 +1,431 @@
+// Copyright 2019 Virta Laboratories, Inc.  All rights reserved.
+/*
+IPv4 and IPv6 defragmentation.
+
+Datagrams larger than a path's MTU arrive in fragments, and only the first
+fragment carries the transport header.  Fragments are therefore collected and
+put back together before a packet is handed to a worker, and the reassembled
+datagram is handled as if it had been captured whole.
+
+Fragments that overlap one another are a sign of a broken stack or of an
+attempt to evade inspection (different reassembly policies yield different
+datagrams).  As RFC 5722 requires for IPv6, a datagram with overlapping
+fragments is discarded, and the anomaly is counted in Stats.  Exact duplicates
+are ignored.
+
+Memory use is bounded by a limit on the size of each datagram, the number of
+fragments in each datagram and the bytes buffered in total; datagrams that are
+not completed within a timeout (measured by capture timestamps) are discarded.
+
+Docs:
+https://tools.ietf.org/html/rfc791#section-3.2
+https://tools.ietf.org/html/rfc8200#section-4.5
+*/
+
+package main
+
+import (
+	"bytes"
+	"encoding/binary"
+	"fmt"
+	"sync"
+	"time"
+
+	"github.com/google/gopacket"
+	"github.com/google/gopacket/layers"
+)
+
+const (
+	// Upper limit on the length of a reassembled datagram (headers and payload)
+	maxDatagramSize = 65535
+
+	// Upper limit on the number of fragments in one datagram
+	maxFragmentsPerDatagram = 128
+
+	// Upper limit on bytes buffered in all incomplete datagrams
+	maxFragmentMemory = 16 << 20
+
+	// Incomplete datagrams are discarded after this long.
+	fragmentTimeout = 30 * time.Second
+
+	// How often (in capture time) to look for expired datagrams
+	fragmentExpiryInterval = time.Second
+
+	// IPv6 extension headers
+	ipv6HeaderLength  = 40
+	ipv6HopByHop      = 0
+	ipv6Routing       = 43
+	ipv6FragmentHdr   = 44
+	ipv6Destination   = 60
+	ipv6FragmentLen   = 8
+	ipv4MoreFragments = 0x2000
+	ipv4OffsetMask    = 0x1fff
+)
+
+// fragmentKey identifies the fragments of one datagram.
+type fragmentKey struct {
+	src, dst [16]byte
+	id       uint32
+	protocol uint8
+	ipv6     bool
+}
+
+// fragment is one piece of a datagram's payload.
+type fragment struct {
+	offset int
+	data   []byte
+}
+
+// datagram collects the fragments of one datagram.
+type datagram struct {
+	fragments []fragment
+	total     int    // payload length, or -1 until the last fragment arrives
+	first     []byte // link-layer and IP headers from the first fragment
+	ipStart   int    // offset in first of the IP header
+	nextProto int    // offset in first of the byte naming the payload's protocol (IPv6)
+	protocol  uint8  // protocol of the payload (IPv6)
+	linkType  gopacket.LayerType
+	created   time.Time
+	size      int // bytes buffered
+}
+
+// Defragmenter reassembles fragmented IPv4 and IPv6 datagrams.
+type Defragmenter struct {
+	sync.Mutex
+	datagrams  map[fragmentKey]*datagram
+	size       int
+	lastExpiry time.Time
+}
+
+// NewDefragmenter returns a new Defragmenter.
+func NewDefragmenter() *Defragmenter {
+	d := new(Defragmenter)
+	d.datagrams = make(map[fragmentKey]*datagram)
+	return d
+}
+
+// Defragment returns the packet itself if it is not a fragment, the whole
+// datagram if the packet is the fragment that completes it, or nil otherwise.
+func (d *Defragmenter) Defragment(packet gopacket.Packet) gopacket.Packet {
+	data := packet.Data()
+	ipStart, isIPv6, ok := networkLayerOffset(packet)
+	if !ok {
+		return packet
+	}
+
+	var key fragmentKey
+	var frag fragment
+	var more bool
+	var dgram datagram
+	if isIPv6 {
+		key, frag, more, dgram, ok = parseIPv6Fragment(data, ipStart)
+	} else {
+		key, frag, more, dgram, ok = parseIPv4Fragment(data, ipStart)
+	}
+	if !ok {
+		return packet
+	}
+	dgram.linkType = linkLayerType(packet)
+	if isIPv6 {
+		stats.AddLayer("IPv6/fragment")
+	} else {
+		stats.AddLayer("IPv4/fragment")
+	}
+
+	d.Lock()
+	defer d.Unlock()
+	now := packet.Metadata().Timestamp
+	d.expire(now)
+
+	whole, err := d.insert(key, frag, more, &dgram, now)
+	if err != nil {
+		stats.AddError(err)
+		return nil
+	}
+	if whole == nil {
+		return nil
+	}
+	stats.AddLayer("IP/reassembled")
+
+	ci := packet.Metadata().CaptureInfo
+	ci.CaptureLength = len(whole)
+	ci.Length = len(whole)
+	reassembled := gopacket.NewPacket(whole, dgram.linkType, gopacket.Default)
+	reassembled.Metadata().CaptureInfo = ci
+	return reassembled
+}
+
+// insert adds a fragment to its datagram and returns the reassembled packet
+// bytes if the datagram is complete.  template holds what was learned about
+// the datagram from this fragment.
+func (d *Defragmenter) insert(key fragmentKey, frag fragment, more bool, template *datagram, now time.Time) ([]byte, error) {
+	end := frag.offset + len(frag.data)
+	if end > maxDatagramSize {
+		d.discard(key)
+		return nil, fmt.Errorf("IP datagram too large")
+	}
+	if more && len(frag.data)%8 != 0 {
+		d.discard(key)
+		return nil, fmt.Errorf("IP fragment length not a multiple of 8")
+	}
+
+	dgram, ok := d.datagrams[key]
+	if !ok {
+		dgram = &datagram{total: -1, created: now}
+		d.datagrams[key] = dgram
+	}
+
+	// Check for overlaps before changing anything.
+	for _, existing := range dgram.fragments {
+		existingEnd := existing.offset + len(existing.data)
+		if frag.offset >= existingEnd || end <= existing.offset {
+			continue
+		}
+		if frag.offset == existing.offset && bytes.Equal(frag.data, existing.data) {
+			// A duplicate, perhaps from a second copy of a mirrored packet
+			return nil, nil
+		}
+		d.discard(key)
+		stats.AddFragmentOverlap()
+		return nil, fmt.Errorf("Overlapping IP fragments")
+	}
+	if !more {
+		if dgram.total >= 0 && dgram.total != end {
+			d.discard(key)
+			stats.AddFragmentOverlap()
+			return nil, fmt.Errorf("Conflicting IP datagram lengths")
+		}
+		dgram.total = end
+	}
+	if dgram.total >= 0 && end > dgram.total {
+		d.discard(key)
+		return nil, fmt.Errorf("IP fragment beyond end of datagram")
+	}
+	if len(dgram.fragments) >= maxFragmentsPerDatagram {
+		d.discard(key)
+		return nil, fmt.Errorf("Too many IP fragments")
+	}
+
+	// Copy the fragment, since the packet's buffer may be reused.
+	frag.data = append([]byte(nil), frag.data...)
+	dgram.fragments = append(dgram.fragments, frag)
+	dgram.size += len(frag.data)
+	d.size += len(frag.data)
+	if frag.offset == 0 {
+		dgram.first = append([]byte(nil), template.first...)
+		dgram.ipStart = template.ipStart
+		dgram.nextProto = template.nextProto
+		dgram.protocol = template.protocol
+		dgram.size += len(dgram.first)
+		d.size += len(dgram.first)
+	}
+	dgram.linkType = template.linkType
+	d.limitMemory()
+
+	// Is the datagram complete?  (It may have just been discarded to free
+	// memory.)
+	if _, ok := d.datagrams[key]; !ok {
+		return nil, nil
+	}
+	if dgram.total < 0 || dgram.first == nil {
+		return nil, nil
+	}
+	received := 0
+	for _, f := range dgram.fragments {
+		received += len(f.data)
+	}
+	if received != dgram.total {
+		return nil, nil
+	}
+	d.discard(key)
+	if dgram.length(key.ipv6) > maxDatagramSize {
+		// The payload fits, but not along with the headers.
+		return nil, fmt.Errorf("IP datagram too large")
+	}
+	return dgram.build(key.ipv6), nil
+}
+
+// length returns the length of a complete datagram as given in its IP header:
+// the total length of an IPv4 datagram, or the payload length (including any
+// extension headers) of an IPv6 datagram.
+func (dgram *datagram) length(isIPv6 bool) int {
+	if isIPv6 {
+		return len(dgram.first) - dgram.ipStart - ipv6HeaderLength + dgram.total
+	}
+	return len(dgram.first) - dgram.ipStart + dgram.total
+}
+
+// build puts a complete datagram back together, fixing up the IP header.
+func (dgram *datagram) build(isIPv6 bool) []byte {
+	whole := make([]byte, len(dgram.first)+dgram.total)
+	copy(whole, dgram.first)
+	payload := whole[len(dgram.first):]
+	for _, f := range dgram.fragments {
+		copy(payload[f.offset:], f.data)
+	}
+
+	if isIPv6 {
+		// Drop the fragment header by naming the payload's protocol in
+		// the header that preceded it.
+		whole[dgram.nextProto] = dgram.protocol
+		binary.BigEndian.PutUint16(whole[dgram.ipStart+4:], uint16(dgram.length(true)))
+		return whole
+	}
+
+	header := whole[dgram.ipStart:len(dgram.first)]
+	binary.BigEndian.PutUint16(header[2:], uint16(dgram.length(false)))
+	binary.BigEndian.PutUint16(header[6:], 0)
+	binary.BigEndian.PutUint16(header[10:], 0)
+	binary.BigEndian.PutUint16(header[10:], ipv4Checksum(header))
+	return whole
+}
+
+// discard forgets a datagram.
+func (d *Defragmenter) discard(key fragmentKey) {
+	if dgram, ok := d.datagrams[key]; ok {
+		d.size -= dgram.size
+		delete(d.datagrams, key)
+	}
+}
+
+// expire discards datagrams that have not been completed within the timeout.
+func (d *Defragmenter) expire(now time.Time) {
+	if now.Sub(d.lastExpiry) < fragmentExpiryInterval {
+		return
+	}
+	d.lastExpiry = now
+	cutoff := now.Add(-fragmentTimeout)
+	for key, dgram := range d.datagrams {
+		if dgram.created.Before(cutoff) {
+			d.discard(key)
+			stats.AddError(fmt.Errorf("IP datagram incomplete after timeout"))
+		}
+	}
+}
+
+// limitMemory discards the oldest datagrams until the buffered fragments fit
+// within the memory limit.
+func (d *Defragmenter) limitMemory() {
+	for d.size > maxFragmentMemory {
+		var oldestKey fragmentKey
+		var oldest *datagram
+		for key, dgram := range d.datagrams {
+			if oldest == nil || dgram.created.Before(oldest.created) {
+				oldestKey, oldest = key, dgram
+			}
+		}
+		if oldest == nil {
+			return
+		}
+		d.discard(oldestKey)
+		stats.AddError(fmt.Errorf("IP fragment memory exhausted"))
+	}
+}
+
+// networkLayerOffset finds where the outermost IP header starts in a packet's
+// data.
+func networkLayerOffset(packet gopacket.Packet) (int, bool, bool) {
+	offset := 0
+	for _, layer := range packet.Layers() {
+		switch layer.LayerType() {
+		case layers.LayerTypeIPv4:
+			return offset, false, true
+		case layers.LayerTypeIPv6:
+			return offset, true, true
+		}
+		offset += len(layer.LayerContents())
+	}
+	return 0, false, false
+}
+
+// parseIPv4Fragment extracts the fragment from an IPv4 packet, if it is one,
+// along with a template datagram holding the packet's headers.
+func parseIPv4Fragment(data []byte, ipStart int) (fragmentKey, fragment, bool, datagram, bool) {
+	var key fragmentKey
+	var dgram datagram
+	if len(data) < ipStart+20 {
+		return key, fragment{}, false, dgram, false
+	}
+	header := data[ipStart:]
+	ihl := int(header[0]&0x0f) * 4
+	totalLength := int(binary.BigEndian.Uint16(header[2:4]))
+	flagsOffset := binary.BigEndian.Uint16(header[6:8])
+	more := flagsOffset&ipv4MoreFragments != 0
+	offset := int(flagsOffset&ipv4OffsetMask) * 8
+	if !more && offset == 0 {
+		return key, fragment{}, false, dgram, false
+	}
+	if ihl < 20 || totalLength < ihl || totalLength > len(header) {
+		return key, fragment{}, false, dgram, false
+	}
+
+	key.id = uint32(binary.BigEndian.Uint16(header[4:6]))
+	key.protocol = header[9]
+	copy(key.src[:], header[12:16])
+	copy(key.dst[:], header[16:20])
+	dgram.first = data[:ipStart+ihl]
+	dgram.ipStart = ipStart
+	return key, fragment{offset: offset, data: header[ihl:totalLength]}, more, dgram, true
+}
+
+// parseIPv6Fragment extracts the fragment from an IPv6 packet, if it has a
+// fragment header, along with a template datagram holding the packet's headers
+// up to the fragment header.
+func parseIPv6Fragment(data []byte, ipStart int) (fragmentKey, fragment, bool, datagram, bool) {
+	var key fragmentKey
+	var dgram datagram
+	if len(data) < ipStart+ipv6HeaderLength {
+		return key, fragment{}, false, dgram, false
+	}
+	end := ipStart + ipv6HeaderLength + int(binary.BigEndian.Uint16(data[ipStart+4:ipStart+6]))
+	if end > len(data) {
+		return key, fragment{}, false, dgram, false
+	}
+
+	// Walk the extension headers that precede the fragment header.
+	nextProto := ipStart + 6
+	offset := ipStart + ipv6HeaderLength
+	for {
+		switch data[nextProto] {
+		case ipv6HopByHop, ipv6Routing, ipv6Destination:
+			if offset+2 > end {
+				return key, fragment{}, false, dgram, false
+			}
+			nextProto = offset
+			offset += (int(data[offset+1]) + 1) * 8
+			continue
+		case ipv6FragmentHdr:
+		default:
+			return key, fragment{}, false, dgram, false
+		}
+		break
+	}
+	if offset+ipv6FragmentLen > end {
+		return key, fragment{}, false, dgram, false
+	}
+
+	fragHeader := data[offset : offset+ipv6FragmentLen]
+	offsetMore := binary.BigEndian.Uint16(fragHeader[2:4])
+	key.ipv6 = true
+	key.id = binary.BigEndian.Uint32(fragHeader[4:8])
+	copy(key.src[:], data[ipStart+8:ipStart+24])
+	copy(key.dst[:], data[ipStart+24:ipStart+40])
+	dgram.first = data[:offset]
+	dgram.ipStart = ipStart
+	dgram.nextProto = nextProto
+	dgram.protocol = fragHeader[0]
+	frag := fragment{offset: int(offsetMore &^ 7), data: data[offset+ipv6FragmentLen : end]}
+	return key, frag, offsetMore&1 != 0, dgram, true
+}
+
+// ipv4Checksum computes the checksum of an IPv4 header.
+func ipv4Checksum(header []byte) uint16 {
+	var sum uint32
+	for i := 0; i+1 < len(header); i += 2 {
+		sum += uint32(binary.BigEndian.Uint16(header[i:]))
+	}
+	for sum > 0xffff {
+		sum = (sum >> 16) + (sum & 0xffff)
+	}
+	return ^uint16(sum)
+}
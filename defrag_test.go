@@ -0,0 +1,232 @@
+/*
+Unit tests for IPv4 and IPv6 defragmentation.
+*/
+package main
+
+import (
+	"encoding/binary"
+	"net"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/google/gopacket"
+	"github.com/google/gopacket/layers"
+)
+
+var (
+	testClientIPv6 = net.ParseIP("fe80::1")
+	testServerIPv6 = net.ParseIP("fe80::2")
+)
+
+// A UDP payload too large for one Ethernet frame
+var largeGreeting = "HELLO pump-" + strings.Repeat("9", 3000)
+
+// serializeUDP serializes a UDP datagram carrying largeGreeting over the given
+// IP layer.
+func serializeUDP(ip gopacket.NetworkLayer, etherType layers.EthernetType) []byte {
+	eth := &layers.Ethernet{
+		SrcMAC:       testClientMAC,
+		DstMAC:       testServerMAC,
+		EthernetType: etherType,
+	}
+	udp := &layers.UDP{SrcPort: 40000, DstPort: 40001}
+	udp.SetNetworkLayerForChecksum(ip)
+	buf := gopacket.NewSerializeBuffer()
+	opts := gopacket.SerializeOptions{FixLengths: true, ComputeChecksums: true}
+	err := gopacket.SerializeLayers(buf, opts, eth, ip.(gopacket.SerializableLayer), udp,
+		gopacket.Payload(largeGreeting))
+	if err != nil {
+		panic(err)
+	}
+	return buf.Bytes()
+}
+
+// fragmentIPv4 splits an Ethernet frame holding an IPv4 datagram into fragments
+// at the given payload offsets.
+func fragmentIPv4(frame []byte, cuts ...int) [][]byte {
+	header := frame[:14+20]
+	payload := frame[len(header):]
+	cuts = append(append([]int{0}, cuts...), len(payload))
+	var fragments [][]byte
+	for i := 0; i+1 < len(cuts); i++ {
+		chunk := payload[cuts[i]:cuts[i+1]]
+		frag := append(append([]byte(nil), header...), chunk...)
+		ip := frag[14:]
+		binary.BigEndian.PutUint16(ip[2:], uint16(20+len(chunk)))
+		flagsOffset := uint16(cuts[i] / 8)
+		if i+2 < len(cuts) {
+			flagsOffset |= ipv4MoreFragments
+		}
+		binary.BigEndian.PutUint16(ip[6:], flagsOffset)
+		fragments = append(fragments, frag)
+	}
+	return fragments
+}
+
+// fragmentIPv6 splits an Ethernet frame holding an IPv6 datagram into fragments
+// at the given payload offsets.
+func fragmentIPv6(frame []byte, cuts ...int) [][]byte {
+	header := frame[:14+ipv6HeaderLength]
+	payload := frame[len(header):]
+	nextHeader := header[14+6]
+	cuts = append(append([]int{0}, cuts...), len(payload))
+	var fragments [][]byte
+	for i := 0; i+1 < len(cuts); i++ {
+		chunk := payload[cuts[i]:cuts[i+1]]
+		frag := append([]byte(nil), header...)
+		frag[14+6] = ipv6FragmentHdr
+		binary.BigEndian.PutUint16(frag[14+4:], uint16(ipv6FragmentLen+len(chunk)))
+		offsetMore := uint16(cuts[i])
+		if i+2 < len(cuts) {
+			offsetMore |= 1
+		}
+		fragHeader := []byte{nextHeader, 0, 0, 0, 0, 0, 0x12, 0x34}
+		binary.BigEndian.PutUint16(fragHeader[2:], offsetMore)
+		frag = append(append(frag, fragHeader...), chunk...)
+		fragments = append(fragments, frag)
+	}
+	return fragments
+}
+
+// defragmentAll feeds fragments to a Defragmenter in the given order and
+// returns the reassembled packets.
+func defragmentAll(d *Defragmenter, fragments [][]byte, order ...int) []gopacket.Packet {
+	var out []gopacket.Packet
+	for i, n := range order {
+		packet := gopacket.NewPacket(fragments[n], layers.LayerTypeEthernet, gopacket.Default)
+		packet.Metadata().Timestamp = testStartTime.Add(time.Duration(i) * time.Millisecond)
+		if whole := d.Defragment(packet); whole != nil {
+			out = append(out, whole)
+		}
+	}
+	return out
+}
+
+// checkGreeting checks that a reassembled packet identifies the device that
+// sent largeGreeting.
+func checkGreeting(t *testing.T, packet gopacket.Packet) {
+	udp, ok := packet.TransportLayer().(*layers.UDP)
+	if !ok {
+		t.Fatalf("No UDP layer in reassembled packet")
+	}
+	if string(udp.LayerPayload()) != largeGreeting {
+		t.Fatalf("Wrong reassembled payload of %d bytes", len(udp.LayerPayload()))
+	}
+
+	inventory := NewInventory(0)
+	decoders := []PayloadDecoder{&helloDecoder{}}
+	handlePacket(packet, decoders, nil, inventory)
+	name := strings.TrimPrefix(largeGreeting, "HELLO ")
+	if inventory.Len() != 1 || inventory.Assets()[0].Identifier != name {
+		t.Errorf("Reassembled datagram did not identify the device")
+	}
+}
+
+func TestDefragmentIPv4(t *testing.T) {
+	setupLogging(false)
+	stats = *NewStats()
+	ip4 := &layers.IPv4{
+		Version:  4,
+		TTL:      64,
+		Id:       0x1234,
+		Protocol: layers.IPProtocolUDP,
+		SrcIP:    testClientIP,
+		DstIP:    testServerIP,
+	}
+	fragments := fragmentIPv4(serializeUDP(ip4, layers.EthernetTypeIPv4), 1480, 2960)
+
+	out := defragmentAll(NewDefragmenter(), fragments, 2, 0, 1)
+	if len(out) != 1 {
+		t.Fatalf("Expected 1 reassembled packet, got %d", len(out))
+	}
+	checkGreeting(t, out[0])
+	if ip := out[0].NetworkLayer().(*layers.IPv4); ip.Flags&layers.IPv4MoreFragments != 0 || ip.FragOffset != 0 {
+		t.Errorf("Reassembled packet still looks like a fragment")
+	}
+}
+
+func TestDefragmentIPv6(t *testing.T) {
+	setupLogging(false)
+	stats = *NewStats()
+	ip6 := &layers.IPv6{
+		Version:    6,
+		HopLimit:   64,
+		NextHeader: layers.IPProtocolUDP,
+		SrcIP:      testClientIPv6,
+		DstIP:      testServerIPv6,
+	}
+	fragments := fragmentIPv6(serializeUDP(ip6, layers.EthernetTypeIPv6), 1448)
+
+	out := defragmentAll(NewDefragmenter(), fragments, 1, 0)
+	if len(out) != 1 {
+		t.Fatalf("Expected 1 reassembled packet, got %d", len(out))
+	}
+	checkGreeting(t, out[0])
+}
+
+func TestDefragmentOverlap(t *testing.T) {
+	setupLogging(false)
+	stats = *NewStats()
+	ip4 := &layers.IPv4{
+		Version:  4,
+		TTL:      64,
+		Id:       0x1234,
+		Protocol: layers.IPProtocolUDP,
+		SrcIP:    testClientIP,
+		DstIP:    testServerIP,
+	}
+	frame := serializeUDP(ip4, layers.EthernetTypeIPv4)
+	fragments := fragmentIPv4(frame, 1480)
+
+	// A rewritten second fragment that starts inside the first one and
+	// disagrees with the original second fragment
+	evil := fragmentIPv4(frame, 1472)[1]
+	evil[len(evil)-1] ^= 0xff
+	fragments = append(fragments, evil)
+
+	if out := defragmentAll(NewDefragmenter(), fragments, 0, 2, 1); len(out) != 0 {
+		t.Errorf("Datagram with overlapping fragments was reassembled")
+	}
+	if stats.FragmentOverlaps != 1 {
+		t.Errorf("Expected 1 fragment overlap, got %d", stats.FragmentOverlaps)
+	}
+
+	// Duplicates are harmless.
+	if out := defragmentAll(NewDefragmenter(), fragments, 0, 0, 1); len(out) != 1 {
+		t.Errorf("Datagram with duplicate fragments was not reassembled")
+	}
+}
+
+func TestDefragmentTooLarge(t *testing.T) {
+	setupLogging(false)
+	stats = *NewStats()
+	ip4 := &layers.IPv4{
+		Version:  4,
+		TTL:      64,
+		Id:       0x1234,
+		Protocol: layers.IPProtocolUDP,
+		SrcIP:    testClientIP,
+		DstIP:    testServerIP,
+	}
+
+	// The payload is as large as a datagram can be, leaving no room for the
+	// header.
+	header := serializeUDP(ip4, layers.EthernetTypeIPv4)[:14+20]
+	frame := append(append([]byte(nil), header...), make([]byte, maxDatagramSize)...)
+	fragments := fragmentIPv4(frame, 32768, 65528)
+	if out := defragmentAll(NewDefragmenter(), fragments, 0, 1, 2); len(out) != 0 {
+		t.Errorf("Datagram too large for its header was reassembled")
+	}
+	if stats.Errors["IP datagram too large"] != 1 {
+		t.Errorf("Datagram too large not reported: %v", stats.Errors)
+	}
+}
+
+func TestDefragmentLeavesWholePacketsAlone(t *testing.T) {
+	setupLogging(false)
+	packet := buildTCPPacket(1000, "hello")
+	if NewDefragmenter().Defragment(packet) != packet {
+		t.Errorf("Unfragmented packet was replaced")
+	}
+}
@@ -23,6 +23,29 @@ const defaultMaxPDUSize uint32 = 4 << 20
 
 const typeAAssociateRq = 0x01
 
+// A-ABORT is the highest-numbered PDU type defined in DICOM part 8
+const typeAAbort = 0x07
+
+// Every PDU starts with a type byte, a reserved byte, and a 4-byte length
+const pduHeaderLength = 6
+
+// The PDU header and fixed fields of an associate request take 74 bytes;
+// variable items follow.
+const associateRqFixedLength = 74
+
+// Variable item types
+const (
+	itemUserInformation          = 0x50
+	subItemImplementationVersion = 0x55
+)
+
+// AE titles are configured by hand and are often generic, so they are weaker
+// evidence than a version string baked into the device's software.
+const (
+	dicomAETitleConfidence = 0.6
+	dicomVersionConfidence = 0.8
+)
+
 // DicomDecoder receives application-layer payloads and, when possible, extracts
 // identifying information from DICOM messages therein.
 type DicomDecoder struct{}
@@ -42,20 +65,90 @@ func (decoder *DicomDecoder) Initialize() error {
 }
 
 // DecodePayload extracts device identifiers from an application-layer payload.
-func (decoder *DicomDecoder) DecodePayload(app *gopacket.ApplicationLayer) (string, string, error) {
-	var appReader io.Reader = bytes.NewReader((*app).Payload())
+func (decoder *DicomDecoder) DecodePayload(app *gopacket.ApplicationLayer) (*Observation, error) {
+	payload := (*app).Payload()
+	var appReader io.Reader = bytes.NewReader(payload)
 
 	identifier, err := detectDicomAssociateIdentifier(appReader)
 
 	if err != nil {
 		logger.Println("Not a DICOM packet")
-		return "", "", fmt.Errorf("Not a DICOM packet")
+		return nil, fmt.Errorf("Not a DICOM packet")
 	}
 
-	// Hard code provenance (suboptimal but OK)
-	provenance := "DICOM"
+	obs := NewObservation()
+	obs.Add(AttrAETitle, identifier, "DICOM", dicomAETitleConfidence)
+
+	// The variable items following the fixed part of the associate request
+	// may announce the implementation's version.
+	pduEnd := pduHeaderLength + int(binary.BigEndian.Uint32(payload[2:pduHeaderLength]))
+	if pduEnd > len(payload) {
+		pduEnd = len(payload)
+	}
+	if version := dicomImplementationVersion(payload[associateRqFixedLength:pduEnd]); version != "" {
+		obs.Add(AttrSoftwareVersion, version, "DICOM implementation version", dicomVersionConfidence)
+	}
+
+	return obs, nil
+}
+
+// dicomImplementationVersion walks the variable items of an associate request
+// looking for the Implementation Version Name sub-item of the User Information
+// item.
+//
+// http://dicom.nema.org/medical/dicom/current/output/chtml/part07/sect_D.3.3.2.html
+func dicomImplementationVersion(items []byte) string {
+	for len(items) >= 4 {
+		itemType := items[0]
+		itemLength := int(binary.BigEndian.Uint16(items[2:4]))
+		if 4+itemLength > len(items) {
+			return ""
+		}
+		item := items[4 : 4+itemLength]
+		items = items[4+itemLength:]
+		if itemType != itemUserInformation {
+			continue
+		}
 
-	return identifier, provenance, nil
+		// User Information sub-items share the same layout.
+		for len(item) >= 4 {
+			subType := item[0]
+			subLength := int(binary.BigEndian.Uint16(item[2:4]))
+			if 4+subLength > len(item) {
+				return ""
+			}
+			if subType == subItemImplementationVersion {
+				return strings.TrimSpace(string(item[4 : 4+subLength]))
+			}
+			item = item[4+subLength:]
+		}
+	}
+	return ""
+}
+
+// MessageLength finds the end of the DICOM PDU at the start of a reassembled
+// TCP stream.  Every PDU begins with a 6-byte header announcing its length.
+func (decoder *DicomDecoder) MessageLength(buf []byte, final bool) (int, error) {
+	if len(buf) > 0 && (buf[0] < typeAAssociateRq || buf[0] > typeAAbort) {
+		return 0, fmt.Errorf("Type '%d' not a DICOM PDU", buf[0])
+	}
+	if len(buf) > 1 && buf[1] != 0x00 {
+		return 0, fmt.Errorf("Reserved byte should have been 0x00, was 0x%x", buf[1])
+	}
+	if len(buf) < pduHeaderLength {
+		if final {
+			return len(buf), nil
+		}
+		return 0, nil
+	}
+	length := binary.BigEndian.Uint32(buf[2:pduHeaderLength])
+	if length >= defaultMaxPDUSize*2 {
+		return 0, fmt.Errorf("Invalid length %d; it's much larger than max PDU size of %d", length, defaultMaxPDUSize)
+	}
+	if final && int(length)+pduHeaderLength > len(buf) {
+		return len(buf), nil
+	}
+	return int(length) + pduHeaderLength, nil
 }
 
 // Accept an io.Reader, detects whether it is a DICOM associate
@@ -9,7 +9,6 @@ import (
 	"testing"
 
 	"github.com/google/gopacket"
-	"github.com/google/gopacket/pcap"
 
 	// import layers to run its init function
 	_ "github.com/google/gopacket/layers"
@@ -40,10 +39,11 @@ func TestDicomFile(t *testing.T) {
 }
 
 func findDicomIdentifierInPcap(testfile string) string {
-	handle, err := pcap.OpenOffline(testfile)
+	handle, closeHandle, err := openOffline(testfile, "")
 	if err != nil {
 		panic(err)
 	}
+	defer closeHandle()
 
 	var identifier string
 	packetSource := gopacket.NewPacketSource(handle, handle.LinkType())
@@ -53,7 +53,7 @@ func findDicomIdentifierInPcap(testfile string) string {
 		if app == nil {
 			continue // Ignore packets without an application layer
 		}
-		identifier, _, _ = dicomDecoder.DecodePayload(&app)
+		identifier = dicomIdentifier(&app)
 		if identifier != "" {
 			break // Found an identifier in one of the packets, breaking out of the loop
 		}
@@ -61,6 +61,17 @@ func findDicomIdentifierInPcap(testfile string) string {
 	return identifier
 }
 
+// dicomIdentifier returns the identifier the DICOM decoder finds in an
+// application layer, or "" if it finds none.
+func dicomIdentifier(app *gopacket.ApplicationLayer) string {
+	obs, err := dicomDecoder.DecodePayload(app)
+	if err != nil {
+		return ""
+	}
+	ident, _ := obs.Attributes.Identifier()
+	return ident.Value
+}
+
 // A "canonically good" application layer packet
 var goodAppLayerBytes = []byte{
 	1,           // type (Assoc Request)
@@ -81,7 +92,7 @@ func TestDicomAppLayerGood(t *testing.T) {
 	copy(appBytes, goodAppLayerBytes)
 
 	appLayer := gopacket.ApplicationLayer(gopacket.Payload(appBytes))
-	identifier, _, _ := dicomDecoder.DecodePayload(&appLayer)
+	identifier := dicomIdentifier(&appLayer)
 
 	if identifier == "" {
 		t.Errorf("Failed to find identifier in payload %s", appBytes)
@@ -129,7 +140,7 @@ func TestAETitleWhitespace(t *testing.T) {
 		copy(appBytes[offsetCallingAET:], []byte(tt.callingTitle))
 
 		appLayer := gopacket.ApplicationLayer(gopacket.Payload(appBytes))
-		identifier, _, _ := dicomDecoder.DecodePayload(&appLayer)
+		identifier := dicomIdentifier(&appLayer)
 		if identifier != tt.expectedID {
 			t.Errorf("Bad identifier: expected '%s', got '%s'", tt.expectedID, identifier)
 		}
@@ -163,9 +174,48 @@ func TestAEBadBytes(t *testing.T) {
 		appBytes[tt.offset] = tt.badByte
 
 		appLayer := gopacket.ApplicationLayer(gopacket.Payload(appBytes))
-		identifier, _, _ := dicomDecoder.DecodePayload(&appLayer)
+		identifier := dicomIdentifier(&appLayer)
 		if identifier != "" {
 			t.Errorf("Bad byte '%x' in offset '%d' should have caused decoding to fail", tt.badByte, tt.offset)
 		}
 	}
 }
+
+func TestDicomMessageLength(t *testing.T) {
+	var decoder DicomDecoder
+
+	if n, err := decoder.MessageLength(goodAppLayerBytes, false); err != nil || n != 74 {
+		t.Errorf("Wrong PDU length %d (%v)", n, err)
+	}
+	if n, err := decoder.MessageLength(goodAppLayerBytes[:4], false); err != nil || n != 0 {
+		t.Errorf("Expected to need more data, got %d (%v)", n, err)
+	}
+	if _, err := decoder.MessageLength([]byte("GET /"), false); err == nil {
+		t.Errorf("Expected an error from a non-DICOM stream")
+	}
+}
+
+func TestDicomImplementationVersion(t *testing.T) {
+	handle, closeHandle, err := openOffline("testdata/dicom_arq_1_find_testclient.pcap", "")
+	if err != nil {
+		panic(err)
+	}
+	defer closeHandle()
+
+	packetSource := gopacket.NewPacketSource(handle, handle.LinkType())
+	for packet := range packetSource.Packets() {
+		app := packet.ApplicationLayer()
+		if app == nil {
+			continue
+		}
+		obs, err := dicomDecoder.DecodePayload(&app)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if attr := obs.Attributes[AttrSoftwareVersion]; attr.Value != "GODICOM_1_1" {
+			t.Errorf("Wrong implementation version: '%s'", attr.Value)
+		}
+		return
+	}
+	t.Errorf("No DICOM payload found")
+}
@@ -0,0 +1,200 @@
+// Copyright 2019 Virta Laboratories, Inc.  All rights reserved.
+/*
+Asset change events.
+
+Security teams want to hear about changes on the network rather than read every
+update to every inventory record, so the Inventory reports explicit events when:
+
+  - a device it has never seen before appears (new_device);
+  - a known device moves to a new IPv4 or IPv6 address (address_change);
+  - a known device reports a different value for a kind of identifier it
+    reported before, such as a different UDI (identifier_change); or
+  - a device has not been seen for longer than a timeout (device_lost).
+
+Events are delivered to listeners one at a time and in the order they happened.
+Events are written as JSON to standard output, to their own CSV file, and to a
+REST API endpoint, as requested by the user.
+*/
+
+package main
+
+import (
+	"encoding/csv"
+	"encoding/json"
+	"fmt"
+	"os"
+	"sync"
+	"time"
+)
+
+// Types of AssetEvent
+const (
+	EventNewDevice        = "new_device"
+	EventAddressChange    = "address_change"
+	EventIdentifierChange = "identifier_change"
+	EventDeviceLost       = "device_lost"
+)
+
+// An AssetEvent describes a change to the inventory.  For changes to one field
+// of a record, Field names it (using the Asset's JSON field name) and OldValue
+// and NewValue hold its values before and after the change.
+type AssetEvent struct {
+	Type     string    `json:"event_type"`
+	Time     time.Time `json:"time"`
+	Field    string    `json:"field,omitempty"`
+	OldValue string    `json:"old_value,omitempty"`
+	NewValue string    `json:"new_value,omitempty"`
+	Asset    *Asset    `json:"asset"`
+	ClientID string    `json:"client_id"`
+}
+
+// changeEvents compares an inventory record before and after an observation
+// was merged into it and returns an event for each change of interest.
+func changeEvents(before, after *Asset) []*AssetEvent {
+	var events []*AssetEvent
+	fieldChange := func(eventType, field, oldValue, newValue string) {
+		if oldValue == "" || oldValue == newValue {
+			return
+		}
+		events = append(events, &AssetEvent{
+			Type:     eventType,
+			Time:     after.LastSeen,
+			Field:    field,
+			OldValue: oldValue,
+			NewValue: newValue,
+			Asset:    after,
+		})
+	}
+	fieldChange(EventAddressChange, "ipv4_address", before.IPv4Address, after.IPv4Address)
+	fieldChange(EventAddressChange, "ipv6_address", before.IPv6Address, after.IPv6Address)
+	// A device that reveals a more specific kind of identifier is the same
+	// device; only a new value for the same kind of identifier is a change.
+	for _, name := range identifierAttributes {
+		fieldChange(EventIdentifierChange, name, before.Attributes[name].Value, after.Attributes[name].Value)
+	}
+	return events
+}
+
+// reportEvent writes an AssetEvent to standard output, a CSV file, and a REST
+// API endpoint, as requested by the user.
+func reportEvent(event *AssetEvent, apiClient *APIClient, eventCSVWriter *EventCSVWriter) {
+	// Write to stdout and stderr
+	bytesRepresentation, err := json.Marshal(event)
+	if err != nil {
+		stats.AddError(err)
+	}
+	stringRepresentation := string(bytesRepresentation)
+	if verbose {
+		fmt.Println(stringRepresentation)
+	}
+	logger.Println(stringRepresentation)
+
+	// Write to CSV file if requested by the user.
+	if eventCSVWriter != nil {
+		if err := eventCSVWriter.Append(event); err != nil {
+			stats.AddError(err)
+		}
+	}
+
+	// Upload to API if requested by the user.
+	if apiClient != nil && apiClient.enabled {
+		if _, err := apiClient.UploadEvent(event); err != nil {
+			logger.Println("API Upload error:", err)
+			stats.AddUploadError(err)
+		} else {
+			stats.AddUpload()
+		}
+	}
+}
+
+// EventCSVWriter contains the state needed to write AssetEvents to a CSV file
+type EventCSVWriter struct {
+	sync.Mutex
+	filehandle *os.File
+	csvWriter  *csv.Writer
+}
+
+// NewEventCSVWriter creates (or appends to) a file and writes a CSV header.
+//
+// If filename is "-", write to standard output instead of a file.  If filename
+// is empty, return nil.
+func NewEventCSVWriter(filename string) (*EventCSVWriter, error) {
+	if filename == "" {
+		return nil, nil
+	}
+
+	w := new(EventCSVWriter)
+	if filename == "-" {
+		w.filehandle = os.Stdout
+	} else {
+		file, err := os.OpenFile(filename, os.O_APPEND|os.O_CREATE|os.O_WRONLY, 0644)
+		if err != nil {
+			return nil, err
+		}
+		w.filehandle = file
+	}
+	w.csvWriter = csv.NewWriter(w.filehandle)
+
+	// Write CSV header
+	header := []string{
+		"event_type",
+		"time",
+		"field",
+		"old_value",
+		"new_value",
+		"ipv4_address",
+		"ipv6_address",
+		"mac_address",
+		"identifier",
+		"provenance",
+		"first_seen",
+		"last_seen",
+	}
+	if err := w.csvWriter.Write(header); err != nil {
+		return nil, err
+	}
+
+	// Flush buffer to file
+	w.csvWriter.Flush()
+	if err := w.csvWriter.Error(); err != nil {
+		return nil, err
+	}
+	return w, nil
+}
+
+// Close closes the CSV writer's underlying filehandle.
+func (w *EventCSVWriter) Close() {
+	w.Lock()
+	defer w.Unlock()
+	w.filehandle.Close()
+}
+
+// Append appends one AssetEvent to a file in CSV format.
+func (w *EventCSVWriter) Append(event *AssetEvent) error {
+	w.Lock()
+	defer w.Unlock()
+
+	// Write CSV row
+	asset := event.Asset
+	row := []string{
+		event.Type,
+		event.Time.String(),
+		event.Field,
+		event.OldValue,
+		event.NewValue,
+		asset.IPv4Address,
+		asset.IPv6Address,
+		asset.MACAddress,
+		asset.Identifier,
+		asset.Provenance,
+		asset.FirstSeen.String(),
+		asset.LastSeen.String(),
+	}
+	if err := w.csvWriter.Write(row); err != nil {
+		return err
+	}
+
+	// Flush buffer to file
+	w.csvWriter.Flush()
+	return w.csvWriter.Error() // may be nil
+}
@@ -0,0 +1,194 @@
+/*
+Unit tests for asset change events.
+*/
+package main
+
+import (
+	"io/ioutil"
+	"os"
+	"strings"
+	"testing"
+	"time"
+)
+
+// collectEvents returns an Inventory that appends every event it reports to
+// the returned slice.
+func collectEvents(lostTimeout time.Duration) (*Inventory, *[]*AssetEvent) {
+	setupLogging(false)
+	stats = *NewStats()
+	var events []*AssetEvent
+	inv := NewInventory(lostTimeout)
+	inv.OnEvent(func(event *AssetEvent) {
+		events = append(events, event)
+	})
+	return inv, &events
+}
+
+func TestEventNewDevice(t *testing.T) {
+	inv, events := collectEvents(0)
+	t0 := time.Date(2019, 1, 1, 0, 0, 0, 0, time.UTC)
+
+	inv.Observe(observedAsset("11:22:33:44:55:66", "10.0.0.1", "", t0, nil))
+	inv.Observe(observedAsset("11:22:33:44:55:66", "10.0.0.1", "", t0.Add(time.Second), nil))
+	inv.WaitEvents()
+	if len(*events) != 1 {
+		t.Fatalf("Expected 1 event, got %d", len(*events))
+	}
+	if event := (*events)[0]; event.Type != EventNewDevice || event.Asset.IPv4Address != "10.0.0.1" {
+		t.Errorf("Unexpected event %+v", event)
+	}
+}
+
+func TestEventHasItsOwnCopy(t *testing.T) {
+	inv, events := collectEvents(0)
+	var changes []*Asset
+	inv.OnChange(func(asset *Asset) {
+		asset.ClientID = "listener" // as an API client might
+		changes = append(changes, asset)
+	})
+	inv.Observe(observedAsset("11:22:33:44:55:66", "10.0.0.1", "", time.Now(), nil))
+	inv.WaitEvents()
+	if len(*events) != 1 || len(changes) != 1 {
+		t.Fatalf("Expected 1 event and 1 change, got %d and %d", len(*events), len(changes))
+	}
+	if (*events)[0].Asset == changes[0] {
+		t.Errorf("Event shares its asset with change listeners")
+	}
+}
+
+func TestEventAddressChange(t *testing.T) {
+	inv, events := collectEvents(0)
+	t0 := time.Date(2019, 1, 1, 0, 0, 0, 0, time.UTC)
+
+	inv.Observe(observedAsset("11:22:33:44:55:66", "10.0.0.1", "", t0, nil))
+	inv.Observe(observedAsset("11:22:33:44:55:66", "10.0.0.2", "", t0.Add(time.Second), nil))
+	inv.WaitEvents()
+	if len(*events) != 2 {
+		t.Fatalf("Expected 2 events, got %d", len(*events))
+	}
+	event := (*events)[1]
+	if event.Type != EventAddressChange || event.Field != "ipv4_address" ||
+		event.OldValue != "10.0.0.1" || event.NewValue != "10.0.0.2" {
+		t.Errorf("Unexpected event %+v", event)
+	}
+}
+
+func TestEventIdentifierChange(t *testing.T) {
+	inv, events := collectEvents(0)
+	t0 := time.Date(2019, 1, 1, 0, 0, 0, 0, time.UTC)
+	udi := func(value string) Attributes {
+		return Attributes{AttrUDIDI: {Value: value, Provenance: "HL7 PRT-16", Confidence: 0.9}}
+	}
+
+	// A pump is swapped for another one on the same network port.
+	inv.Observe(observedAsset("11:22:33:44:55:66", "10.0.0.1", "", t0, udi("PUMP-1")))
+	inv.Observe(observedAsset("11:22:33:44:55:66", "10.0.0.1", "", t0.Add(time.Second), udi("PUMP-2")))
+	inv.WaitEvents()
+	if len(*events) != 3 {
+		t.Fatalf("Expected 3 events, got %d", len(*events))
+	}
+	if (*events)[1].Type != EventNewDevice {
+		t.Errorf("The new pump is not a new device: %+v", (*events)[1])
+	}
+	event := (*events)[2]
+	if event.Type != EventIdentifierChange || event.OldValue != "PUMP-1" || event.NewValue != "PUMP-2" {
+		t.Errorf("Unexpected event %+v", event)
+	}
+}
+
+func TestEventMoreSpecificIdentifier(t *testing.T) {
+	inv, events := collectEvents(0)
+	t0 := time.Date(2019, 1, 1, 0, 0, 0, 0, time.UTC)
+
+	// A device known by its DICOM AE title then reveals its UDI.  It is
+	// still the same device.
+	inv.Observe(observedAsset("11:22:33:44:55:66", "10.0.0.1", "", t0, Attributes{
+		AttrAETitle: {Value: "PUMP_AE", Provenance: "DICOM", Confidence: dicomAETitleConfidence},
+	}))
+	inv.Observe(observedAsset("11:22:33:44:55:66", "10.0.0.1", "", t0.Add(time.Second), Attributes{
+		AttrUDIDI: {Value: "PUMP-1", Provenance: "HL7 PRT-16", Confidence: 0.9},
+	}))
+	inv.WaitEvents()
+	if len(*events) != 1 {
+		t.Fatalf("Expected 1 event, got %d: %+v", len(*events), (*events)[1:])
+	}
+	if inv.Assets()[0].Identifier != "PUMP-1" {
+		t.Errorf("The UDI did not become the identifier")
+	}
+}
+
+func TestEventDeviceLost(t *testing.T) {
+	inv, events := collectEvents(time.Hour)
+	t0 := time.Date(2019, 1, 1, 0, 0, 0, 0, time.UTC)
+
+	inv.Observe(observedAsset("11:22:33:44:55:66", "10.0.0.1", "", t0, nil))
+	inv.Observe(observedAsset("aa:bb:cc:dd:ee:ff", "10.0.0.2", "", t0.Add(30*time.Minute), nil))
+	inv.Observe(observedAsset("aa:bb:cc:dd:ee:ff", "10.0.0.2", "", t0.Add(2*time.Hour), nil))
+	inv.WaitEvents()
+	if len(*events) != 3 {
+		t.Fatalf("Expected 3 events, got %d", len(*events))
+	}
+	event := (*events)[2]
+	if event.Type != EventDeviceLost || event.Asset.MACAddress != "11:22:33:44:55:66" {
+		t.Errorf("Unexpected event %+v", event)
+	}
+
+	// A lost device is reported only once, and comes back when seen again.
+	inv.Observe(observedAsset("aa:bb:cc:dd:ee:ff", "10.0.0.2", "", t0.Add(3*time.Hour), nil))
+	inv.WaitEvents()
+	if len(*events) != 3 {
+		t.Errorf("Expected no more events, got %d", len(*events))
+	}
+	inv.Observe(observedAsset("11:22:33:44:55:66", "10.0.0.1", "", t0.Add(4*time.Hour), nil))
+	if record := inv.Assets()[0]; record.Missing {
+		t.Errorf("Device seen again is still missing")
+	}
+}
+
+func TestEventDeviceLostWithoutTraffic(t *testing.T) {
+	inv, events := collectEvents(time.Hour)
+	t0 := time.Date(2019, 1, 1, 0, 0, 0, 0, time.UTC)
+
+	inv.Observe(observedAsset("11:22:33:44:55:66", "10.0.0.1", "", t0, nil))
+	inv.CheckLost(t0.Add(30 * time.Minute))
+	inv.WaitEvents()
+	if len(*events) != 1 {
+		t.Fatalf("Expected 1 event, got %d", len(*events))
+	}
+	inv.CheckLost(t0.Add(2 * time.Hour))
+	inv.WaitEvents()
+	if len(*events) != 2 {
+		t.Fatalf("Expected 2 events, got %d", len(*events))
+	}
+	if event := (*events)[1]; event.Type != EventDeviceLost || !event.Time.Equal(t0.Add(2*time.Hour)) {
+		t.Errorf("Unexpected event %+v", event)
+	}
+}
+
+func TestEventCSV(t *testing.T) {
+	w, err := NewEventCSVWriter("events.csv")
+	defer os.Remove("events.csv")
+	if err != nil {
+		panic(err)
+	}
+	w.Append(&AssetEvent{
+		Type:     EventAddressChange,
+		Field:    "ipv4_address",
+		OldValue: "10.0.0.1",
+		NewValue: "10.0.0.2",
+		Asset:    &Asset{IPv4Address: "10.0.0.2", MACAddress: "11:22:33:44:55:66"},
+	})
+	w.Close()
+
+	actual, err := ioutil.ReadFile("events.csv")
+	if err != nil {
+		panic(err)
+	}
+	lines := strings.Split(strings.TrimSpace(string(actual)), "\n")
+	if len(lines) != 2 {
+		t.Fatalf("Expected header and 1 row, got %q", actual)
+	}
+	if !strings.HasPrefix(lines[1], "address_change,0001-01-01 00:00:00 +0000 UTC,ipv4_address,10.0.0.1,10.0.0.2,10.0.0.2,,11:22:33:44:55:66,") {
+		t.Errorf("Unexpected CSV row %q", lines[1])
+	}
+}
@@ -0,0 +1,754 @@
+// Copyright 2019 Virta Laboratories, Inc.  All rights reserved.
+/*
+Packet filter expressions compiled in Go.
+
+Builds without libpcap cannot use its compiler, so they compile filter
+expressions to BPF programs here instead.  Live capture attaches the program to
+the socket, so the kernel drops unwanted packets, and packets read from files
+are run through it in a BPF virtual machine.  The common part of the
+pcap-filter(7) language is understood:
+
+ ip, ip6, arp, tcp, udp, icmp, icmp6, vlan [id]
+ [ether|ip|ip6|arp] [src|dst] host <address>
+ [ip|ip6|arp] [src|dst] net <address/prefix>
+ [tcp|udp] [src|dst] port <number>
+ [tcp|udp] [src|dst] portrange <number>-<number>
+
+combined with and (&&), or (||), not (!) and parentheses.  The programs test
+the same header fields as libpcap's do, so an expression means the same in
+either build: and and or have equal precedence and group left to right, a port
+without tcp or udp may be an SCTP port too, and only tests after vlan look
+inside a VLAN tag, since vlan moves each later test 4 bytes into the frame.  As
+with tcpdump, a bare value repeats the qualifiers before it, so "port 104 or
+11112" matches either port.
+*/
+
+package main
+
+import (
+	"encoding/binary"
+	"fmt"
+	"net"
+	"strconv"
+	"strings"
+
+	"github.com/google/gopacket"
+	"github.com/google/gopacket/layers"
+	"golang.org/x/net/bpf"
+)
+
+const (
+	// What a filter program returns for a packet it keeps, as libpcap does
+	filterAccept = 262144
+
+	// The longest program a kernel accepts as a socket filter
+	maxFilterLength = 4096
+
+	etherTypeRARP = 0x8035
+)
+
+// EtherTypes of VLAN tags
+var vlanEtherTypes = []uint32{0x8100, 0x88a8, 0x9100}
+
+// A packetFilter decides which captured packets to keep.  pcap.BPF is one.
+type packetFilter interface {
+	Matches(ci gopacket.CaptureInfo, data []byte) bool
+}
+
+// A goFilter is a filter expression compiled to BPF in Go.
+type goFilter struct {
+	program []bpf.RawInstruction
+	vm      *bpf.VM
+}
+
+// Matches runs a packet through the filter program.
+func (f *goFilter) Matches(ci gopacket.CaptureInfo, data []byte) bool {
+	n, err := f.vm.Run(data)
+	return err == nil && n > 0
+}
+
+// A filterLink describes the headers of a link type, as far as filters need
+// to know them.
+type filterLink struct {
+	ethernet  bool // whether frames have MAC addresses and may have VLAN tags
+	typeAt    int  // offset of the EtherType, or -1 if there is none
+	networkAt int  // offset of the network-layer header
+
+	// Address families that stand in for EtherTypes on loopback links
+	families map[layers.EthernetType][]uint32
+}
+
+// BSD address families, in either byte order for Null links, which use the
+// order of the capturing host
+var (
+	nullFamilies = map[layers.EthernetType][]uint32{
+		layers.EthernetTypeIPv4: {2, 0x02000000},
+		layers.EthernetTypeIPv6: {24, 28, 30, 0x18000000, 0x1c000000, 0x1e000000},
+	}
+	loopFamilies = map[layers.EthernetType][]uint32{
+		layers.EthernetTypeIPv4: {2},
+		layers.EthernetTypeIPv6: {24, 28, 30},
+	}
+)
+
+// Link types that filters can be compiled for
+var filterLinks = map[layers.LinkType]filterLink{
+	layers.LinkTypeEthernet: {ethernet: true, typeAt: 12, networkAt: 14},
+	layers.LinkTypeLinuxSLL: {typeAt: 14, networkAt: 16},
+	layers.LinkTypeRaw:      {typeAt: -1, networkAt: 0},
+	layers.LinkTypeIPv4:     {typeAt: -1, networkAt: 0},
+	layers.LinkTypeIPv6:     {typeAt: -1, networkAt: 0},
+	layers.LinkTypeNull:     {typeAt: -1, networkAt: 4, families: nullFamilies},
+	layers.LinkTypeLoop:     {typeAt: -1, networkAt: 4, families: loopFamilies},
+}
+
+// compileGoFilter compiles a filter expression for packets of a link type.
+func compileGoFilter(linkType layers.LinkType, expr string) (*goFilter, error) {
+	link, ok := filterLinks[linkType]
+	if !ok {
+		return nil, fmt.Errorf("Filter expressions for %s captures need libpcap", linkType)
+	}
+	p := &filterParser{tokens: tokenizeFilter(expr), link: link}
+	code, err := p.expression()
+	if err != nil {
+		return nil, err
+	}
+	if p.pos < len(p.tokens) {
+		return nil, fmt.Errorf("Unexpected '%s' in filter expression", p.tokens[p.pos])
+	}
+
+	c := &filterCompiler{}
+	accept, reject := c.label(), c.label()
+	code(c, accept, reject)
+	c.place(accept)
+	c.emit(bpf.RetConstant{Val: filterAccept})
+	c.place(reject)
+	c.emit(bpf.RetConstant{Val: 0})
+	instructions, err := c.program()
+	if err != nil {
+		return nil, err
+	}
+	program, err := bpf.Assemble(instructions)
+	if err != nil {
+		return nil, err
+	}
+	vm, err := bpf.NewVM(instructions)
+	if err != nil {
+		return nil, err
+	}
+	return &goFilter{program: program, vm: vm}, nil
+}
+
+// tokenizeFilter splits a filter expression into words, operators and
+// parentheses.
+func tokenizeFilter(expr string) []string {
+	for _, op := range []string{"(", ")", "&&", "||", "!"} {
+		expr = strings.Replace(expr, op, " "+op+" ", -1)
+	}
+	return strings.Fields(expr)
+}
+
+// Qualifiers of a primitive, as in "tcp dst port"
+type filterQualifiers struct {
+	proto, dir, kind string
+}
+
+var (
+	filterProtos = map[string]bool{
+		"ether": true, "ip": true, "ip6": true, "arp": true,
+		"tcp": true, "udp": true, "icmp": true, "icmp6": true, "vlan": true,
+	}
+	filterDirs  = map[string]bool{"src": true, "dst": true}
+	filterKinds = map[string]bool{"host": true, "net": true, "port": true, "portrange": true}
+)
+
+// A filterParser is a recursive-descent parser of filter expressions.
+type filterParser struct {
+	tokens []string
+	pos    int
+	last   *filterQualifiers // qualifiers repeated by a bare value
+	link   filterLink
+	vlans  int // VLAN tags that later tests look inside
+}
+
+func (p *filterParser) peek() string {
+	if p.pos < len(p.tokens) {
+		return p.tokens[p.pos]
+	}
+	return ""
+}
+
+func (p *filterParser) next() string {
+	tok := p.peek()
+	p.pos++
+	return tok
+}
+
+// expression := factor { (and|or) factor }
+func (p *filterParser) expression() (filterCode, error) {
+	left, err := p.factor()
+	if err != nil {
+		return nil, err
+	}
+	for {
+		var combine func(...filterCode) filterCode
+		switch p.peek() {
+		case "and", "&&":
+			combine = filterAll
+		case "or", "||":
+			combine = filterAny
+		default:
+			return left, nil
+		}
+		p.next()
+		right, err := p.factor()
+		if err != nil {
+			return nil, err
+		}
+		left = combine(left, right)
+	}
+}
+
+// factor := not factor | ( expression ) | primitive
+func (p *filterParser) factor() (filterCode, error) {
+	switch p.peek() {
+	case "not", "!":
+		p.next()
+		inner, err := p.factor()
+		if err != nil {
+			return nil, err
+		}
+		return filterNot(inner), nil
+	case "(":
+		p.next()
+		inner, err := p.expression()
+		if err != nil {
+			return nil, err
+		}
+		if p.next() != ")" {
+			return nil, fmt.Errorf("Missing ')' in filter expression")
+		}
+		return inner, nil
+	case "":
+		return nil, fmt.Errorf("Incomplete filter expression")
+	}
+	return p.primitive()
+}
+
+// primitive := [proto] [dir] [kind] [value]
+func (p *filterParser) primitive() (filterCode, error) {
+	var q filterQualifiers
+	if filterProtos[p.peek()] {
+		q.proto = p.next()
+	}
+	if filterDirs[p.peek()] {
+		q.dir = p.next()
+	}
+	if filterKinds[p.peek()] {
+		q.kind = p.next()
+	}
+
+	if q.proto == "vlan" && q.dir == "" && q.kind == "" {
+		return p.vlan()
+	}
+	if q == (filterQualifiers{}) {
+		// A bare value repeats the previous qualifiers.
+		if p.last == nil {
+			q.kind = "host"
+		} else {
+			q = *p.last
+		}
+	} else if q.kind == "" {
+		if q.dir == "" {
+			return p.proto(q.proto)
+		}
+		q.kind = "host"
+	}
+	p.last = &q
+
+	value := p.next()
+	switch value {
+	case "", "(", ")", "and", "&&", "or", "||":
+		return nil, fmt.Errorf("Missing value after '%s' in filter expression", q.kind)
+	}
+	switch q.kind {
+	case "host":
+		return p.host(q, value)
+	case "net":
+		_, network, err := net.ParseCIDR(value)
+		if err != nil {
+			return nil, fmt.Errorf("Bad network '%s' in filter expression", value)
+		}
+		bits, _ := network.Mask.Size()
+		return p.addresses(q, network.IP, bits)
+	case "port":
+		port, err := strconv.ParseUint(value, 10, 16)
+		if err != nil {
+			return nil, fmt.Errorf("Bad port '%s' in filter expression", value)
+		}
+		return p.ports(q, uint32(port), uint32(port))
+	default: // portrange
+		bounds := strings.SplitN(value, "-", 2)
+		if len(bounds) == 2 {
+			low, err1 := strconv.ParseUint(bounds[0], 10, 16)
+			high, err2 := strconv.ParseUint(bounds[1], 10, 16)
+			if err1 == nil && err2 == nil && low <= high {
+				return p.ports(q, uint32(low), uint32(high))
+			}
+		}
+		return nil, fmt.Errorf("Bad port range '%s' in filter expression", value)
+	}
+}
+
+// typeAt returns the offset of the EtherType, after any VLAN tags.
+func (p *filterParser) typeAt() uint32 {
+	return uint32(p.link.typeAt + 4*p.vlans)
+}
+
+// networkAt returns the offset of the network-layer header, after any VLAN
+// tags.
+func (p *filterParser) networkAt() uint32 {
+	return uint32(p.link.networkAt + 4*p.vlans)
+}
+
+// vlan matches VLAN-tagged frames, with a particular VLAN ID if one follows,
+// and makes later tests look inside the tag.
+func (p *filterParser) vlan() (filterCode, error) {
+	if !p.link.ethernet {
+		return nil, fmt.Errorf("VLAN tags in filter expression need Ethernet frames")
+	}
+	var tagged []filterCode
+	for _, etherType := range vlanEtherTypes {
+		tagged = append(tagged, filterCompare(loadAt(p.typeAt(), 2), 0, bpf.JumpEqual, etherType))
+	}
+	test := filterAny(tagged...)
+	if id, err := strconv.ParseUint(p.peek(), 10, 12); err == nil {
+		p.next()
+		test = filterAll(test, filterCompare(loadAt(p.typeAt()+2, 2), 0x0fff, bpf.JumpEqual, uint32(id)))
+	}
+	p.vlans++
+	return test, nil
+}
+
+// etherType matches packets of a network protocol, given by its EtherType.
+func (p *filterParser) etherType(etherType layers.EthernetType) filterCode {
+	switch {
+	case p.link.typeAt >= 0:
+		return filterCompare(loadAt(p.typeAt(), 2), 0, bpf.JumpEqual, uint32(etherType))
+	case p.link.families != nil:
+		var tests []filterCode
+		for _, family := range p.link.families[etherType] {
+			tests = append(tests, filterCompare(loadAt(0, 4), 0, bpf.JumpEqual, family))
+		}
+		return filterAny(tests...)
+	}
+	// Raw IP packets are told apart by their version.
+	switch etherType {
+	case layers.EthernetTypeIPv4:
+		return filterCompare(loadAt(p.networkAt(), 1), 0xf0, bpf.JumpEqual, 0x40)
+	case layers.EthernetTypeIPv6:
+		return filterCompare(loadAt(p.networkAt(), 1), 0xf0, bpf.JumpEqual, 0x60)
+	}
+	return filterAny()
+}
+
+// ipProtocol matches IPv4 and IPv6 packets carrying a protocol.  As with
+// libpcap, an IPv6 fragment header may come first.
+func (p *filterParser) ipProtocol(proto layers.IPProtocol, ipv4, ipv6 bool) filterCode {
+	var tests []filterCode
+	if ipv4 {
+		tests = append(tests, filterAll(
+			p.etherType(layers.EthernetTypeIPv4),
+			filterCompare(loadAt(p.networkAt()+9, 1), 0, bpf.JumpEqual, uint32(proto)),
+		))
+	}
+	if ipv6 {
+		next := loadAt(p.networkAt()+6, 1)
+		tests = append(tests, filterAll(
+			p.etherType(layers.EthernetTypeIPv6),
+			filterAny(
+				filterCompare(next, 0, bpf.JumpEqual, uint32(proto)),
+				filterAll(
+					filterCompare(next, 0, bpf.JumpEqual, uint32(layers.IPProtocolIPv6Fragment)),
+					filterCompare(loadAt(p.networkAt()+40, 1), 0, bpf.JumpEqual, uint32(proto)),
+				),
+			),
+		))
+	}
+	return filterAny(tests...)
+}
+
+// proto matches packets of a protocol.
+func (p *filterParser) proto(proto string) (filterCode, error) {
+	switch proto {
+	case "ip":
+		return p.etherType(layers.EthernetTypeIPv4), nil
+	case "ip6":
+		return p.etherType(layers.EthernetTypeIPv6), nil
+	case "arp":
+		return p.etherType(layers.EthernetTypeARP), nil
+	case "tcp":
+		return p.ipProtocol(layers.IPProtocolTCP, true, true), nil
+	case "udp":
+		return p.ipProtocol(layers.IPProtocolUDP, true, true), nil
+	case "icmp":
+		return p.ipProtocol(layers.IPProtocolICMPv4, true, false), nil
+	case "icmp6":
+		return p.ipProtocol(layers.IPProtocolICMPv6, false, true), nil
+	}
+	return nil, fmt.Errorf("Missing value after '%s' in filter expression", proto)
+}
+
+// direction applies the test of a source or destination field (or either), as
+// chosen by the qualifiers.
+func direction(q filterQualifiers, src, dst filterCode) filterCode {
+	switch q.dir {
+	case "src":
+		return src
+	case "dst":
+		return dst
+	}
+	return filterAny(src, dst)
+}
+
+// host matches packets to or from a MAC or IP address.
+func (p *filterParser) host(q filterQualifiers, value string) (filterCode, error) {
+	if mac, err := net.ParseMAC(value); err == nil && len(mac) == 6 {
+		if q.proto != "" && q.proto != "ether" {
+			return nil, fmt.Errorf("MAC address with '%s' in filter expression", q.proto)
+		}
+		if !p.link.ethernet {
+			return nil, fmt.Errorf("MAC address in filter expression needs Ethernet frames")
+		}
+		return direction(q, matchAddress(6, mac, 48), matchAddress(0, mac, 48)), nil
+	}
+	ip := net.ParseIP(value)
+	if ip == nil {
+		return nil, fmt.Errorf("Bad host '%s' in filter expression", value)
+	}
+	if q.proto == "ether" {
+		return nil, fmt.Errorf("Bad MAC address '%s' in filter expression", value)
+	}
+	return p.addresses(q, ip, 8*len(ip))
+}
+
+// addresses matches packets to or from the addresses that share the first bits
+// of an IP address.  IPv4 addresses are found in ARP and RARP packets too
+// unless the ip qualifier is given, as with libpcap.
+func (p *filterParser) addresses(q filterQualifiers, ip net.IP, bits int) (filterCode, error) {
+	at := p.networkAt()
+	if ip4 := ip.To4(); ip4 != nil {
+		if len(ip) == net.IPv6len {
+			bits -= 8 * (net.IPv6len - net.IPv4len)
+		}
+		inIP := filterAll(p.etherType(layers.EthernetTypeIPv4),
+			direction(q, matchAddress(at+12, ip4, bits), matchAddress(at+16, ip4, bits)))
+		inARP := func(etherType layers.EthernetType) filterCode {
+			return filterAll(p.etherType(etherType),
+				direction(q, matchAddress(at+14, ip4, bits), matchAddress(at+24, ip4, bits)))
+		}
+		switch q.proto {
+		case "":
+			return filterAny(inIP, inARP(layers.EthernetTypeARP), inARP(etherTypeRARP)), nil
+		case "ip":
+			return inIP, nil
+		case "arp":
+			return inARP(layers.EthernetTypeARP), nil
+		}
+		return nil, fmt.Errorf("IPv4 address with '%s' in filter expression", q.proto)
+	}
+	if q.proto != "" && q.proto != "ip6" {
+		return nil, fmt.Errorf("IPv6 address with '%s' in filter expression", q.proto)
+	}
+	return filterAll(p.etherType(layers.EthernetTypeIPv6),
+		direction(q, matchAddress(at+8, ip, bits), matchAddress(at+24, ip, bits))), nil
+}
+
+// ports matches TCP, UDP or SCTP packets to or from a range of ports.  As
+// with libpcap, only the first fragment of an IPv4 datagram has ports.
+func (p *filterParser) ports(q filterQualifiers, low, high uint32) (filterCode, error) {
+	var protos []layers.IPProtocol
+	switch q.proto {
+	case "":
+		protos = []layers.IPProtocol{layers.IPProtocolTCP, layers.IPProtocolUDP, layers.IPProtocolSCTP}
+	case "tcp":
+		protos = []layers.IPProtocol{layers.IPProtocolTCP}
+	case "udp":
+		protos = []layers.IPProtocol{layers.IPProtocolUDP}
+	default:
+		return nil, fmt.Errorf("Port with '%s' in filter expression", q.proto)
+	}
+	at := p.networkAt()
+	var in4, in6 []filterCode
+	for _, proto := range protos {
+		in4 = append(in4, filterCompare(loadAt(at+9, 1), 0, bpf.JumpEqual, uint32(proto)))
+		in6 = append(in6, filterCompare(loadAt(at+6, 1), 0, bpf.JumpEqual, uint32(proto)))
+	}
+	ipv4 := filterAll(
+		p.etherType(layers.EthernetTypeIPv4),
+		filterAny(in4...),
+		filterCompare(loadAt(at+6, 2), 0, bpf.JumpBitsNotSet, 0x1fff),
+		filterLoad(bpf.LoadMemShift{Off: at}),
+		direction(q,
+			filterRange(bpf.LoadIndirect{Off: at, Size: 2}, low, high),
+			filterRange(bpf.LoadIndirect{Off: at + 2, Size: 2}, low, high)),
+	)
+	ipv6 := filterAll(
+		p.etherType(layers.EthernetTypeIPv6),
+		filterAny(in6...),
+		direction(q,
+			filterRange(loadAt(at+40, 2), low, high),
+			filterRange(loadAt(at+42, 2), low, high)),
+	)
+	return filterAny(ipv4, ipv6), nil
+}
+
+// loadAt loads a field from a fixed offset.
+func loadAt(offset uint32, size int) bpf.Instruction {
+	return bpf.LoadAbsolute{Off: offset, Size: size}
+}
+
+// A filterCode emits the instructions of a test, which jump to yes if it
+// passes and to no if it fails.
+type filterCode func(c *filterCompiler, yes, no filterLabel)
+
+// filterAll passes if every test passes.
+func filterAll(tests ...filterCode) filterCode {
+	return func(c *filterCompiler, yes, no filterLabel) {
+		for _, test := range tests {
+			next := c.label()
+			test(c, next, no)
+			c.place(next)
+		}
+		c.jump(yes)
+	}
+}
+
+// filterAny passes if any test passes.
+func filterAny(tests ...filterCode) filterCode {
+	return func(c *filterCompiler, yes, no filterLabel) {
+		for _, test := range tests {
+			next := c.label()
+			test(c, yes, next)
+			c.place(next)
+		}
+		c.jump(no)
+	}
+}
+
+// filterNot passes if a test fails.
+func filterNot(test filterCode) filterCode {
+	return func(c *filterCompiler, yes, no filterLabel) {
+		test(c, no, yes)
+	}
+}
+
+// filterLoad executes a load and passes.
+func filterLoad(load bpf.Instruction) filterCode {
+	return func(c *filterCompiler, yes, no filterLabel) {
+		c.emit(load)
+		c.jump(yes)
+	}
+}
+
+// filterCompare loads a field, masks it if a mask is given, and compares it
+// with a value.
+func filterCompare(load bpf.Instruction, mask uint32, cond bpf.JumpTest, value uint32) filterCode {
+	return func(c *filterCompiler, yes, no filterLabel) {
+		c.emit(load)
+		if mask != 0 {
+			c.emit(bpf.ALUOpConstant{Op: bpf.ALUOpAnd, Val: mask})
+		}
+		c.jumpIf(cond, value, yes, no)
+	}
+}
+
+// filterRange loads a field and passes if it lies between low and high.
+func filterRange(load bpf.Instruction, low, high uint32) filterCode {
+	if low == high {
+		return filterCompare(load, 0, bpf.JumpEqual, low)
+	}
+	return func(c *filterCompiler, yes, no filterLabel) {
+		c.emit(load)
+		next := c.label()
+		c.jumpIf(bpf.JumpGreaterOrEqual, low, next, no)
+		c.place(next)
+		c.jumpIf(bpf.JumpLessOrEqual, high, yes, no)
+	}
+}
+
+// matchAddress compares the first bits of an address with those of the
+// address at an offset, a word at a time.
+func matchAddress(offset uint32, addr []byte, bits int) filterCode {
+	mask := make([]byte, len(addr))
+	for i := range mask {
+		if bits >= 8*(i+1) {
+			mask[i] = 0xff
+		} else if bits > 8*i {
+			mask[i] = 0xff << uint(8*(i+1)-bits)
+		}
+	}
+	var tests []filterCode
+	for i := 0; i < len(addr); {
+		size := 4
+		if len(addr)-i < size {
+			size = len(addr) - i
+		}
+		word, wordMask := addressWord(addr[i:i+size]), addressWord(mask[i:i+size])
+		switch wordMask {
+		case 0:
+		case addressWord([]byte{0xff, 0xff, 0xff, 0xff}[:size]):
+			tests = append(tests, filterCompare(loadAt(offset+uint32(i), size), 0, bpf.JumpEqual, word))
+		default:
+			tests = append(tests, filterCompare(loadAt(offset+uint32(i), size), wordMask, bpf.JumpEqual, word&wordMask))
+		}
+		i += size
+	}
+	return filterAll(tests...)
+}
+
+// addressWord reads up to 4 bytes of an address as a big-endian number.
+func addressWord(b []byte) uint32 {
+	var word [4]byte
+	copy(word[4-len(b):], b)
+	return binary.BigEndian.Uint32(word[:])
+}
+
+// A filterLabel names a place in a program being compiled.
+type filterLabel int
+
+// A filterStep is an instruction of a program being compiled, a jump to
+// labels, or the place of a label.
+type filterStep struct {
+	insn    bpf.Instruction // an instruction that does not jump
+	jump    bool            // a jump to yes, or to yes or no if cond is set
+	cond    *bpf.JumpIf
+	yes, no filterLabel
+	label   filterLabel // placed here, if nothing else is set
+}
+
+// A filterCompiler collects the steps of a program.
+type filterCompiler struct {
+	steps  []filterStep
+	labels int
+}
+
+func (c *filterCompiler) label() filterLabel {
+	c.labels++
+	return filterLabel(c.labels)
+}
+
+func (c *filterCompiler) place(label filterLabel) {
+	c.steps = append(c.steps, filterStep{label: label})
+}
+
+func (c *filterCompiler) emit(insn bpf.Instruction) {
+	c.steps = append(c.steps, filterStep{insn: insn})
+}
+
+func (c *filterCompiler) jump(to filterLabel) {
+	c.steps = append(c.steps, filterStep{jump: true, yes: to})
+}
+
+func (c *filterCompiler) jumpIf(cond bpf.JumpTest, value uint32, yes, no filterLabel) {
+	c.steps = append(c.steps, filterStep{jump: true, cond: &bpf.JumpIf{Cond: cond, Val: value}, yes: yes, no: no})
+}
+
+// program lays out the steps and returns the instructions.  Jumps to the very
+// next instruction are left out.  A conditional jump reaches at most 255
+// instructions ahead, so one that must go further goes by way of an
+// unconditional jump placed right after it.
+func (c *filterCompiler) program() ([]bpf.Instruction, error) {
+	var steps []filterStep
+	for i, step := range c.steps {
+		if step.jump && step.cond == nil && c.fallsThrough(i, step.yes) {
+			continue
+		}
+		steps = append(steps, step)
+	}
+
+	for {
+		at, length := filterLayout(steps)
+		if length > maxFilterLength {
+			return nil, fmt.Errorf("Filter expression is too long")
+		}
+		var laidOut []filterStep
+		var far bool
+		n := 0
+		for _, step := range steps {
+			if step.insn == nil && !step.jump {
+				laidOut = append(laidOut, step)
+				continue
+			}
+			n++
+			if step.cond == nil {
+				laidOut = append(laidOut, step)
+				continue
+			}
+			var trampolines []filterStep
+			for _, to := range []*filterLabel{&step.yes, &step.no} {
+				if at[*to]-n > 255 {
+					c.labels++
+					trampolines = append(trampolines,
+						filterStep{label: filterLabel(c.labels)},
+						filterStep{jump: true, yes: *to})
+					*to = filterLabel(c.labels)
+					far = true
+				}
+			}
+			laidOut = append(laidOut, step)
+			laidOut = append(laidOut, trampolines...)
+		}
+		steps = laidOut
+		if !far {
+			break
+		}
+	}
+
+	at, _ := filterLayout(steps)
+	var instructions []bpf.Instruction
+	for _, step := range steps {
+		n := len(instructions) + 1
+		switch {
+		case step.cond != nil:
+			insn := *step.cond
+			insn.SkipTrue = uint8(at[step.yes] - n)
+			insn.SkipFalse = uint8(at[step.no] - n)
+			instructions = append(instructions, insn)
+		case step.jump:
+			instructions = append(instructions, bpf.Jump{Skip: uint32(at[step.yes] - n)})
+		case step.insn != nil:
+			instructions = append(instructions, step.insn)
+		}
+	}
+	return instructions, nil
+}
+
+// fallsThrough reports whether a label is placed right after a step, with no
+// instructions in between.
+func (c *filterCompiler) fallsThrough(i int, label filterLabel) bool {
+	for _, step := range c.steps[i+1:] {
+		if step.insn != nil || step.jump {
+			return false
+		}
+		if step.label == label {
+			return true
+		}
+	}
+	return false
+}
+
+// filterLayout returns the position of each label in a sequence of steps, and
+// the number of instructions.
+func filterLayout(steps []filterStep) (map[filterLabel]int, int) {
+	at := make(map[filterLabel]int)
+	n := 0
+	for _, step := range steps {
+		if step.insn == nil && !step.jump {
+			at[step.label] = n
+		} else {
+			n++
+		}
+	}
+	return at, n
+}
@@ -0,0 +1,175 @@
+/*
+Unit tests for filter expressions compiled in Go.
+*/
+package main
+
+import (
+	"fmt"
+	"strings"
+	"testing"
+
+	"github.com/google/gopacket"
+	"github.com/google/gopacket/layers"
+)
+
+// filterTests are run through the filter compiler of each capture backend,
+// which must agree on whether each expression matches a TCP segment, a UDP
+// datagram and a TCP segment tagged with VLAN 100.
+var filterTests = []struct {
+	expr             string
+	tcp, udp, tagged bool
+}{
+	{"tcp", true, false, false},
+	{"not udp", true, false, true},
+	{"ip and not ip6", true, true, false},
+	{"tcp port 2575", true, false, false},
+	{"udp port 2575", false, false, false},
+	{"port 104 or 2575", true, true, false},
+	{"dst port 104 || src port 104", false, true, false},
+	{"src port 2575", false, false, false},
+	{"portrange 100-200", false, true, false},
+	{"tcp dst portrange 2000-3000", true, false, false},
+	{"src host " + testClientIP.String(), true, true, false},
+	{"dst host " + testClientIP.String(), false, false, false},
+	{"host " + testServerMAC.String(), true, true, true},
+	{"ether src " + testServerMAC.String(), false, false, false},
+	{"net 10.0.0.0/8", true, true, false},
+	{"not net 192.168.0.0/16", true, true, true},
+	{"(tcp or udp) and !arp", true, true, false},
+	{"ip6 or icmp", false, false, false},
+
+	// and and or have equal precedence and group left to right.
+	{"udp or tcp and port 2575", true, false, false},
+	{"tcp or udp and port 104", false, true, false},
+	{"not tcp and udp", false, true, false},
+	{"tcp or not udp", true, false, true},
+
+	// Only tests after vlan look inside the tag.
+	{"vlan", false, false, true},
+	{"vlan 100", false, false, true},
+	{"vlan 200", false, false, false},
+	{"vlan and tcp dst port 2575", false, false, true},
+	{"vlan 100 and src host " + testClientIP.String(), false, false, true},
+	{"tcp and vlan", false, false, false},
+}
+
+// filterTestPackets returns the packets that filterTests are matched against.
+func filterTestPackets() [][]byte {
+	tcp := buildTCPPacket(1000, "hello") // testClientPort -> testServerPort
+	udp := buildUDPPacket(40000, 104, "DICM")
+	eth := &layers.Ethernet{
+		SrcMAC:       testClientMAC,
+		DstMAC:       testServerMAC,
+		EthernetType: layers.EthernetTypeDot1Q,
+	}
+	tag := &layers.Dot1Q{VLANIdentifier: 100, Type: layers.EthernetTypeIPv4}
+	return [][]byte{tcp.Data(), udp.Data(), serializeIPv4TCP(eth, tag)}
+}
+
+// checkFilters runs filterTests through a filter compiler.
+func checkFilters(t *testing.T, compile func(layers.LinkType, string) (packetFilter, error)) {
+	packets := filterTestPackets()
+	for _, c := range filterTests {
+		filter, err := compile(layers.LinkTypeEthernet, c.expr)
+		if err != nil {
+			t.Errorf("%s: %v", c.expr, err)
+			continue
+		}
+		for i, want := range []bool{c.tcp, c.udp, c.tagged} {
+			if got := filter.Matches(gopacket.CaptureInfo{}, packets[i]); got != want {
+				t.Errorf("%s: %s packet matched %v", c.expr, []string{"TCP", "UDP", "tagged"}[i], got)
+			}
+		}
+	}
+}
+
+func TestGoFilter(t *testing.T) {
+	checkFilters(t, func(linkType layers.LinkType, expr string) (packetFilter, error) {
+		return compileGoFilter(linkType, expr)
+	})
+}
+
+func TestGoFilterLinkTypes(t *testing.T) {
+	sll := append([]byte{0, 0, 0, 1, 0, 6}, testClientMAC...)
+	sll = append(sll, 0, 0, 0x08, 0x00)
+	null := []byte{2, 0, 0, 0}
+
+	cases := []struct {
+		linkType layers.LinkType
+		data     []byte
+	}{
+		{layers.LinkTypeLinuxSLL, serializeIPv4TCP(gopacket.Payload(sll))},
+		{layers.LinkTypeRaw, serializeIPv4TCP()},
+		{layers.LinkTypeNull, serializeIPv4TCP(gopacket.Payload(null))},
+	}
+	for _, c := range cases {
+		for expr, want := range map[string]bool{
+			"ip and tcp port 2575":              true,
+			"src host " + testClientIP.String(): true,
+			"ip6 or udp":                        false,
+		} {
+			filter, err := compileGoFilter(c.linkType, expr)
+			if err != nil {
+				t.Errorf("%s: %s: %v", c.linkType, expr, err)
+				continue
+			}
+			if got := filter.Matches(gopacket.CaptureInfo{}, c.data); got != want {
+				t.Errorf("%s: %s matched %v", c.linkType, expr, got)
+			}
+		}
+	}
+	if _, err := compileGoFilter(layers.LinkTypeRaw, "vlan"); err == nil {
+		t.Errorf("VLAN test accepted for raw IP packets")
+	}
+}
+
+func TestGoFilterLongJumps(t *testing.T) {
+	// Enough ports that conditional jumps cannot reach the end directly
+	var ports []string
+	for port := 3000; port < 3040; port++ {
+		ports = append(ports, fmt.Sprint(port))
+	}
+	expr := "port " + strings.Join(ports, " or ")
+	packets := filterTestPackets()
+	for _, c := range []struct {
+		expr     string
+		tcp, udp bool
+	}{
+		{expr, false, false},
+		{expr + " or 2575", true, false},
+		{"port 104 or " + expr, false, true},
+	} {
+		filter, err := compileGoFilter(layers.LinkTypeEthernet, c.expr)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if len(filter.program) < 256 {
+			t.Fatalf("Expected a long program, got %d instructions", len(filter.program))
+		}
+		if got := filter.Matches(gopacket.CaptureInfo{}, packets[0]); got != c.tcp {
+			t.Errorf("TCP packet matched %v", got)
+		}
+		if got := filter.Matches(gopacket.CaptureInfo{}, packets[1]); got != c.udp {
+			t.Errorf("UDP packet matched %v", got)
+		}
+	}
+}
+
+func TestGoFilterErrors(t *testing.T) {
+	for _, expr := range []string{
+		"port abc",
+		"portrange 3000-2000",
+		"(tcp",
+		"tcp and",
+		"host nowhere",
+		"net 10.0.0.0",
+		"icmp port 80",
+		"tcp[13]=2",
+		"tcp host 10.0.0.1",
+		"ip6 host 10.0.0.1",
+	} {
+		if _, err := compileGoFilter(layers.LinkTypeEthernet, expr); err == nil {
+			t.Errorf("Bad filter expression '%s' was accepted", expr)
+		}
+	}
+}
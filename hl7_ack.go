@@ -0,0 +1,144 @@
+// Copyright 2019 Virta Laboratories, Inc.  All rights reserved.
+/*
+Pairing HL7 messages with their acknowledgments.
+
+The receiver of an HL7 message answers it with an acknowledgment whose MSA
+segment gives an acknowledgment code and the control ID (MSH-10) of the message
+it acknowledges.  The code is AA (or CA) if the message was accepted, AE (or
+CE) if it was rejected for an error in its content, and AR (or CR) if it was
+rejected outright.  A device whose messages are rejected is usually a sign of
+a broken integration, long before anyone notices missing data in the EHR.
+
+Whoever sends acknowledgments is a receiver, which we report as its hl7_role.
+By remembering when each message was sent, we also count each sender's
+accepted, rejected and unacknowledged messages, and measure how long their
+acknowledgments take, in the statistics.
+
+A control ID need only be unique among the messages of one sending system, and
+many devices simply count 1, 2, 3...  So a message is known by its sending
+application and facility (MSH-3 and MSH-4) as well as its control ID, and an
+acknowledgment names the message it acknowledges by its own receiving
+application and facility (MSH-5 and MSH-6) and MSA-2.
+*/
+
+package main
+
+import (
+	"sync"
+	"time"
+)
+
+// The hl7_role of systems that acknowledge HL7 messages
+const hl7RoleReceiver = "receiver"
+
+const (
+	// How long (in observation time) to wait for an acknowledgment
+	hl7AckTimeout = 5 * time.Minute
+
+	// Most messages to remember at once while awaiting acknowledgment
+	hl7MaxPending = 100000
+)
+
+// An hl7PendingMessage is a message awaiting acknowledgment.
+type hl7PendingMessage struct {
+	sender string
+	sent   time.Time
+}
+
+// hl7Exchanges pairs HL7 messages with their acknowledgments.
+type hl7Exchanges struct {
+	sync.Mutex
+	pending   map[string]hl7PendingMessage // by sender and control ID (hl7MessageID)
+	lastSweep time.Time
+}
+
+// hl7MessageID identifies a message by the application and facility that sent
+// it and its control ID, or returns "" if there is no control ID.
+func hl7MessageID(application, facility, controlID string) string {
+	if controlID == "" {
+		return ""
+	}
+	// A field cannot contain the field separator.
+	return application + "|" + facility + "|" + controlID
+}
+
+// newHL7Exchanges returns an hl7Exchanges awaiting no acknowledgments.
+func newHL7Exchanges() *hl7Exchanges {
+	return &hl7Exchanges{pending: make(map[string]hl7PendingMessage)}
+}
+
+// Correlate remembers an HL7 message until it is acknowledged, or pairs an
+// acknowledgment with the message it acknowledges.
+func (decoder *HL7Decoder) Correlate(obs *Observation, sender *Asset) {
+	if decoder.exchanges != nil {
+		decoder.exchanges.add(obs, sender)
+	}
+}
+
+// add records one message.
+func (exchanges *hl7Exchanges) add(obs *Observation, sender *Asset) {
+	exchanges.Lock()
+	defer exchanges.Unlock()
+	now := sender.LastSeen
+	exchanges.sweep(now)
+
+	if obs.Acknowledges != "" {
+		message, ok := exchanges.pending[obs.Acknowledges]
+		if !ok {
+			logger.Printf("  HL7 acknowledgment of unknown message %s", obs.Acknowledges)
+			return
+		}
+		delete(exchanges.pending, obs.Acknowledges)
+		latency := now.Sub(message.sent)
+		if latency < 0 {
+			latency = 0
+		}
+		logger.Printf("  HL7 message %s from %s acknowledged with %s after %v",
+			obs.Acknowledges, message.sender, obs.AckCode, latency)
+		stats.AddHL7Acknowledgment(message.sender, obs.AckCode, latency)
+		return
+	}
+
+	if obs.MessageID == "" {
+		return
+	}
+	if len(exchanges.pending) >= hl7MaxPending {
+		logger.Printf("  Too many HL7 messages awaiting acknowledgment; not tracking %s", obs.MessageID)
+		return
+	}
+	exchanges.pending[obs.MessageID] = hl7PendingMessage{
+		sender: exchangeParty(obs, sender),
+		sent:   now,
+	}
+}
+
+// sweep forgets messages that were not acknowledged in time, counting them as
+// unacknowledged.
+func (exchanges *hl7Exchanges) sweep(now time.Time) {
+	if now.Sub(exchanges.lastSweep) < hl7AckTimeout {
+		return
+	}
+	exchanges.lastSweep = now
+	cutoff := now.Add(-hl7AckTimeout)
+	for id, message := range exchanges.pending {
+		if message.sent.Before(cutoff) {
+			delete(exchanges.pending, id)
+			stats.AddHL7Unacknowledged(message.sender)
+		}
+	}
+}
+
+// exchangeParty names the sender of a message in statistics: by its address,
+// which every message from it shares, or failing that by the identifier the
+// message gave.
+func exchangeParty(obs *Observation, sender *Asset) string {
+	for _, address := range []string{sender.IPv4Address, sender.IPv6Address, sender.MACAddress} {
+		if address != "" {
+			return address
+		}
+	}
+	if ident, ok := obs.Attributes.Identifier(); ok {
+		return ident.Value
+	}
+	return "unknown"
+}
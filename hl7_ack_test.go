@@ -0,0 +1,115 @@
+/*
+Unit tests for pairing HL7 messages with their acknowledgments.
+*/
+package main
+
+import (
+	"testing"
+	"time"
+
+	"github.com/google/gopacket"
+)
+
+// hl7Exchange decodes an HL7 message sent by the device at an address at a
+// time, returning the Assets decodeMessages made of it.
+func hl7Exchange(t *testing.T, decoder *HL7Decoder, address string, sent time.Time, message string) []*Asset {
+	assets, ok := decodeMessages(decoder, []byte(message), &Asset{IPv4Address: address, LastSeen: sent})
+	if !ok {
+		t.Fatalf("Message not understood: %q", message)
+	}
+	return assets
+}
+
+// hl7Ack returns an acknowledgment of a message sent by an application and
+// facility, given as "application|facility".
+func hl7Ack(to, code, controlID string) string {
+	return "MSH|^~\\&|EHR|HOSP|" + to + "|20190102123457||ACK^R01^ACK|ACK-" + controlID + "|P|2.6\r" +
+		"MSA|" + code + "|" + controlID + "\r"
+}
+
+func TestHL7Acknowledgments(t *testing.T) {
+	setupLogging(false)
+	stats = *NewStats()
+	decoder := &HL7Decoder{}
+	if err := decoder.Initialize(); err != nil {
+		t.Fatal(err)
+	}
+	t0 := time.Date(2019, 1, 2, 12, 34, 56, 0, time.UTC)
+
+	hl7Exchange(t, decoder, "10.0.0.7", t0, okHL7Header)
+	hl7Exchange(t, decoder, "10.0.0.7", t0, pcdHL7Message)
+	receiver := hl7Exchange(t, decoder, "10.0.0.1", t0.Add(20*time.Millisecond), hl7Ack("Sender|Sender Facility", "AA", "CNTRL-12345"))
+	hl7Exchange(t, decoder, "10.0.0.1", t0.Add(40*time.Millisecond), hl7Ack("PUMP-GW|ICU", "AR", "MSG-1"))
+	hl7Exchange(t, decoder, "10.0.0.1", t0.Add(50*time.Millisecond), hl7Ack("PUMP-GW|ICU", "AR", "MSG-1")) // repeated
+
+	if len(receiver) != 1 || receiver[0].Attributes[AttrHL7Role].Value != hl7RoleReceiver {
+		t.Errorf("Receiver not recognized: %+v", receiver)
+	}
+	expected := HL7AckCounts{Accepted: 1, Rejected: 1, MeanLatency: 30, MaxLatency: 40}
+	if counts := stats.HL7Acknowledgments["10.0.0.7"]; counts != expected {
+		t.Errorf("Expected %+v, got %+v", expected, counts)
+	}
+
+	// Messages that are never acknowledged are counted when they time out.
+	hl7Exchange(t, decoder, "10.0.0.8", t0, okHL7Header)
+	hl7Exchange(t, decoder, "10.0.0.7", t0.Add(hl7AckTimeout+time.Second), pcdHL7Message)
+	if counts := stats.HL7Acknowledgments["10.0.0.8"]; counts != (HL7AckCounts{Unacknowledged: 1}) {
+		t.Errorf("Expected an unacknowledged message, got %+v", counts)
+	}
+	if counts := stats.HL7Acknowledgments["10.0.0.7"]; counts.Unacknowledged != 0 {
+		t.Errorf("Message still awaiting acknowledgment counted: %+v", counts)
+	}
+}
+
+func TestHL7AcknowledgmentsOfSendersSharingControlIDs(t *testing.T) {
+	setupLogging(false)
+	stats = *NewStats()
+	decoder := &HL7Decoder{}
+	if err := decoder.Initialize(); err != nil {
+		t.Fatal(err)
+	}
+	t0 := time.Date(2019, 1, 2, 12, 34, 56, 0, time.UTC)
+	message := func(from string) string {
+		return "MSH|^~\\&|" + from + "|EHR|HOSP|20190102123456||ORU^R01|1|P|2.6\r"
+	}
+
+	// Two pumps count their messages from 1; only the second one's is
+	// rejected.
+	hl7Exchange(t, decoder, "10.0.0.7", t0, message("PUMP-7|ICU"))
+	hl7Exchange(t, decoder, "10.0.0.8", t0, message("PUMP-8|ICU"))
+	hl7Exchange(t, decoder, "10.0.0.1", t0.Add(10*time.Millisecond), hl7Ack("PUMP-8|ICU", "AR", "1"))
+	hl7Exchange(t, decoder, "10.0.0.1", t0.Add(20*time.Millisecond), hl7Ack("PUMP-7|ICU", "AA", "1"))
+
+	if counts := stats.HL7Acknowledgments["10.0.0.7"]; counts != (HL7AckCounts{Accepted: 1, MeanLatency: 20, MaxLatency: 20}) {
+		t.Errorf("Wrong counts for the first pump: %+v", counts)
+	}
+	if counts := stats.HL7Acknowledgments["10.0.0.8"]; counts != (HL7AckCounts{Rejected: 1, MeanLatency: 10, MaxLatency: 10}) {
+		t.Errorf("Wrong counts for the second pump: %+v", counts)
+	}
+}
+
+func TestHL7AcknowledgmentsInCapture(t *testing.T) {
+	setupLogging(false)
+	stats = *NewStats()
+	decoder := &HL7Decoder{}
+	if err := decoder.Initialize(); err != nil {
+		t.Fatal(err)
+	}
+	handle, closeHandle, err := openOffline("testdata/HL7-ADT-UDI-PRT.pcap", "")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer closeHandle()
+	packetSource := gopacket.NewPacketSource(handle, handle.LinkType())
+	for packet := range packetSource.Packets() {
+		handlePacket(packet, []PayloadDecoder{decoder}, nil, nil)
+	}
+	if len(stats.HL7Acknowledgments) != 1 {
+		t.Fatalf("Expected one sender, got %+v", stats.HL7Acknowledgments)
+	}
+	for sender, counts := range stats.HL7Acknowledgments {
+		if counts.Accepted != 1 {
+			t.Errorf("Expected an accepted message from %s, got %+v", sender, counts)
+		}
+	}
+}
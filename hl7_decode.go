@@ -26,9 +26,10 @@ import (
 
 // HL7Query represents a compiled query and its corresponding output field.
 type HL7Query struct {
-	hl7Field    string
-	hl7Query    *hl7.Query
-	outputField string
+	hl7Field     string
+	hl7Query     *hl7.Query
+	outputField  string
+	messageTypes []string // the query applies to any message if empty
 }
 
 // CompileQuery compiles an HL7 field query into an HL7Query.
@@ -46,13 +47,115 @@ func (q HL7Query) String() string {
 	return fmt.Sprintf("HL7Query{%v -> %v, %v}", q.hl7Field, q.outputField, compiled)
 }
 
+// mustParseHL7Query compiles an HL7 field query that is known to be valid.
+func mustParseHL7Query(field string) *hl7.Query {
+	qry, err := hl7.ParseQuery(field)
+	if err != nil {
+		panic(err)
+	}
+	return qry
+}
+
+// Queries for the sending and receiving applications and facilities in MSH-3
+// through MSH-6, the message type and trigger event in MSH-9, the message
+// control ID in MSH-10, the acknowledgment code and acknowledged control ID in
+// MSA-1 and MSA-2, and the full UDI label in PRT-10
+var (
+	hl7SendingAppQuery   = mustParseHL7Query("MSH-3")
+	hl7SendingFacQuery   = mustParseHL7Query("MSH-4")
+	hl7ReceivingAppQuery = mustParseHL7Query("MSH-5")
+	hl7ReceivingFacQuery = mustParseHL7Query("MSH-6")
+	hl7MessageTypeQuery  = mustParseHL7Query("MSH-9-1")
+	hl7TriggerEventQuery = mustParseHL7Query("MSH-9-2")
+	hl7ControlIDQuery    = mustParseHL7Query("MSH-10")
+	hl7AckCodeQuery      = mustParseHL7Query("MSA-1")
+	hl7AckControlIDQuery = mustParseHL7Query("MSA-2")
+	hl7UDILabelQuery     = mustParseHL7Query("PRT-10-1")
+)
+
+// hl7Unescaper replaces escape sequences for the standard delimiters, which
+// ICCBBA UDI labels use ("&" in particular), with the delimiters themselves.
+var hl7Unescaper = strings.NewReplacer(
+	`\F\`, "|", `\S\`, "^", `\T\`, "&", `\R\`, "~", `\E\`, `\`)
+
 var mshHeader = []byte{77, 83, 72} // "MSH"
 
+// Minimal Lower Layer Protocol (MLLP) framing bytes.  An MLLP-framed message
+// looks like <SB> message <EB><CR>.
+const (
+	mllpStartBlock = 0x0b
+	mllpEndBlock   = 0x1c
+	mllpCR         = 0x0d
+)
+
+// Confidence in identifiers found in structured HL7 fields
+const hl7FieldConfidence = 0.9
+
+// Fields that commonly hold device information, and the attributes they map to.
+//
+// HL7 (V2.8) supports FDA UDI (Unique Device Identifier) by allowing both
+// the full label text in PRT-10 and the components in PRT-16 through PRT22.
+// The components are read first, so they win over the parts of a label that we
+// parse ourselves (see ParseUDI).
+//
+// PRT-10 Full text label for FDA-UDI (string)
+// PRT-16 Participation Device Identifier (string)
+// PRT-17 Participation Device Manufacture Date (Date-string?)
+// PRT-18 Participation Device Expiry Date (Date-string?)
+// PRT-19 Participation Device Lot Number (String)
+// PRT-20 Participation Device Serial Number (String)
+// PRT-21 Participation Device Donation Identification (String) - relates to donation of blood etc
+// PRT-22 Participation Device Type (string)
+// OBX-18 Equipment Instance Identifier (EI), read along with IHE PCD-01 device
+// observations (see addPCDObservations)
+//
+// The message header profiles the application that sent the message, which
+// helps tell a bedside monitor from an interface engine or a pharmacy system
+// even when the message identifies no device:
+//
+// MSH-3  Sending Application (HD)
+// MSH-4  Sending Facility (HD)
+// MSH-5  Receiving Application (HD)
+// MSH-6  Receiving Facility (HD)
+// MSH-12 Version ID (VID), of which we read the version
+// MSH-18 Character Set (ID), of which we read the first
+//
+// Reference:
+// https://www.hl7.org/documentcenter/public/wg/healthcaredevices/IEEE_UDI.ppt
+//
+// Reference:
+// https://wiki.ihe.net/images/6/6c/UDITopic.pdf
+var defaultHL7Fields = []HL7Query{
+	{hl7Field: "PRT-16", outputField: AttrUDIDI},
+	{hl7Field: "PRT-17", outputField: AttrManufactureDate},
+	{hl7Field: "PRT-18", outputField: AttrExpiryDate},
+	{hl7Field: "PRT-19", outputField: AttrLotNumber},
+	{hl7Field: "PRT-20", outputField: AttrSerialNumber},
+	{hl7Field: "PRT-21", outputField: AttrDonationID},
+	{hl7Field: "PRT-22", outputField: AttrDeviceType},
+	{hl7Field: "MSH-3", outputField: AttrSendingApplication},
+	{hl7Field: "MSH-4", outputField: AttrSendingFacility},
+	{hl7Field: "MSH-5", outputField: AttrReceivingApplication},
+	{hl7Field: "MSH-6", outputField: AttrReceivingFacility},
+	{hl7Field: "MSH-12-1", outputField: AttrHL7Version},
+	{hl7Field: "MSH-18", outputField: AttrHL7CharacterSet},
+}
+
 // HL7Decoder receives application-layer payloads and, when possible, extracts
 // identifying information from HL7 messages therein.
 type HL7Decoder struct {
+	// Fields to extract in addition to (or instead of) the default ones
+	fieldConfig *HL7FieldConfig
+
 	// Compiled HL7 queries to be matched against
 	hl7Queries []HL7Query
+
+	// Whether to read the default fields that take more than a query: UDI
+	// labels in PRT-10 and IHE PCD-01 device observations
+	readStructuredFields bool
+
+	// Messages awaiting acknowledgment
+	exchanges *hl7Exchanges
 }
 
 // Name returns the name of the decoder.
@@ -70,11 +173,14 @@ func (decoder HL7Decoder) String() string {
 		strings.Join(decoderNames, ","))
 }
 
-// AddField registers an additional field matcher with an HL7Decoder.
+// AddField registers an additional field matcher with an HL7Decoder.  Values
+// found in the field are reported as the attribute named outputName.  When
+// several fields map to the same attribute, the first one registered wins.
 //
-// TODO: make outputName actually do something
-func (decoder *HL7Decoder) AddField(fieldName, outputName string) error {
-	newQuery := HL7Query{hl7Field: fieldName, outputField: outputName}
+// If message types (as "ORU" or "ORU^R01") are given, the field is only read
+// from messages of those types.
+func (decoder *HL7Decoder) AddField(fieldName, outputName string, messageTypes ...string) error {
+	newQuery := HL7Query{hl7Field: fieldName, outputField: outputName, messageTypes: messageTypes}
 	if err := newQuery.CompileQuery(); err != nil {
 		return err
 	}
@@ -82,25 +188,82 @@ func (decoder *HL7Decoder) AddField(fieldName, outputName string) error {
 	return nil
 }
 
-// Initialize precompiles a set of HL7 queries to match against payloads.
-//
-// Currently uses a hard-coded set of "interesting" fields.
+// Initialize precompiles a set of HL7 queries to match against payloads: the
+// configured fields, if any, followed by a set of "interesting" fields unless
+// the configuration replaces them.
 func (decoder *HL7Decoder) Initialize() error {
-	placeholder := "" // TODO: use meaningful output field names
-	if err := decoder.AddField("PRT-16", placeholder); err != nil {
-		return err
+	decoder.exchanges = newHL7Exchanges()
+	useDefaults := true
+	if config := decoder.fieldConfig; config != nil {
+		for _, mapping := range config.Fields {
+			if err := decoder.AddField(mapping.Field, mapping.Attribute, mapping.MessageTypes...); err != nil {
+				return err
+			}
+		}
+		useDefaults = !config.ReplaceDefaults
 	}
-	if err := decoder.AddField("OBX-18", placeholder); err != nil {
-		return err
+	if !useDefaults {
+		return nil
+	}
+	decoder.readStructuredFields = true
+	for _, field := range defaultHL7Fields {
+		if err := decoder.AddField(field.hl7Field, field.outputField); err != nil {
+			return err
+		}
 	}
 	return nil
 }
 
-// DecodePayload extracts device identifiers from an application-layer payload.
-func (decoder *HL7Decoder) DecodePayload(app *gopacket.ApplicationLayer) (string, string, error) {
+// MessageLength finds the end of the HL7 message at the start of a reassembled
+// TCP stream.
+//
+// MLLP-framed messages end with an end block.  Unframed messages (or batches)
+// end where the next "MSH" segment begins, or at the end of the stream.
+func (decoder *HL7Decoder) MessageLength(buf []byte, final bool) (int, error) {
+	if len(buf) > 0 && buf[0] == mllpStartBlock {
+		end := bytes.IndexByte(buf, mllpEndBlock)
+		if end < 0 {
+			if final {
+				return len(buf), nil
+			}
+			return 0, nil
+		}
+		if end+1 == len(buf) && !final {
+			// Wait for the trailing carriage return
+			return 0, nil
+		}
+		if end+1 < len(buf) && buf[end+1] == mllpCR {
+			end++
+		}
+		return end + 1, nil
+	}
+
+	if !isHL7Start(buf) {
+		return 0, fmt.Errorf("Not an HL7 stream")
+	}
+	for _, sep := range [][]byte{[]byte("\rMSH"), []byte("\nMSH")} {
+		if next := bytes.Index(buf, sep); next >= 0 {
+			return next + 1, nil
+		}
+	}
+	if final {
+		return len(buf), nil
+	}
+	return 0, nil
+}
+
+// SplitMessages splits a payload into its HL7 messages so that each one can be
+// passed to DecodePayload.
+func (decoder *HL7Decoder) SplitMessages(payload []byte) [][]byte {
+	return splitHL7Messages(payload)
+}
+
+// DecodePayload extracts device identifiers from an application-layer payload
+// holding one HL7 message.
+func (decoder *HL7Decoder) DecodePayload(app *gopacket.ApplicationLayer) (*Observation, error) {
 	payloadBytes := (*app).Payload()
 	if len(payloadBytes) < 4 {
-		return "", "", fmt.Errorf("Not an HL7 packet (too small)")
+		return nil, fmt.Errorf("Not an HL7 packet (too small)")
 	}
 
 	if bytes.Compare(mshHeader, payloadBytes[:3]) == 0 {
@@ -109,7 +272,7 @@ func (decoder *HL7Decoder) DecodePayload(app *gopacket.ApplicationLayer) (string
 		payloadBytes = payloadBytes[1:]
 	} else {
 		// Ignore messages that don't start with "MSH"
-		return "", "", fmt.Errorf("Not an HL7 packet (no header)")
+		return nil, fmt.Errorf("Not an HL7 packet (no header)")
 	}
 	logger.Println("Found HL7 header")
 
@@ -135,40 +298,65 @@ func (decoder *HL7Decoder) DecodePayload(app *gopacket.ApplicationLayer) (string
 	message, _, err := hl7.ParseMessage(payloadBytes)
 	if err != nil {
 		logger.Println("Error parsing HL7 payload")
-		return "", "", err
+		return nil, err
 	}
 
-	// Parse identifiers
-	//
-	// HL7 (V2.8) supports FDA UDI (Unique Device Identifier) by allowing both
-	// the full label text in PRT-10 and the components in PRT-16 through PRT22
-	//
-	// PRT-10 Full text label for FDA-UDI (string)
-	// PRT-16 Participation Device Identifier (string)
-	// PRT-17 Participation Device Manufacture Date (Date-string?)
-	// PRT-18 Participation Device Expiry Date (Date-string?)
-	// PRT-19 Participation Device Lot Number (String)
-	// PRT-20 Participation Device Serial Number (String)
-	// PRT-21 Participation Device Donation Identification (String) - relates to donation of blood etc
-	// PRT-22 Participation Device Type (string)
-	//
-	// Reference:
-	// https://www.hl7.org/documentcenter/public/wg/healthcaredevices/IEEE_UDI.ppt
-	//
-	// Reference:
-	// https://wiki.ihe.net/images/6/6c/UDITopic.pdf
-	var identifier, provenance string
-
-	for _, query := range decoder.hl7Queries {
-		if ident := query.hl7Query.GetString(message); ident != "" {
-			logger.Printf("  Found HL7 identifier in %s segment", query.hl7Field)
-			identifier = ident
-			provenance = "HL7 " + query.hl7Field
-			break
+	// Extract attributes from each field of interest (see defaultHL7Fields)
+	messageType := hl7MessageTypeQuery.GetString(message)
+	triggerEvent := hl7TriggerEventQuery.GetString(message)
+	obs := NewObservation()
+	obs.MessageType = messageType
+	if messageType != "" && triggerEvent != "" {
+		obs.MessageType += "^" + triggerEvent
+	}
+	obs.MessageID = hl7MessageID(hl7SendingAppQuery.GetString(message),
+		hl7SendingFacQuery.GetString(message), hl7ControlIDQuery.GetString(message))
+	obs.Acknowledges = hl7MessageID(hl7ReceivingAppQuery.GetString(message),
+		hl7ReceivingFacQuery.GetString(message), hl7AckControlIDQuery.GetString(message))
+	obs.AckCode = hl7AckCodeQuery.GetString(message)
+	if obs.Acknowledges != "" {
+		// Whoever acknowledges messages receives them.
+		obs.Add(AttrHL7Role, hl7RoleReceiver, "HL7 MSA", hl7FieldConfidence)
+	}
+	// Fields are ranked in the order they are read, so that a field read
+	// later never replaces the value of one read earlier, even when they come
+	// from different messages.
+	for rank, query := range decoder.hl7Queries {
+		if !matchesMessageType(query.messageTypes, messageType, triggerEvent) {
+			continue
+		}
+		if value := query.hl7Query.GetString(message); value != "" {
+			logger.Printf("  Found HL7 %s in %s segment", query.outputField, query.hl7Field)
+			obs.AddRanked(query.outputField, value, "HL7 "+query.hl7Field, hl7FieldConfidence, rank)
 		}
 	}
+	if decoder.readStructuredFields {
+		rank := len(decoder.hl7Queries)
+		decoder.addUDILabel(message, obs, rank)
+		addPCDObservations(message, obs, rank)
+	}
 
-	logger.Printf("  HL7 identifier: [%s] (provenance: %s)", identifier, provenance)
+	ident, _ := obs.Attributes.Identifier()
+	logger.Printf("  HL7 identifier: [%s] (provenance: %s)", ident.Value, ident.Provenance)
 
-	return identifier, provenance, nil
+	return obs, nil
+}
+
+// addUDILabel adds the parts of the UDI label in a message's PRT-10, if any, to
+// an Observation, with the given rank.  Labels that cannot be parsed are logged
+// and ignored.
+func (decoder *HL7Decoder) addUDILabel(message hl7.Message, obs *Observation, rank int) {
+	label := hl7Unescaper.Replace(hl7UDILabelQuery.GetString(message))
+	if label == "" {
+		return
+	}
+	udi, err := ParseUDI(label)
+	if err != nil {
+		logger.Printf("  Ignoring HL7 UDI label %+q: %v", label, err)
+		return
+	}
+	logger.Printf("  Found %s UDI label in PRT-10", udi.Issuer)
+	for name, value := range udi.attributes() {
+		obs.AddRanked(name, value, "HL7 PRT-10", hl7FieldConfidence, rank)
+	}
 }
@@ -7,7 +7,6 @@ import (
 	"testing"
 
 	"github.com/google/gopacket"
-	"github.com/google/gopacket/pcap"
 )
 
 var testHl7Decoder HL7Decoder
@@ -19,10 +18,11 @@ func init() {
 }
 
 func TestHL7DecodeFile(t *testing.T) {
-	handle, err := pcap.OpenOffline("testdata/HL7-ADT-UDI-PRT.pcap")
+	handle, closeHandle, err := openOffline("testdata/HL7-ADT-UDI-PRT.pcap", "")
 	if err != nil {
 		panic(err)
 	}
+	defer closeHandle()
 
 	packetSource := gopacket.NewPacketSource(handle, handle.LinkType())
 	for packet := range packetSource.Packets() {
@@ -31,7 +31,7 @@ func TestHL7DecodeFile(t *testing.T) {
 			continue // Ignore packets without an application layer
 		}
 
-		_, _, err := testHl7Decoder.DecodePayload(&app)
+		_, err := testHl7Decoder.DecodePayload(&app)
 		if err != nil {
 			panic(err)
 		}
@@ -46,8 +46,8 @@ func appLayerFromString(s string) *gopacket.ApplicationLayer {
 
 func TestHL7DecodeTooShort(t *testing.T) {
 	appLayer := appLayerFromString(".")
-	ident, _, err := testHl7Decoder.DecodePayload(appLayer)
-	if ident != "" {
+	obs, err := testHl7Decoder.DecodePayload(appLayer)
+	if !obs.Empty() {
 		t.Errorf("Got identifier when none was expected")
 	}
 	if err == nil {
@@ -57,25 +57,30 @@ func TestHL7DecodeTooShort(t *testing.T) {
 
 func testHL7DecodeEmpty(s string, t *testing.T) {
 	appLayer := appLayerFromString(s)
-	ident, _, err := testHl7Decoder.DecodePayload(appLayer)
-	if ident != "" {
-		t.Errorf("Got identifier when none was expected")
-	}
+	obs, err := testHl7Decoder.DecodePayload(appLayer)
 	if err != nil {
 		panic(err)
 	}
+	if !obs.Empty() {
+		t.Errorf("Got identifier when none was expected")
+	}
 }
 
 func TestHL7DecodeEmpty1(t *testing.T) { testHL7DecodeEmpty("MSH|^~\\&", t) }
 func TestHL7DecodeEmpty2(t *testing.T) { testHL7DecodeEmpty("MSH|^~\\&|", t) }
 
-func identFromString(s string) string {
+func obsFromString(s string) *Observation {
 	appLayer := appLayerFromString(s)
-	ident, _, err := testHl7Decoder.DecodePayload(appLayer)
+	obs, err := testHl7Decoder.DecodePayload(appLayer)
 	if err != nil {
 		panic(err)
 	}
-	return ident
+	return obs
+}
+
+func identFromString(s string) string {
+	ident, _ := obsFromString(s).Attributes.Identifier()
+	return ident.Value
 }
 
 // Well-formed message header segment to be prepended to messages for testing
@@ -108,7 +113,7 @@ func getNRecordString(nrec int) string {
 	}
 	alphas := make([]string, nrec)
 	for i := 0; i < nrec; i++ {
-		alphas[i] = string('A' + i)
+		alphas[i] = string(rune('A' + i))
 	}
 	return strings.Join(alphas, "|")
 }
@@ -164,3 +169,94 @@ func BenchmarkHL7IdentFromPRT16(b *testing.B) {
 		identFromString(str)
 	}
 }
+
+func TestHL7PRTAttributes(t *testing.T) {
+	// PRT-16 through PRT-22 each map to their own attribute.
+	str := okHL7Header + "PRT|" + getNRecordString(15) +
+		"|00643169007222|20180101|20230101|LOT123|SN456||Infusion Pump\r"
+	obs := obsFromString(str)
+
+	expected := map[string]string{
+		AttrUDIDI:           "00643169007222",
+		AttrManufactureDate: "20180101",
+		AttrExpiryDate:      "20230101",
+		AttrLotNumber:       "LOT123",
+		AttrSerialNumber:    "SN456",
+		AttrDeviceType:      "Infusion Pump",
+	}
+	for name, value := range expected {
+		if attr := obs.Attributes[name]; attr.Value != value {
+			t.Errorf("Wrong %s: expected '%s', got '%s'", name, value, attr.Value)
+		}
+	}
+	if _, ok := obs.Attributes[AttrDonationID]; ok {
+		t.Errorf("Got a donation identifier from an empty field")
+	}
+	if attr := obs.Attributes[AttrSerialNumber]; attr.Provenance != "HL7 PRT-20" {
+		t.Errorf("Wrong provenance for serial number: '%s'", attr.Provenance)
+	}
+	if ident := identFromString(str); ident != "00643169007222" {
+		t.Errorf("Identifier should come from PRT-16, got '%s'", ident)
+	}
+}
+
+func TestHL7PRT16BeforeOBX18(t *testing.T) {
+	str := okHL7Header +
+		"OBX|" + getNRecordString(17) + "|Grospira Peach B+\r" +
+		"PRT|" + getNRecordString(15) + "|00643169007222\r"
+	obs := obsFromString(str)
+	if ident, _ := obs.Attributes.Identifier(); ident.Provenance != "HL7 PRT-16" {
+		t.Errorf("Wrong identifier provenance: '%s'", ident.Provenance)
+	}
+	if attr := obs.Attributes[AttrEquipmentID]; attr.Value != "Grospira Peach B+" {
+		t.Errorf("Lost OBX-18 equipment identifier, got '%s'", attr.Value)
+	}
+}
+
+func TestHL7MessageLength(t *testing.T) {
+	var decoder HL7Decoder
+	framed := "\x0bMSH|^~\\&|A\r\x1c\x0d"
+
+	if n, err := decoder.MessageLength([]byte(framed+"\x0bMSH"), false); err != nil || n != len(framed) {
+		t.Errorf("Wrong framed length %d (%v)", n, err)
+	}
+	if n, err := decoder.MessageLength([]byte(framed[:8]), false); err != nil || n != 0 {
+		t.Errorf("Expected to need more data, got %d (%v)", n, err)
+	}
+	if n, err := decoder.MessageLength([]byte("MSH|^~\\&|A\rMSH|^~\\&|B\r"), false); err != nil || n != 11 {
+		t.Errorf("Wrong unframed length %d (%v)", n, err)
+	}
+	if n, err := decoder.MessageLength([]byte("MSH|^~\\&|A\r"), true); err != nil || n != 11 {
+		t.Errorf("Wrong final unframed length %d (%v)", n, err)
+	}
+	if _, err := decoder.MessageLength([]byte("GET /"), false); err == nil {
+		t.Errorf("Expected an error from a non-HL7 stream")
+	}
+}
+
+func TestHL7MessageHeaderProfile(t *testing.T) {
+	// A message that identifies no device still profiles its sender.
+	str := "MSH|^~\\&|PHARM^1.2.3^ISO|MAIN|EHR|HOSP|20190102123456||RDE^O11^RDE_O11|MSG-1|P|2.5.1^USA||||||UNICODE UTF-8\r" +
+		"PID|||12345^^^HOSP^MR||Doe^Jane\r"
+	obs := obsFromString(str)
+
+	if obs.MessageType != "RDE^O11" {
+		t.Errorf("Wrong message type '%s'", obs.MessageType)
+	}
+	expected := map[string]string{
+		AttrSendingApplication:   "PHARM^1.2.3^ISO",
+		AttrSendingFacility:      "MAIN",
+		AttrReceivingApplication: "EHR",
+		AttrReceivingFacility:    "HOSP",
+		AttrHL7Version:           "2.5.1",
+		AttrHL7CharacterSet:      "UNICODE UTF-8",
+	}
+	for name, value := range expected {
+		if attr := obs.Attributes[name]; attr.Value != value {
+			t.Errorf("Wrong %s: expected '%s', got '%s'", name, value, attr.Value)
+		}
+	}
+	if _, ok := obs.Attributes.Identifier(); ok {
+		t.Errorf("Got an identifier from the message header")
+	}
+}
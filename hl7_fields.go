@@ -0,0 +1,95 @@
+// Copyright 2019 Virta Laboratories, Inc.  All rights reserved.
+/*
+Configurable HL7 field extraction.
+
+Every vendor integration puts device identifiers somewhere different: OBX-18,
+PRT-10, MSH-3, or a custom Z-segment.  Rather than recompiling Tapirx for each
+site, the fields to read can be declared in a JSON file given with -hl7fields:
+
+	{
+	  "replace_defaults": false,
+	  "fields": [
+	    {"field": "ZDV-2", "attribute": "serial_number"},
+	    {"field": "OBX-18-1", "attribute": "equipment_id", "message_types": ["ORU^R01"]},
+	    {"field": "MSH-3", "attribute": "sending_application"}
+	  ]
+	}
+
+Each field is an HL7 query (segment, field, and optionally repetition,
+component and subcomponent) and the attribute its value is reported as, which
+may be one of the well-known attributes or a name of our own.  A field may be
+limited to messages of certain types, given as "ORU" or "ORU^R01".  Fields are
+listed in priority order: when several fields of a message map to the same
+attribute, the first one listed that has a value wins, and a field listed later
+never replaces that value in the device's record when a later message lacks
+the first field.  Configured fields come before the built-in ones, which are
+dropped altogether if replace_defaults is true.
+*/
+
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"os"
+	"strings"
+)
+
+// An HL7FieldConfig declares the HL7 fields to extract.
+type HL7FieldConfig struct {
+	ReplaceDefaults bool              `json:"replace_defaults"`
+	Fields          []HL7FieldMapping `json:"fields"`
+}
+
+// An HL7FieldMapping maps an HL7 field to an attribute.
+type HL7FieldMapping struct {
+	Field        string   `json:"field"`
+	Attribute    string   `json:"attribute"`
+	MessageTypes []string `json:"message_types"`
+}
+
+// LoadHL7FieldConfig reads an HL7 field configuration file.
+func LoadHL7FieldConfig(filename string) (*HL7FieldConfig, error) {
+	f, err := os.Open(filename)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+
+	config := new(HL7FieldConfig)
+	decoder := json.NewDecoder(f)
+	decoder.DisallowUnknownFields()
+	if err := decoder.Decode(config); err != nil {
+		return nil, fmt.Errorf("%s: %v", filename, err)
+	}
+	for i, mapping := range config.Fields {
+		if mapping.Field == "" || mapping.Attribute == "" {
+			return nil, fmt.Errorf("%s: field %d needs a field and an attribute", filename, i+1)
+		}
+		for _, messageType := range mapping.MessageTypes {
+			if messageType == "" || strings.Count(messageType, "^") > 1 {
+				return nil, fmt.Errorf("%s: bad message type '%s'", filename, messageType)
+			}
+		}
+	}
+	return config, nil
+}
+
+// matchesMessageType returns true if a message of the given type and trigger
+// event is one of the message types, as "ORU" or "ORU^R01".  Any message
+// matches an empty list.
+func matchesMessageType(messageTypes []string, messageType, trigger string) bool {
+	if len(messageTypes) == 0 {
+		return true
+	}
+	for _, want := range messageTypes {
+		parts := strings.SplitN(want, "^", 2)
+		if parts[0] != messageType {
+			continue
+		}
+		if len(parts) == 1 || parts[1] == trigger {
+			return true
+		}
+	}
+	return false
+}
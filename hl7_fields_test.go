@@ -0,0 +1,158 @@
+/*
+Unit tests for configurable HL7 field extraction.
+*/
+package main
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+// loadTestHL7FieldConfig writes an HL7 field configuration file and loads it.
+func loadTestHL7FieldConfig(t *testing.T, contents string) (*HL7FieldConfig, error) {
+	dir, err := ioutil.TempDir("", "tapirx")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	name := filepath.Join(dir, "fields.json")
+	if err := ioutil.WriteFile(name, []byte(contents), 0644); err != nil {
+		t.Fatal(err)
+	}
+	return LoadHL7FieldConfig(name)
+}
+
+// configuredHL7Decoder returns an initialized HL7Decoder using a field
+// configuration.
+func configuredHL7Decoder(t *testing.T, contents string) *HL7Decoder {
+	config, err := loadTestHL7FieldConfig(t, contents)
+	if err != nil {
+		t.Fatal(err)
+	}
+	decoder := &HL7Decoder{fieldConfig: config}
+	if err := decoder.Initialize(); err != nil {
+		t.Fatal(err)
+	}
+	return decoder
+}
+
+func TestHL7FieldConfig(t *testing.T) {
+	decoder := configuredHL7Decoder(t, `{
+	  "fields": [
+	    {"field": "ZDV-2", "attribute": "serial_number"},
+	    {"field": "MSH-3", "attribute": "sending_application"},
+	    {"field": "OBX-3-2", "attribute": "model", "message_types": ["ADT"]}
+	  ]
+	}`)
+	str := okHL7Header +
+		"OBX|1|ST|0^Pump Model X|||||||||||||||Grospira Peach B+\r" +
+		"PRT|" + getNRecordString(19) + "|SN-FROM-PRT\r" +
+		"ZDV|1|SN-FROM-ZDV\r"
+	obs, err := decoder.DecodePayload(appLayerFromString(str))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// Configured fields take priority over the built-in ones.
+	if attr := obs.Attributes[AttrSerialNumber]; attr.Value != "SN-FROM-ZDV" || attr.Provenance != "HL7 ZDV-2" {
+		t.Errorf("Wrong serial number %+v", attr)
+	}
+	if attr := obs.Attributes["sending_application"]; attr.Value != "Sender" {
+		t.Errorf("Wrong custom attribute %+v", attr)
+	}
+	if _, ok := obs.Attributes[AttrModel]; ok {
+		t.Errorf("Field read from a message of the wrong type")
+	}
+	if attr := obs.Attributes[AttrEquipmentID]; attr.Value != "Grospira Peach B+" {
+		t.Errorf("Lost built-in OBX-18 field, got %+v", attr)
+	}
+}
+
+func TestHL7FieldConfigReplaceDefaults(t *testing.T) {
+	decoder := configuredHL7Decoder(t, `{
+	  "replace_defaults": true,
+	  "fields": [{"field": "OBX-3-2", "attribute": "model", "message_types": ["ADT^A01", "ORU^R01"]}]
+	}`)
+	str := okHL7Header + "OBX|1|ST|0^Pump Model X|||||||||||||||Grospira Peach B+\r"
+	obs, err := decoder.DecodePayload(appLayerFromString(str))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(obs.Attributes) != 1 || obs.Attributes[AttrModel].Value != "Pump Model X" {
+		t.Errorf("Wrong attributes %+v", obs.Attributes)
+	}
+}
+
+func TestHL7FieldPriorityAcrossMessages(t *testing.T) {
+	stats = *NewStats()
+	decoder := configuredHL7Decoder(t, `{
+	  "fields": [
+	    {"field": "ZDV-2", "attribute": "serial_number"},
+	    {"field": "MSH-3", "attribute": "serial_number"}
+	  ]
+	}`)
+	inv := NewInventory(0)
+	t0 := time.Date(2019, 1, 1, 0, 0, 0, 0, time.UTC)
+	for i, str := range []string{
+		okHL7Header + "ZDV|1|SN-FROM-ZDV\r",
+		okHL7Header,
+	} {
+		obs, err := decoder.DecodePayload(appLayerFromString(str))
+		if err != nil {
+			t.Fatal(err)
+		}
+		inv.Observe(observedAsset("11:22:33:44:55:66", "10.0.0.1", "", t0.Add(time.Duration(i)*time.Second), obs.Attributes))
+	}
+
+	// The message without ZDV-2 does not replace its serial number with one
+	// from the lower-priority MSH-3.
+	record := inv.Assets()[0]
+	if attr := record.Attributes[AttrSerialNumber]; attr.Value != "SN-FROM-ZDV" {
+		t.Errorf("Wrong serial number %+v", attr)
+	}
+}
+
+func TestHL7FieldConfigErrors(t *testing.T) {
+	for _, contents := range []string{
+		`{"fields": [{"field": "OBX-18"}]}`,
+		`{"fields": [{"field": "OBX-18", "attribute": "model", "message_types": ["ORU^R01^ORU_R01"]}]}`,
+		`{"fields": [{"field": "OBX-18", "attribute": "model", "priority": 1}]}`,
+		`{"fields": [`,
+	} {
+		if _, err := loadTestHL7FieldConfig(t, contents); err == nil {
+			t.Errorf("Bad configuration was accepted: %s", contents)
+		}
+	}
+
+	config, err := loadTestHL7FieldConfig(t, `{"fields": [{"field": "not a field", "attribute": "model"}]}`)
+	if err != nil {
+		t.Fatal(err)
+	}
+	decoder := &HL7Decoder{fieldConfig: config}
+	if err := decoder.Initialize(); err == nil {
+		t.Errorf("Bad HL7 query was accepted")
+	}
+}
+
+func TestMatchesMessageType(t *testing.T) {
+	cases := []struct {
+		types        []string
+		typ, trigger string
+		expected     bool
+	}{
+		{nil, "ORU", "R01", true},
+		{[]string{"ORU"}, "ORU", "R01", true},
+		{[]string{"ORU^R01"}, "ORU", "R01", true},
+		{[]string{"ORU^R01"}, "ORU", "R30", false},
+		{[]string{"ADT", "ORU^R30"}, "ORU", "R30", true},
+		{[]string{"ADT"}, "ORU", "R01", false},
+	}
+	for _, c := range cases {
+		if got := matchesMessageType(c.types, c.typ, c.trigger); got != c.expected {
+			t.Errorf("%v %s^%s: got %v", c.types, c.typ, c.trigger, got)
+		}
+	}
+}
@@ -0,0 +1,136 @@
+// Copyright 2019 Virta Laboratories, Inc.  All rights reserved.
+/*
+hl7_mllp: Split payloads into individual HL7 messages.
+
+HL7 v2 messages travel over TCP wrapped in the Minimal Lower Layer Protocol
+(MLLP), which frames each message as
+
+	<SB> message <EB><CR>
+
+where SB is 0x0b, EB is 0x1c and CR is 0x0d.  Interface engines commonly
+pipeline several frames in one TCP payload, and a single frame may carry a
+batch of messages wrapped in a file/batch envelope:
+
+	FHS  file header
+	BHS  batch header
+	MSH  message 1 ...
+	MSH  message 2 ...
+	BTS  batch trailer
+	FTS  file trailer
+
+The envelope segments carry no device information, so they are dropped and
+each MSH-led message is returned on its own.
+
+Reference:
+https://www.hl7.org/documentcenter/public/wg/inm/mllp_transport_specification.PDF
+*/
+
+package main
+
+import "bytes"
+
+// HL7 batch envelope segment names
+var (
+	fhsHeader = []byte("FHS")
+	bhsHeader = []byte("BHS")
+	btsHeader = []byte("BTS")
+	ftsHeader = []byte("FTS")
+)
+
+// splitHL7Messages returns every HL7 message contained in a payload, whether
+// or not it is MLLP-framed or wrapped in a batch envelope.
+func splitHL7Messages(payload []byte) [][]byte {
+	var messages [][]byte
+	for _, block := range mllpBlocks(payload) {
+		messages = append(messages, splitHL7Batch(block)...)
+	}
+	return messages
+}
+
+// mllpBlocks returns the contents of each MLLP frame in a payload.  Data outside
+// of any frame, including a payload without framing at all, is returned as a
+// block of its own.  A frame that is cut off before its end block is returned
+// as-is.
+func mllpBlocks(payload []byte) [][]byte {
+	var blocks [][]byte
+	for len(payload) > 0 {
+		start := bytes.IndexByte(payload, mllpStartBlock)
+		if start < 0 {
+			blocks = append(blocks, payload)
+			break
+		}
+		if start > 0 {
+			blocks = append(blocks, payload[:start])
+		}
+		payload = payload[start+1:]
+
+		end := bytes.IndexByte(payload, mllpEndBlock)
+		if end < 0 {
+			blocks = append(blocks, payload)
+			break
+		}
+		blocks = append(blocks, payload[:end])
+		payload = payload[end+1:]
+		if len(payload) > 0 && payload[0] == mllpCR {
+			payload = payload[1:]
+		}
+	}
+	return blocks
+}
+
+// splitHL7Batch splits a block of HL7 segments into messages, each starting
+// with an MSH segment.  Batch envelope segments and anything preceding the
+// first MSH segment are discarded.
+func splitHL7Batch(block []byte) [][]byte {
+	var messages [][]byte
+	var current []byte
+	segments := bytes.FieldsFunc(block, func(r rune) bool {
+		return r == '\r' || r == '\n'
+	})
+	for _, segment := range segments {
+		switch {
+		case isHL7Segment(segment, mshHeader):
+			if current != nil {
+				messages = append(messages, current)
+			}
+			current = append([]byte{}, segment...)
+			current = append(current, '\r')
+		case isHL7Segment(segment, fhsHeader),
+			isHL7Segment(segment, bhsHeader),
+			isHL7Segment(segment, btsHeader),
+			isHL7Segment(segment, ftsHeader):
+			if current != nil {
+				messages = append(messages, current)
+				current = nil
+			}
+		case current != nil:
+			current = append(current, segment...)
+			current = append(current, '\r')
+		}
+	}
+	if current != nil {
+		messages = append(messages, current)
+	}
+	return messages
+}
+
+// isHL7Segment reports whether a segment has the given three-letter name.
+func isHL7Segment(segment, name []byte) bool {
+	return len(segment) > len(name) && bytes.HasPrefix(segment, name)
+}
+
+// isHL7Start reports whether buf could be the start of an unframed HL7 message
+// or batch.  A buf shorter than a segment name matches if it is a prefix of
+// one.
+func isHL7Start(buf []byte) bool {
+	for _, name := range [][]byte{mshHeader, fhsHeader, bhsHeader} {
+		n := len(name)
+		if len(buf) < n {
+			n = len(buf)
+		}
+		if bytes.Equal(buf[:n], name[:n]) {
+			return true
+		}
+	}
+	return false
+}
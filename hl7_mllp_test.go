@@ -0,0 +1,106 @@
+/*
+Unit tests for splitting payloads into HL7 messages.
+*/
+package main
+
+import (
+	"testing"
+
+	"github.com/google/gopacket"
+)
+
+// mllpFrame wraps a message in MLLP start and end blocks.
+func mllpFrame(message string) string {
+	return "\x0b" + message + "\x1c\x0d"
+}
+
+var (
+	hl7MessageA = okHL7Header + "PRT|" + getNRecordString(15) + "|Grospira Peach B+\r"
+	hl7MessageB = okHL7Header + "OBX|" + getNRecordString(17) + "|Grospira Pluot C+\r"
+)
+
+func TestSplitHL7Unframed(t *testing.T) {
+	messages := splitHL7Messages([]byte(hl7MessageA))
+	if len(messages) != 1 {
+		t.Fatalf("Expected 1 message, got %d", len(messages))
+	}
+	if string(messages[0]) != hl7MessageA {
+		t.Errorf("Wrong message: %+q", messages[0])
+	}
+}
+
+func TestSplitHL7Pipelined(t *testing.T) {
+	payload := mllpFrame(hl7MessageA) + mllpFrame(hl7MessageB) + mllpFrame(hl7MessageA)
+	messages := splitHL7Messages([]byte(payload))
+	if len(messages) != 3 {
+		t.Fatalf("Expected 3 messages, got %d", len(messages))
+	}
+	if string(messages[1]) != hl7MessageB {
+		t.Errorf("Wrong message: %+q", messages[1])
+	}
+}
+
+func TestSplitHL7Batch(t *testing.T) {
+	payload := mllpFrame("" +
+		"FHS|^~\\&|Sender|Sender Facility\r" +
+		"BHS|^~\\&|Sender|Sender Facility\r" +
+		hl7MessageA +
+		hl7MessageB +
+		"BTS|2\r" +
+		"FTS|1\r")
+	messages := splitHL7Messages([]byte(payload))
+	if len(messages) != 2 {
+		t.Fatalf("Expected 2 messages, got %d", len(messages))
+	}
+	if string(messages[0]) != hl7MessageA {
+		t.Errorf("Wrong first message: %+q", messages[0])
+	}
+	if string(messages[1]) != hl7MessageB {
+		t.Errorf("Wrong second message: %+q", messages[1])
+	}
+}
+
+func TestSplitHL7TruncatedFrame(t *testing.T) {
+	payload := mllpFrame(hl7MessageA) + "\x0b" + hl7MessageB
+	messages := splitHL7Messages([]byte(payload))
+	if len(messages) != 2 {
+		t.Fatalf("Expected 2 messages, got %d", len(messages))
+	}
+}
+
+func TestSplitHL7Garbage(t *testing.T) {
+	if messages := splitHL7Messages([]byte("GET / HTTP/1.1\r\n\r\n")); len(messages) != 0 {
+		t.Errorf("Expected no messages, got %d", len(messages))
+	}
+}
+
+func TestParsePipelinedHL7(t *testing.T) {
+	// Every message in a payload yields an Asset.
+	payload := mllpFrame(hl7MessageA) + mllpFrame(hl7MessageB)
+	packet := gopacket.NewPacket([]byte(payload), gopacket.LayerTypePayload, gopacket.Default)
+	stats = *NewStats()
+
+	assets, err := parseApplicationLayer(packet, testDecoders, &Asset{MACAddress: "11:22:33:44:55:66"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(assets) != 2 {
+		t.Fatalf("Expected 2 assets, got %d", len(assets))
+	}
+	if assets[0].Identifier != "Grospira Peach B+" || assets[0].Provenance != "HL7 PRT-16" {
+		t.Errorf("Wrong first asset: %v", assets[0])
+	}
+	if assets[1].Identifier != "Grospira Pluot C+" || assets[1].Provenance != "HL7 OBX-18" {
+		t.Errorf("Wrong second asset: %v", assets[1])
+	}
+	if assets[1].MACAddress != "11:22:33:44:55:66" {
+		t.Errorf("Asset lost its MAC address")
+	}
+}
+
+func BenchmarkSplitHL7Pipelined(b *testing.B) {
+	payload := []byte(mllpFrame(hl7MessageA) + mllpFrame(hl7MessageB))
+	for i := 0; i < b.N; i++ {
+		splitHL7Messages(payload)
+	}
+}
@@ -0,0 +1,187 @@
+// Copyright 2019 Virta Laboratories, Inc.  All rights reserved.
+/*
+Device observations in IHE PCD-01 messages.
+
+Patient monitors, infusion pumps and their gateways report observations in
+ORU^R01 messages following the IHE Patient Care Device profile (PCD-01).  Each
+OBX segment has a place in a containment tree given by its observation sub-ID
+in OBX-4, "mds.vmd.channel.metric": the medical device system (MDS) is the
+device itself, which contains virtual medical devices (VMDs, such as a
+monitor's modules or a pump's channels), which contain channels of metrics.
+OBX-3 names each observation with an ISO/IEEE 11073 (MDC) code, and OBX-18
+identifies the equipment, usually by its EUI-64:
+
+	OBX|1||...^MDC_DEV_PUMP_INFUS_MDS^MDC|1.0.0.0|...|0123456789ABCDEF^^0123456789ABCDEF^EUI-64
+	OBX|2|ST|...^MDC_ID_MODEL_MANUFACTURER^MDC|1.0.0.1|Grospira
+	OBX|3|ST|...^MDC_ID_MODEL_NUMBER^MDC|1.0.0.2|Peach B+
+
+We walk the tree, grouping observations by their MDS, and report the device
+type from the MDS's own MDC_DEV_* code, its manufacturer and model from the
+observations at the level of the MDS, and the equipment identifier, its
+namespace and EUI-64 from the first OBX-18 among the MDS's observations that
+has them.  The first MDS is taken to be the device that sent the message; a
+gateway reports several, and each of the others is a device of its own.
+*/
+
+package main
+
+import (
+	"strconv"
+	"strings"
+
+	"github.com/virtalabs/hl7"
+)
+
+// MDC codes of MDS-level observations that describe the device, and the
+// attributes they map to
+var pcdDeviceAttributes = map[string]string{
+	"MDC_ID_MODEL_MANUFACTURER": AttrManufacturer,
+	"MDC_ID_MODEL_NUMBER":       AttrModel,
+}
+
+// A pcdPosition is the place of an observation in the containment tree: the
+// numbers of its MDS, VMD, channel and metric, 0 where it is above that level.
+type pcdPosition [4]int
+
+// parsePCDPosition parses an observation sub-ID (OBX-4).  Levels that are left
+// out are 0.
+func parsePCDPosition(subID string) (pcdPosition, bool) {
+	var position pcdPosition
+	levels := strings.Split(subID, ".")
+	if subID == "" || len(levels) > len(position) {
+		return position, false
+	}
+	for i, level := range levels {
+		n, err := strconv.Atoi(level)
+		if err != nil || n < 0 {
+			return position, false
+		}
+		position[i] = n
+	}
+	return position, position[0] > 0
+}
+
+// describesMDS returns true if an observation is about an MDS as a whole,
+// rather than one of its VMDs or channels.
+func (position pcdPosition) describesMDS() bool {
+	return position[1] == 0 && position[2] == 0
+}
+
+// An hl7EntityIdentifier is an HL7 EI (entity identifier) value.
+type hl7EntityIdentifier struct {
+	entityID        string
+	namespaceID     string
+	universalID     string
+	universalIDType string
+}
+
+// parseEntityIdentifier reads an EI value from a field of a segment.
+func parseEntityIdentifier(segment hl7.Segment, field int) hl7EntityIdentifier {
+	return hl7EntityIdentifier{
+		entityID:        hl7Component(segment, field, 1),
+		namespaceID:     hl7Component(segment, field, 2),
+		universalID:     hl7Component(segment, field, 3),
+		universalIDType: hl7Component(segment, field, 4),
+	}
+}
+
+// eui64 returns the EUI-64 given as the universal ID, or "" if there is none.
+func (ei hl7EntityIdentifier) eui64() string {
+	if !strings.EqualFold(ei.universalIDType, "EUI-64") || len(ei.universalID) != 16 {
+		return ""
+	}
+	for _, c := range ei.universalID {
+		if !strings.ContainsRune("0123456789abcdefABCDEF", c) {
+			return ""
+		}
+	}
+	return strings.ToUpper(ei.universalID)
+}
+
+// hl7Component returns a component (counting from 1) of the first repetition
+// of a field of a segment, with its subcomponents joined by "&", or "" if the
+// segment does not have it.  Field 0 holds the name of the segment.
+func hl7Component(segment hl7.Segment, field, component int) string {
+	if field >= len(segment) || len(segment[field]) == 0 || component > len(segment[field][0]) {
+		return ""
+	}
+	subcomponents := segment[field][0][component-1]
+	values := make([]string, len(subcomponents))
+	for i, subcomponent := range subcomponents {
+		values[i] = string(subcomponent)
+	}
+	return strings.Join(values, "&")
+}
+
+// addPCDObservations adds what a message's OBX segments say about the device
+// that sent it to an Observation, with the given rank.
+//
+// A gateway may report several devices in one message, each an MDS of its own.
+// An Observation describes one device, so we group the observations by MDS and
+// add the first MDS in the message to obs, and each of the others to
+// obs.Devices.  The others share the sender's addresses, so one that OBX-18
+// does not identify would be taken for the sender, and is left out.  OBX
+// segments without a sub-ID are grouped together as if they belonged to an MDS
+// of their own.
+func addPCDObservations(message hl7.Message, obs *Observation, rank int) {
+	var order []int
+	devices := make(map[int]*Observation)
+	for _, segment := range message {
+		if hl7Component(segment, 0, 1) != "OBX" {
+			continue
+		}
+		position, ok := parsePCDPosition(hl7Component(segment, 4, 1))
+		if !ok {
+			position = pcdPosition{}
+		}
+		device, seen := devices[position[0]]
+		if !seen {
+			order = append(order, position[0])
+			device = NewObservation()
+			devices[position[0]] = device
+		}
+
+		equipment := parseEntityIdentifier(segment, 18)
+		eui64 := equipment.eui64()
+		equipmentID := equipment.entityID
+		if equipmentID == "" {
+			equipmentID = eui64
+		}
+		if equipmentID != "" {
+			logger.Printf("  Found HL7 equipment %s (namespace %q, EUI-64 %q) in OBX-18 of MDS %d",
+				equipmentID, equipment.namespaceID, eui64, position[0])
+		}
+		device.Add(AttrEquipmentID, equipmentID, "HL7 OBX-18", hl7FieldConfidence)
+		device.Add(AttrEquipmentNamespace, equipment.namespaceID, "HL7 OBX-18", hl7FieldConfidence)
+		device.Add(AttrEUI64, eui64, "HL7 OBX-18", hl7FieldConfidence)
+
+		if !ok || !position.describesMDS() {
+			continue
+		}
+		code := hl7Component(segment, 3, 2)
+		if strings.HasPrefix(code, "MDC_DEV_") && position[3] == 0 {
+			logger.Printf("  Found IHE PCD device type %s in OBX-3 of MDS %d", code, position[0])
+			device.Add(AttrDeviceType, code, "HL7 OBX-3", hl7FieldConfidence)
+		} else if name, ok := pcdDeviceAttributes[code]; ok {
+			logger.Printf("  Found IHE PCD %s in OBX-5 of MDS %d", name, position[0])
+			device.Add(name, hl7Component(segment, 5, 1), "HL7 "+code, hl7FieldConfidence)
+		}
+	}
+
+	for i, mds := range order {
+		device, reported := devices[mds], obs
+		if i > 0 {
+			if _, ok := device.Attributes.Identifier(); !ok {
+				logger.Printf("  Ignoring MDS %d, which OBX-18 does not identify", mds)
+				continue
+			}
+			reported = NewObservation()
+			reported.MessageType = obs.MessageType
+			obs.Devices = append(obs.Devices, reported)
+		}
+		for name, attr := range device.Attributes {
+			attr.Rank = rank
+			reported.Attributes.Merge(name, attr)
+		}
+	}
+}
@@ -0,0 +1,135 @@
+/*
+Unit tests for reading device observations in IHE PCD-01 messages.
+*/
+package main
+
+import (
+	"testing"
+)
+
+// An IHE PCD-01 message from an infusion pump: the MDS, its manufacturer and
+// model, and a channel with a VMD-level model and an infusion rate
+const pcdHL7Message = "MSH|^~\\&|PUMP-GW|ICU|EHR|HOSP|20190102123456||ORU^R01^ORU_R01|MSG-1|P|2.6\r" +
+	"PID|||12345^^^HOSP^MR||Doe^Jane\r" +
+	"OBR|1|||69837^MDC_DEV_PUMP_INFUS_MDS^MDC\r" +
+	"OBX|1||69837^MDC_DEV_PUMP_INFUS_MDS^MDC|1.0.0.0|||||||X|||||||PUMP-7^GROSPIRA^0123456789abcdef^EUI-64\r" +
+	"OBX|2|ST|531970^MDC_ID_MODEL_MANUFACTURER^MDC|1.0.0.1|Grospira||||||F\r" +
+	"OBX|3|ST|531969^MDC_ID_MODEL_NUMBER^MDC|1.0.0.2|Peach B+||||||F\r" +
+	"OBX|4||69986^MDC_DEV_PUMP_INFUS_VMD^MDC|1.1.0.0|||||||X\r" +
+	"OBX|5|ST|531969^MDC_ID_MODEL_NUMBER^MDC|1.1.0.1|Channel Module||||||F\r" +
+	"OBX|6|NM|157784^MDC_FLOW_FLUID_PUMP^MDC|1.1.1.1|25|265266^MDC_DIM_MILLI_L_PER_HR^MDC|||||R\r"
+
+func TestHL7PCDObservations(t *testing.T) {
+	obs := obsFromString(pcdHL7Message)
+	expected := map[string][2]string{ // value and provenance
+		AttrDeviceType:   {"MDC_DEV_PUMP_INFUS_MDS", "HL7 OBX-3"},
+		AttrManufacturer: {"Grospira", "HL7 MDC_ID_MODEL_MANUFACTURER"},
+		AttrModel:        {"Peach B+", "HL7 MDC_ID_MODEL_NUMBER"},
+		AttrEquipmentID:  {"PUMP-7", "HL7 OBX-18"},
+		AttrEUI64:        {"0123456789ABCDEF", "HL7 OBX-18"},
+
+		AttrEquipmentNamespace: {"GROSPIRA", "HL7 OBX-18"},
+	}
+	for name, want := range expected {
+		attr := obs.Attributes[name]
+		if attr.Value != want[0] || attr.Provenance != want[1] || attr.Confidence != hl7FieldConfidence {
+			t.Errorf("Wrong %s: expected %q, got %+v", name, want, attr)
+		}
+	}
+}
+
+func TestHL7PCDEUI64Only(t *testing.T) {
+	str := okHL7Header + "OBX|1||69837^MDC_DEV_MON_PHYSIO_MULTI_PARAM_MDS^MDC|1|||||||X|||||||^^0123456789ABCDEF^EUI-64\r"
+	obs := obsFromString(str)
+	if ident, _ := obs.Attributes.Identifier(); ident.Value != "0123456789ABCDEF" {
+		t.Errorf("Wrong identifier %+v", ident)
+	}
+	if attr := obs.Attributes[AttrDeviceType]; attr.Value != "MDC_DEV_MON_PHYSIO_MULTI_PARAM_MDS" {
+		t.Errorf("Wrong device type %+v", attr)
+	}
+}
+
+// A gateway reports a pump as MDS 1, a monitor as MDS 2, and a device that
+// OBX-18 does not identify as MDS 3.
+const pcdGatewayMessage = okHL7Header +
+	"OBX|1||69986^MDC_DEV_PUMP_INFUS_MDS^MDC|1.0.0.0|||||||X|||||||PUMP-1\r" +
+	"OBX|2||69798^MDC_DEV_MON_PHYSIO_MULTI_PARAM_MDS^MDC|2.0.0.0|||||||X|||||||MON-2\r" +
+	"OBX|3|ST|531970^MDC_ID_MODEL_MANUFACTURER^MDC|2.0.0.1|Monitors Inc.||||||F\r" +
+	"OBX|4|ST|531969^MDC_ID_MODEL_NUMBER^MDC|1.0.0.2|Peach B+||||||F\r" +
+	"OBX|5||70000^MDC_DEV_ANALY_SAT_O2_MDS^MDC|3.0.0.0|||||||X\r"
+
+func TestHL7PCDGatewayReportsEveryMDS(t *testing.T) {
+	obs := obsFromString(pcdGatewayMessage)
+	expected := map[string]string{
+		AttrDeviceType:  "MDC_DEV_PUMP_INFUS_MDS",
+		AttrModel:       "Peach B+",
+		AttrEquipmentID: "PUMP-1",
+	}
+	for name, value := range expected {
+		if attr := obs.Attributes[name]; attr.Value != value {
+			t.Errorf("Wrong %s: expected %q, got %+v", name, value, attr)
+		}
+	}
+	if attr, ok := obs.Attributes[AttrManufacturer]; ok {
+		t.Errorf("Manufacturer of another MDS reported: %+v", attr)
+	}
+
+	if len(obs.Devices) != 1 {
+		t.Fatalf("Expected 1 other device, got %d", len(obs.Devices))
+	}
+	other := obs.Devices[0]
+	expected = map[string]string{
+		AttrDeviceType:   "MDC_DEV_MON_PHYSIO_MULTI_PARAM_MDS",
+		AttrManufacturer: "Monitors Inc.",
+		AttrEquipmentID:  "MON-2",
+	}
+	for name, value := range expected {
+		if attr := other.Attributes[name]; attr.Value != value {
+			t.Errorf("Wrong %s of other device: expected %q, got %+v", name, value, attr)
+		}
+	}
+	if attr, ok := other.Attributes[AttrModel]; ok {
+		t.Errorf("Model of another MDS reported: %+v", attr)
+	}
+	if other.MessageType != obs.MessageType {
+		t.Errorf("Wrong message type %q of other device", other.MessageType)
+	}
+}
+
+func TestHL7PCDGatewayAssets(t *testing.T) {
+	setupLogging(false)
+	stats = *NewStats()
+	template := &Asset{IPv4Address: testClientIP.String()}
+	assets, ok := decodeMessages(&testHl7Decoder, []byte(pcdGatewayMessage), template)
+	if !ok || len(assets) != 2 {
+		t.Fatalf("Expected 2 assets, got %d (%v)", len(assets), ok)
+	}
+	for i, identifier := range []string{"PUMP-1", "MON-2"} {
+		if assets[i].Identifier != identifier || assets[i].IPv4Address != template.IPv4Address {
+			t.Errorf("Wrong asset %d: %+v", i, assets[i])
+		}
+	}
+}
+
+func TestParsePCDPosition(t *testing.T) {
+	cases := []struct {
+		subID        string
+		ok           bool
+		describesMDS bool
+	}{
+		{"1", true, true},
+		{"1.0.0.2", true, true},
+		{"2.1", true, false},
+		{"1.0.3.1", true, false},
+		{"", false, false},
+		{"0.0.0.0", false, false},
+		{"1.0.0.0.0", false, false},
+		{"1.a", false, false},
+	}
+	for _, c := range cases {
+		position, ok := parsePCDPosition(c.subID)
+		if ok != c.ok || (ok && position.describesMDS() != c.describesMDS) {
+			t.Errorf("%q: got %v, %v", c.subID, position, ok)
+		}
+	}
+}
@@ -0,0 +1,485 @@
+// Copyright 2019 Virta Laboratories, Inc.  All rights reserved.
+/*
+In-memory asset inventory.
+
+Every decoded message yields an Asset describing what one packet (or stream)
+revealed about its sender.  The same device sends many such messages, so rather
+than emit each one, the Inventory merges them into one record per device and
+notifies its listeners only when a record is created or learns something new.
+
+A new observation belongs to an existing record if it shares an identifier with
+it, or failing that an IPv4 address, IPv6 address or MAC address (in that
+order).  MAC addresses are only meaningful on the local network segment; on a
+routed segment, every device appears to have the router's MAC address.  Since
+addresses are shared and reused, an address never joins an observation to a
+record that has a different value for the same kind of identifier (a different
+UDI, say): that is a different device.
+
+Besides the records themselves, the Inventory reports AssetEvents when devices
+appear, change addresses or identifiers, or stop being seen.  Whether a device
+has stopped being seen is judged by the time of the latest observation, so that
+prerecorded traffic is handled the same way as live traffic.
+
+An Inventory may be backed by an InventoryStore.  Records are saved as soon as
+they change; records that were merely seen again are saved by Sync.
+*/
+
+package main
+
+import (
+	"fmt"
+	"sort"
+	"sync"
+	"time"
+)
+
+// How often (in observation time) to look for devices that stopped being seen
+const lostCheckInterval = time.Minute
+
+// How many events may wait for delivery before Observe blocks
+const eventQueueSize = 1024
+
+// An eventDelivery is an AssetEvent waiting to be delivered to the event
+// listeners registered when it happened.
+type eventDelivery struct {
+	event *AssetEvent
+	sinks []func(*AssetEvent)
+}
+
+// Inventory holds one merged Asset per device.
+type Inventory struct {
+	sync.Mutex
+	assets       []*Asset
+	byIdentifier map[string]*Asset
+	byMAC        map[string]*Asset
+	byIPv4       map[string]*Asset
+	byIPv6       map[string]*Asset
+	ids          map[*Asset]int // record numbers, i.e., positions in assets
+	listeners    []func(*Asset)
+	eventSinks   []func(*AssetEvent)
+	eventQueue   chan eventDelivery
+	undelivered  sync.WaitGroup // events queued but not yet delivered
+	lostTimeout  time.Duration
+	clock        time.Time // time of the latest observation
+	lastLost     time.Time // when we last looked for lost devices
+	store        *InventoryStore
+	unsaved      map[int]bool // records seen again since they were last saved
+}
+
+// NewInventory returns a new, empty Inventory.  Devices not seen for longer
+// than lostTimeout are reported lost; if lostTimeout is 0, they never are.
+func NewInventory(lostTimeout time.Duration) *Inventory {
+	inv := new(Inventory)
+	inv.lostTimeout = lostTimeout
+	inv.byIdentifier = make(map[string]*Asset)
+	inv.byMAC = make(map[string]*Asset)
+	inv.byIPv4 = make(map[string]*Asset)
+	inv.byIPv6 = make(map[string]*Asset)
+	inv.ids = make(map[*Asset]int)
+	inv.unsaved = make(map[int]bool)
+	return inv
+}
+
+// UseStore restores the records loaded from a store and saves every later
+// change to it.  It must be called before anything is observed.
+func (inv *Inventory) UseStore(store *InventoryStore) {
+	inv.Lock()
+	defer inv.Unlock()
+	for _, asset := range store.Loaded() {
+		record := asset.copy()
+		inv.add(record)
+		inv.index(record)
+	}
+	inv.store = store
+}
+
+// Sync saves records that were seen again since they were last saved, compacts
+// the journal if it has grown too large, and commits the store to stable
+// storage.
+func (inv *Inventory) Sync() error {
+	inv.Lock()
+	defer inv.Unlock()
+	if inv.store == nil {
+		return nil
+	}
+	for id := range inv.unsaved {
+		if err := inv.store.Save(id, inv.assets[id]); err != nil {
+			return err
+		}
+		delete(inv.unsaved, id)
+	}
+	if err := inv.store.Compact(inv.assets); err != nil {
+		return err
+	}
+	return inv.store.Sync()
+}
+
+// OnChange registers a function to be called with a copy of a record whenever
+// the record is created or changes.  Listeners are called outside of the
+// Inventory's lock and may be called concurrently.
+func (inv *Inventory) OnChange(listener func(*Asset)) {
+	inv.Lock()
+	defer inv.Unlock()
+	inv.listeners = append(inv.listeners, listener)
+}
+
+// OnEvent registers a function to be called with each AssetEvent.  Events are
+// delivered one at a time, in order, by a goroutine of their own, so a listener
+// never sees an event before the one that preceded it.
+func (inv *Inventory) OnEvent(listener func(*AssetEvent)) {
+	inv.Lock()
+	defer inv.Unlock()
+	inv.eventSinks = append(inv.eventSinks, listener)
+	if inv.eventQueue == nil {
+		inv.eventQueue = make(chan eventDelivery, eventQueueSize)
+		go deliverEvents(inv.eventQueue, &inv.undelivered)
+	}
+}
+
+// deliverEvents calls event listeners with each queued event in turn.
+func deliverEvents(queue <-chan eventDelivery, undelivered *sync.WaitGroup) {
+	for delivery := range queue {
+		for _, sink := range delivery.sinks {
+			sink(delivery.event)
+		}
+		undelivered.Done()
+	}
+}
+
+// queueEvents queues events for delivery.  It must be called with the
+// Inventory locked, so that events are queued in the order they happen.
+func (inv *Inventory) queueEvents(events []*AssetEvent) {
+	if inv.eventQueue == nil {
+		return
+	}
+	for _, event := range events {
+		inv.undelivered.Add(1)
+		inv.eventQueue <- eventDelivery{event, inv.eventSinks}
+	}
+}
+
+// WaitEvents waits until every event reported so far has been delivered.
+func (inv *Inventory) WaitEvents() {
+	inv.undelivered.Wait()
+}
+
+// CheckLost reports devices that have not been seen for longer than the
+// timeout as of now.  While traffic is flowing, Observe does this as part of
+// its work, but during live capture devices must still be reported lost when
+// traffic stops altogether.
+func (inv *Inventory) CheckLost(now time.Time) {
+	inv.Lock()
+	defer inv.Unlock()
+	if now.After(inv.clock) {
+		inv.clock = now
+	}
+	inv.queueEvents(inv.findLost())
+}
+
+// Observe merges an observed Asset into the inventory and notifies listeners
+// if anything new was learned.
+func (inv *Inventory) Observe(observed *Asset) {
+	inv.Lock()
+	record, displaced := inv.find(observed)
+	isNew := record == nil
+	if isNew {
+		record = new(Asset)
+		inv.add(record)
+	}
+	before := *record
+	changed := record.merge(observed) || isNew
+	inv.unindex(&before, record)
+	inv.index(record)
+	var snapshot *Asset
+	var events []*AssetEvent
+	if changed {
+		// Listeners and events are handled by different goroutines, so
+		// each gets its own copy of the record.
+		snapshot = record.copy()
+		eventAsset := record.copy()
+		if isNew {
+			events = append(events, &AssetEvent{
+				Type:  EventNewDevice,
+				Time:  eventAsset.LastSeen,
+				Asset: eventAsset,
+			})
+			if displaced != nil {
+				// Another device has taken this one's place.
+				name := conflictingIdentifier(displaced, eventAsset)
+				events = append(events, &AssetEvent{
+					Type:     EventIdentifierChange,
+					Time:     eventAsset.LastSeen,
+					Field:    name,
+					OldValue: displaced.Attributes[name].Value,
+					NewValue: eventAsset.Attributes[name].Value,
+					Asset:    eventAsset,
+				})
+			}
+		} else {
+			events = changeEvents(&before, eventAsset)
+		}
+	}
+	inv.save(record, changed)
+
+	if record.LastSeen.After(inv.clock) {
+		inv.clock = record.LastSeen
+	}
+	events = append(events, inv.findLost()...)
+	inv.queueEvents(events)
+	listeners := inv.listeners
+	inv.Unlock()
+
+	if snapshot != nil {
+		for _, listener := range listeners {
+			listener(snapshot)
+		}
+	}
+}
+
+// findLost marks devices that have not been seen for longer than the timeout
+// as missing and returns a device_lost event for each.  A missing device that
+// is seen again is no longer missing.
+func (inv *Inventory) findLost() []*AssetEvent {
+	if inv.lostTimeout <= 0 || inv.clock.Sub(inv.lastLost) < lostCheckInterval {
+		return nil
+	}
+	inv.lastLost = inv.clock
+	cutoff := inv.clock.Add(-inv.lostTimeout)
+
+	var events []*AssetEvent
+	for _, record := range inv.assets {
+		if record.Missing || !record.LastSeen.Before(cutoff) {
+			continue
+		}
+		record.Missing = true
+		inv.save(record, true)
+		events = append(events, &AssetEvent{
+			Type:  EventDeviceLost,
+			Time:  inv.clock,
+			Asset: record.copy(),
+		})
+	}
+	return events
+}
+
+// Len returns the number of records in the inventory.
+func (inv *Inventory) Len() int {
+	inv.Lock()
+	defer inv.Unlock()
+	return len(inv.assets)
+}
+
+// Assets returns a copy of every record, oldest first.
+func (inv *Inventory) Assets() []*Asset {
+	inv.Lock()
+	defer inv.Unlock()
+	assets := make([]*Asset, len(inv.assets))
+	for i, record := range inv.assets {
+		assets[i] = record.copy()
+	}
+	sort.SliceStable(assets, func(i, j int) bool {
+		return assets[i].FirstSeen.Before(assets[j].FirstSeen)
+	})
+	return assets
+}
+
+// add appends a new record.
+func (inv *Inventory) add(record *Asset) {
+	inv.ids[record] = len(inv.assets)
+	inv.assets = append(inv.assets, record)
+	stats.AddInventoryAsset()
+}
+
+// save writes a changed record to the store, or remembers that an unchanged
+// one needs saving by Sync.
+func (inv *Inventory) save(record *Asset, changed bool) {
+	if inv.store == nil {
+		return
+	}
+	id := inv.ids[record]
+	if !changed {
+		inv.unsaved[id] = true
+		return
+	}
+	if err := inv.store.Save(id, record); err != nil {
+		logger.Println("Failed to save asset:", err)
+		stats.AddError(fmt.Errorf("Failed to save asset"))
+		inv.unsaved[id] = true
+		return
+	}
+	delete(inv.unsaved, id)
+}
+
+// find returns the record an observation belongs to, or nil if it belongs to a
+// new device.  In that case it also returns the record, if any, of a different
+// device last seen at one of the observation's addresses.
+func (inv *Inventory) find(observed *Asset) (record, displaced *Asset) {
+	if record, ok := inv.byIdentifier[observed.Identifier]; ok && observed.Identifier != "" {
+		return record, nil
+	}
+	for _, byAddress := range []struct {
+		index   map[string]*Asset
+		address string
+	}{
+		{inv.byIPv4, observed.IPv4Address},
+		{inv.byIPv6, observed.IPv6Address},
+		{inv.byMAC, observed.MACAddress},
+	} {
+		record, ok := byAddress.index[byAddress.address]
+		if !ok || byAddress.address == "" {
+			continue
+		}
+		if conflictingIdentifier(record, observed) == "" {
+			return record, nil
+		}
+		if displaced == nil {
+			displaced = record
+		}
+	}
+	return nil, displaced
+}
+
+// conflictingIdentifier returns the name of an identifying attribute for which
+// two Assets have different values, and so cannot be the same device, or "" if
+// there is none.
+func conflictingIdentifier(a, b *Asset) string {
+	for _, name := range identifierAttributes {
+		x, ok := a.Attributes[name]
+		y, ok2 := b.Attributes[name]
+		if ok && ok2 && x.Value != y.Value {
+			return name
+		}
+	}
+	return ""
+}
+
+// unindex forgets the addresses a record had before an observation changed
+// them, unless they have since been given to another record.
+func (inv *Inventory) unindex(before, record *Asset) {
+	for _, address := range []struct {
+		index    map[string]*Asset
+		old, new string
+	}{
+		{inv.byMAC, before.MACAddress, record.MACAddress},
+		{inv.byIPv4, before.IPv4Address, record.IPv4Address},
+		{inv.byIPv6, before.IPv6Address, record.IPv6Address},
+	} {
+		if address.old != "" && address.old != address.new && address.index[address.old] == record {
+			delete(address.index, address.old)
+		}
+	}
+}
+
+// index makes a record findable by its current addresses and every identifier
+// it has reported.
+func (inv *Inventory) index(record *Asset) {
+	for _, identifier := range record.Identifiers {
+		inv.byIdentifier[identifier] = record
+	}
+	if record.MACAddress != "" {
+		inv.byMAC[record.MACAddress] = record
+	}
+	if record.IPv4Address != "" {
+		inv.byIPv4[record.IPv4Address] = record
+	}
+	if record.IPv6Address != "" {
+		inv.byIPv6[record.IPv6Address] = record
+	}
+}
+
+// merge folds an observation into an inventory record.  It returns true if the
+// record learned something other than the time it was last seen.
+func (asset *Asset) merge(observed *Asset) bool {
+	changed := asset.Missing
+	asset.Missing = false
+	asset.ObservationCount++
+	if observed.LastSeen.After(asset.LastSeen) {
+		asset.LastSeen = observed.LastSeen
+	}
+	if asset.FirstSeen.IsZero() || observed.LastSeen.Before(asset.FirstSeen) {
+		asset.FirstSeen = observed.LastSeen
+	}
+
+	changed = updateString(&asset.MACAddress, observed.MACAddress) || changed
+	changed = updateString(&asset.IPv4Address, observed.IPv4Address) || changed
+	changed = updateString(&asset.IPv6Address, observed.IPv6Address) || changed
+	changed = updateString(&asset.VLANID, observed.VLANID) || changed
+	changed = updateString(&asset.OuterVLANID, observed.OuterVLANID) || changed
+	changed = updateString(&asset.Tunnel, observed.Tunnel) || changed
+	changed = updateString(&asset.TunnelID, observed.TunnelID) || changed
+	updateString(&asset.ListensOnPort, observed.ListensOnPort)
+	updateString(&asset.ConnectsToPort, observed.ConnectsToPort)
+	updateString(&asset.ListensOnPortUDP, observed.ListensOnPortUDP)
+	updateString(&asset.ConnectsToPortUDP, observed.ConnectsToPortUDP)
+	updateString(&asset.Interface, observed.Interface)
+	updateString(&asset.CaptureComment, observed.CaptureComment)
+	updateString(&asset.ClientID, observed.ClientID)
+	changed = addToSet(&asset.ListensOnPorts, observed.ListensOnPort) || changed
+	changed = addToSet(&asset.ConnectsToPorts, observed.ConnectsToPort) || changed
+	changed = addToSet(&asset.ListensOnPortsUDP, observed.ListensOnPortUDP) || changed
+	changed = addToSet(&asset.ConnectsToPortsUDP, observed.ConnectsToPortUDP) || changed
+	changed = addToSet(&asset.Interfaces, observed.Interface) || changed
+	changed = addToSet(&asset.CaptureComments, observed.CaptureComment) || changed
+	changed = addToSet(&asset.Identifiers, observed.Identifier) || changed
+	for _, messageType := range observed.MessageTypes {
+		changed = addToSet(&asset.MessageTypes, messageType) || changed
+	}
+
+	if asset.Attributes == nil {
+		asset.Attributes = make(Attributes)
+	}
+	for name, attr := range observed.Attributes {
+		changed = asset.Attributes.Update(name, attr) || changed
+	}
+	if ident, ok := asset.Attributes.Identifier(); ok {
+		asset.Identifier = ident.Value
+		asset.Provenance = ident.Provenance
+	}
+	return changed
+}
+
+// copy returns a deep copy of an Asset.
+func (asset *Asset) copy() *Asset {
+	c := *asset
+	c.Identifiers = append([]string(nil), asset.Identifiers...)
+	c.ListensOnPorts = append([]string(nil), asset.ListensOnPorts...)
+	c.ConnectsToPorts = append([]string(nil), asset.ConnectsToPorts...)
+	c.ListensOnPortsUDP = append([]string(nil), asset.ListensOnPortsUDP...)
+	c.ConnectsToPortsUDP = append([]string(nil), asset.ConnectsToPortsUDP...)
+	c.Interfaces = append([]string(nil), asset.Interfaces...)
+	c.CaptureComments = append([]string(nil), asset.CaptureComments...)
+	c.MessageTypes = append([]string(nil), asset.MessageTypes...)
+	if asset.Attributes != nil {
+		c.Attributes = make(Attributes, len(asset.Attributes))
+		for name, attr := range asset.Attributes {
+			c.Attributes[name] = attr
+		}
+	}
+	return &c
+}
+
+// updateString replaces *dst with a non-empty src and returns true if *dst
+// changed.
+func updateString(dst *string, src string) bool {
+	if src == "" || *dst == src {
+		return false
+	}
+	*dst = src
+	return true
+}
+
+// addToSet adds a non-empty value to a sorted set of strings and returns true
+// if it was not already there.
+func addToSet(set *[]string, value string) bool {
+	if value == "" {
+		return false
+	}
+	i := sort.SearchStrings(*set, value)
+	if i < len(*set) && (*set)[i] == value {
+		return false
+	}
+	*set = append(*set, "")
+	copy((*set)[i+1:], (*set)[i:])
+	(*set)[i] = value
+	return true
+}
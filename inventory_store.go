@@ -0,0 +1,212 @@
+// Copyright 2019 Virta Laboratories, Inc.  All rights reserved.
+/*
+On-disk asset inventory.
+
+An InventoryStore keeps the inventory in a journal file so that it survives
+restarts.  Each line of the journal is a JSON object holding a record number and
+a complete copy of that record; a later line for the same record supersedes an
+earlier one.  Appending whole records keeps every write small and self-contained,
+so a crash can at worst lose a partly written last line, which is ignored when
+the journal is read back.
+
+When a store is opened, the journal is read, reduced to one line per record,
+and atomically replaced.  Records that are merely seen again are rewritten every
+time they are synced, so a long-running sensor's journal would grow without
+bound; it is compacted the same way whenever it holds several times as many
+lines as there are records.
+*/
+
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"io"
+	"os"
+	"sort"
+	"sync"
+	"time"
+)
+
+const (
+	// Upper limit on the length of one line of the journal
+	maxStoreLineLength = 16 << 20
+
+	// How often to save records that were merely seen again
+	inventorySyncInterval = 30 * time.Second
+
+	// Compact the journal once it holds this many lines per record
+	journalCompactionRatio = 4
+)
+
+// storeEntry is one line of the journal.
+type storeEntry struct {
+	ID    int    `json:"id"`
+	Asset *Asset `json:"asset"`
+}
+
+// InventoryStore is a file-backed journal of inventory records.
+type InventoryStore struct {
+	sync.Mutex
+	filename string
+	file     *os.File
+	loaded   []*Asset // records read from the journal, by record number
+	lines    int      // lines in the journal
+}
+
+// OpenInventoryStore reads an inventory journal, creating it if it does not
+// exist, and prepares it for appending.
+func OpenInventoryStore(filename string) (*InventoryStore, error) {
+	store := new(InventoryStore)
+	store.filename = filename
+	if err := store.load(); err != nil {
+		return nil, err
+	}
+	if err := store.compact(store.loaded); err != nil {
+		return nil, err
+	}
+	return store, nil
+}
+
+// load reads the latest copy of each record from the journal.
+func (store *InventoryStore) load() error {
+	file, err := os.Open(store.filename)
+	if os.IsNotExist(err) {
+		return nil
+	}
+	if err != nil {
+		return err
+	}
+	defer file.Close()
+
+	records := make(map[int]*Asset)
+	scanner := bufio.NewScanner(file)
+	scanner.Buffer(nil, maxStoreLineLength)
+	lineNumber := 0
+	for scanner.Scan() {
+		lineNumber++
+		line := bytes.TrimSpace(scanner.Bytes())
+		if len(line) == 0 {
+			continue
+		}
+		var entry storeEntry
+		if err := json.Unmarshal(line, &entry); err != nil || entry.Asset == nil || entry.ID < 0 {
+			// Most likely a write cut short by a crash
+			logger.Printf("Ignoring bad line %d of %s\n", lineNumber, store.filename)
+			stats.AddError(fmt.Errorf("Bad inventory journal line"))
+			continue
+		}
+		records[entry.ID] = entry.Asset
+	}
+	if err := scanner.Err(); err != nil {
+		return fmt.Errorf("Failed to read %s: %s", store.filename, err)
+	}
+
+	ids := make([]int, 0, len(records))
+	for id := range records {
+		ids = append(ids, id)
+	}
+	sort.Ints(ids)
+	for _, id := range ids {
+		store.loaded = append(store.loaded, records[id])
+	}
+	logger.Printf("Loaded %d assets from %s\n", len(store.loaded), store.filename)
+	return nil
+}
+
+// Compact replaces the journal with one line per record if it has grown to
+// several times that size.  records holds every record, by record number.
+func (store *InventoryStore) Compact(records []*Asset) error {
+	store.Lock()
+	defer store.Unlock()
+	if store.lines <= journalCompactionRatio*len(records) {
+		return nil
+	}
+	logger.Printf("Compacting %s from %d lines to %d\n", store.filename, store.lines, len(records))
+	if err := store.file.Close(); err != nil {
+		return err
+	}
+	return store.compact(records)
+}
+
+// compact replaces the journal with one line per record, numbered by position
+// (as in an Inventory), and opens it for appending.
+func (store *InventoryStore) compact(records []*Asset) error {
+	tmpName := store.filename + ".tmp"
+	tmp, err := os.OpenFile(tmpName, os.O_CREATE|os.O_TRUNC|os.O_WRONLY, 0644)
+	if err != nil {
+		return err
+	}
+	w := bufio.NewWriter(tmp)
+	for id, asset := range records {
+		if err := writeStoreEntry(w, id, asset); err != nil {
+			tmp.Close()
+			return err
+		}
+	}
+	if err := w.Flush(); err != nil {
+		tmp.Close()
+		return err
+	}
+	if err := tmp.Sync(); err != nil {
+		tmp.Close()
+		return err
+	}
+	if err := tmp.Close(); err != nil {
+		return err
+	}
+	if err := os.Rename(tmpName, store.filename); err != nil {
+		return err
+	}
+	file, err := os.OpenFile(store.filename, os.O_APPEND|os.O_WRONLY, 0644)
+	if err != nil {
+		return err
+	}
+	store.file = file
+	store.lines = len(records)
+	return nil
+}
+
+// Loaded returns the records read from the journal when the store was opened.
+func (store *InventoryStore) Loaded() []*Asset {
+	return store.loaded
+}
+
+// Save appends a copy of a record to the journal.
+func (store *InventoryStore) Save(id int, asset *Asset) error {
+	store.Lock()
+	defer store.Unlock()
+	store.lines++
+	return writeStoreEntry(store.file, id, asset)
+}
+
+// Sync commits everything saved so far to stable storage.
+func (store *InventoryStore) Sync() error {
+	store.Lock()
+	defer store.Unlock()
+	return store.file.Sync()
+}
+
+// Close syncs and closes the journal.
+func (store *InventoryStore) Close() error {
+	store.Lock()
+	defer store.Unlock()
+	if err := store.file.Sync(); err != nil {
+		store.file.Close()
+		return err
+	}
+	return store.file.Close()
+}
+
+// writeStoreEntry writes one journal line in a single call, so that a line is
+// never interleaved with another.
+func writeStoreEntry(w io.Writer, id int, asset *Asset) error {
+	line, err := json.Marshal(storeEntry{ID: id, Asset: asset})
+	if err != nil {
+		return err
+	}
+	_, err = w.Write(append(line, '\n'))
+	return err
+}
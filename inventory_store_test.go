@@ -0,0 +1,135 @@
+/*
+Unit tests for the on-disk asset inventory.
+*/
+package main
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestInventoryStoreSurvivesRestart(t *testing.T) {
+	setupLogging(false)
+	stats = *NewStats()
+	dir, err := ioutil.TempDir("", "tapirx")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	filename := filepath.Join(dir, "inventory.json")
+	t0 := time.Date(2019, 1, 1, 0, 0, 0, 0, time.UTC)
+	attrs := Attributes{AttrUDIDI: {Value: "UDI-1", Provenance: "HL7 PRT-16", Confidence: 0.9}}
+
+	// First run: one pump, seen twice
+	store, err := OpenInventoryStore(filename)
+	if err != nil {
+		t.Fatal(err)
+	}
+	inv := NewInventory(0)
+	inv.UseStore(store)
+	inv.Observe(observedAsset("11:22:33:44:55:66", "10.0.0.1", "", t0, attrs))
+	inv.Observe(observedAsset("11:22:33:44:55:66", "10.0.0.1", "", t0.Add(time.Hour), attrs))
+	inv.Observe(observedAsset("aa:bb:cc:dd:ee:ff", "10.0.0.2", "", t0, nil))
+	if err := inv.Sync(); err != nil {
+		t.Fatal(err)
+	}
+	store.Close()
+
+	// Simulate a crash in the middle of a write.
+	f, err := os.OpenFile(filename, os.O_APPEND|os.O_WRONLY, 0644)
+	if err != nil {
+		t.Fatal(err)
+	}
+	f.WriteString(`{"id":0,"asset":{"ipv4_add`)
+	f.Close()
+
+	// Second run
+	store, err = OpenInventoryStore(filename)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer store.Close()
+	inv = NewInventory(0)
+	inv.UseStore(store)
+	if n := inv.Len(); n != 2 {
+		t.Fatalf("Expected 2 restored records, got %d", n)
+	}
+	record := inv.Assets()[0]
+	if record.Identifier != "UDI-1" || record.ObservationCount != 2 {
+		t.Errorf("Unexpected restored record %+v", record)
+	}
+	if !record.LastSeen.Equal(t0.Add(time.Hour)) {
+		t.Errorf("Expected last seen %v, got %v", t0.Add(time.Hour), record.LastSeen)
+	}
+
+	// The journal was compacted to one line per record.
+	contents, err := ioutil.ReadFile(filename)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if lines := strings.Count(string(contents), "\n"); lines != 2 {
+		t.Errorf("Expected 2 journal lines after compaction, got %d", lines)
+	}
+
+	// Restored records are matched by later observations.
+	inv.Observe(observedAsset("11:22:33:44:55:66", "10.0.0.1", "", t0.Add(2*time.Hour), attrs))
+	if n := inv.Len(); n != 2 {
+		t.Errorf("Expected 2 records, got %d", n)
+	}
+}
+
+func TestInventoryStoreCompactsWhileRunning(t *testing.T) {
+	setupLogging(false)
+	stats = *NewStats()
+	dir, err := ioutil.TempDir("", "tapirx")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	filename := filepath.Join(dir, "inventory.json")
+	t0 := time.Date(2019, 1, 1, 0, 0, 0, 0, time.UTC)
+
+	store, err := OpenInventoryStore(filename)
+	if err != nil {
+		t.Fatal(err)
+	}
+	inv := NewInventory(0)
+	inv.UseStore(store)
+	for i := 0; i < 100; i++ {
+		seen := t0.Add(time.Duration(i) * time.Minute)
+		inv.Observe(observedAsset("11:22:33:44:55:66", "10.0.0.1", "", seen, nil))
+		inv.Observe(observedAsset("aa:bb:cc:dd:ee:ff", "10.0.0.2", "", seen, nil))
+		if err := inv.Sync(); err != nil {
+			t.Fatal(err)
+		}
+	}
+	store.Close()
+
+	contents, err := ioutil.ReadFile(filename)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if lines := strings.Count(string(contents), "\n"); lines > 2*(journalCompactionRatio+1) {
+		t.Errorf("Expected the journal to stay compact, got %d lines", lines)
+	}
+
+	store, err = OpenInventoryStore(filename)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer store.Close()
+	inv = NewInventory(0)
+	inv.UseStore(store)
+	if n := inv.Len(); n != 2 {
+		t.Fatalf("Expected 2 restored records, got %d", n)
+	}
+	for _, record := range inv.Assets() {
+		if record.ObservationCount != 100 {
+			t.Errorf("Expected 100 observations, got %d", record.ObservationCount)
+		}
+	}
+}
@@ -0,0 +1,195 @@
+/*
+Unit tests for the asset inventory.
+*/
+package main
+
+import (
+	"strings"
+	"testing"
+	"time"
+)
+
+// observedAsset returns an Asset as a decoder would report it.
+func observedAsset(mac, ipv4, port string, seen time.Time, attrs Attributes) *Asset {
+	asset := &Asset{
+		MACAddress:    mac,
+		IPv4Address:   ipv4,
+		ListensOnPort: port,
+		LastSeen:      seen,
+	}
+	asset.AddObservation(&Observation{Attributes: attrs})
+	return asset
+}
+
+func TestInventoryMergesByMAC(t *testing.T) {
+	stats = *NewStats()
+	inv := NewInventory(0)
+	t0 := time.Date(2019, 1, 1, 0, 0, 0, 0, time.UTC)
+	t1 := t0.Add(time.Minute)
+
+	inv.Observe(observedAsset("11:22:33:44:55:66", "10.0.0.1", "2575", t1, Attributes{
+		AttrUDIDI: {Value: "UDI-1", Provenance: "HL7 PRT-16", Confidence: 0.9},
+	}))
+	inv.Observe(observedAsset("11:22:33:44:55:66", "10.0.0.1", "8000", t0, Attributes{
+		AttrAETitle: {Value: "PUMP", Provenance: "DICOM", Confidence: 0.6},
+	}))
+
+	if n := inv.Len(); n != 1 {
+		t.Fatalf("Expected 1 record, got %d", n)
+	}
+	if stats.InventoryAssets != 1 {
+		t.Errorf("Expected 1 inventory asset in stats, got %d", stats.InventoryAssets)
+	}
+	record := inv.Assets()[0]
+	if record.Identifier != "UDI-1" {
+		t.Errorf("Expected identifier UDI-1, got %q", record.Identifier)
+	}
+	if len(record.Identifiers) != 2 || record.Identifiers[0] != "PUMP" || record.Identifiers[1] != "UDI-1" {
+		t.Errorf("Unexpected identifiers %v", record.Identifiers)
+	}
+	if len(record.ListensOnPorts) != 2 || record.ListensOnPorts[0] != "2575" || record.ListensOnPorts[1] != "8000" {
+		t.Errorf("Unexpected ports %v", record.ListensOnPorts)
+	}
+	if !record.FirstSeen.Equal(t0) || !record.LastSeen.Equal(t1) {
+		t.Errorf("Unexpected first/last seen %v/%v", record.FirstSeen, record.LastSeen)
+	}
+	if record.ObservationCount != 2 {
+		t.Errorf("Expected 2 observations, got %d", record.ObservationCount)
+	}
+}
+
+func TestInventoryMergesByIdentifier(t *testing.T) {
+	stats = *NewStats()
+	inv := NewInventory(0)
+	attrs := Attributes{AttrUDIDI: {Value: "UDI-1", Provenance: "HL7 PRT-16", Confidence: 0.9}}
+
+	// The same device seen behind two different routers
+	inv.Observe(observedAsset("aa:aa:aa:aa:aa:aa", "10.0.0.1", "", time.Now(), attrs))
+	inv.Observe(observedAsset("bb:bb:bb:bb:bb:bb", "10.0.1.1", "", time.Now(), attrs))
+	if n := inv.Len(); n != 1 {
+		t.Errorf("Expected 1 record, got %d", n)
+	}
+
+	// A different device
+	inv.Observe(observedAsset("cc:cc:cc:cc:cc:cc", "10.0.2.1", "", time.Now(), nil))
+	if n := inv.Len(); n != 2 {
+		t.Errorf("Expected 2 records, got %d", n)
+	}
+}
+
+func TestInventoryNotifiesOnChange(t *testing.T) {
+	stats = *NewStats()
+	inv := NewInventory(0)
+	var notified []*Asset
+	inv.OnChange(func(asset *Asset) {
+		notified = append(notified, asset)
+	})
+	attrs := Attributes{AttrUDIDI: {Value: "UDI-1", Provenance: "HL7 PRT-16", Confidence: 0.9}}
+
+	inv.Observe(observedAsset("11:22:33:44:55:66", "10.0.0.1", "", time.Now(), attrs))
+	inv.Observe(observedAsset("11:22:33:44:55:66", "10.0.0.1", "", time.Now(), attrs))
+	if len(notified) != 1 {
+		t.Fatalf("Expected 1 notification for a repeated observation, got %d", len(notified))
+	}
+
+	inv.Observe(observedAsset("11:22:33:44:55:66", "10.0.0.2", "", time.Now(), attrs))
+	if len(notified) != 2 {
+		t.Fatalf("Expected 2 notifications after an address change, got %d", len(notified))
+	}
+	if notified[1].IPv4Address != "10.0.0.2" {
+		t.Errorf("Expected new address in notification, got %q", notified[1].IPv4Address)
+	}
+
+	// Listeners get copies that later observations don't touch.
+	if notified[0].IPv4Address != "10.0.0.1" {
+		t.Errorf("Earlier notification was modified: %q", notified[0].IPv4Address)
+	}
+}
+
+func TestInventoryAccumulatesMessageTypes(t *testing.T) {
+	stats = *NewStats()
+	inv := NewInventory(0)
+	t0 := time.Date(2019, 1, 1, 0, 0, 0, 0, time.UTC)
+	changes := 0
+	inv.OnChange(func(*Asset) { changes++ })
+
+	for _, messageType := range []string{"ORU^R01", "ADT^A01", "ORU^R01"} {
+		asset := &Asset{IPv4Address: "10.0.0.1", LastSeen: t0}
+		asset.AddObservation(&Observation{MessageType: messageType})
+		inv.Observe(asset)
+	}
+
+	record := inv.Assets()[0]
+	if len(record.MessageTypes) != 2 || record.MessageTypes[0] != "ADT^A01" || record.MessageTypes[1] != "ORU^R01" {
+		t.Errorf("Unexpected message types %v", record.MessageTypes)
+	}
+	if changes != 2 {
+		t.Errorf("Expected 2 changes, got %d", changes)
+	}
+}
+
+func TestInventoryKeepsEveryCaptureComment(t *testing.T) {
+	stats = *NewStats()
+	inv := NewInventory(0)
+	t0 := time.Date(2019, 1, 1, 0, 0, 0, 0, time.UTC)
+
+	for _, comment := range []string{"Spare pump", "Pump on bed 4", ""} {
+		inv.Observe(&Asset{IPv4Address: "10.0.0.1", LastSeen: t0, CaptureComment: comment})
+	}
+
+	record := inv.Assets()[0]
+	if strings.Join(record.CaptureComments, ";") != "Pump on bed 4;Spare pump" {
+		t.Errorf("Unexpected capture comments %q", record.CaptureComments)
+	}
+}
+
+func TestInventoryKeepsDevicesBehindARouterApart(t *testing.T) {
+	stats = *NewStats()
+	inv := NewInventory(0)
+	router := "11:22:33:44:55:66"
+
+	inv.Observe(observedAsset(router, "10.0.1.1", "", time.Now(), Attributes{
+		AttrUDIDI: {Value: "PUMP-1", Provenance: "HL7 PRT-16", Confidence: 0.9},
+	}))
+	inv.Observe(observedAsset(router, "10.0.1.2", "", time.Now(), Attributes{
+		AttrUDIDI: {Value: "PUMP-2", Provenance: "HL7 PRT-16", Confidence: 0.9},
+	}))
+	if n := inv.Len(); n != 2 {
+		t.Fatalf("Expected 2 records, got %d", n)
+	}
+
+	// Without an identifier, an observation is matched by its IP address
+	// rather than the router's MAC address.
+	inv.Observe(observedAsset(router, "10.0.1.1", "", time.Now(), nil))
+	for _, record := range inv.Assets() {
+		if len(record.Identifiers) != 1 {
+			t.Errorf("Devices merged: %v", record.Identifiers)
+		}
+		if record.Identifier == "PUMP-1" && record.ObservationCount != 2 {
+			t.Errorf("Observation not matched by IP address: %+v", record)
+		}
+	}
+
+	// The same identifier at the same address is still the same device.
+	inv.Observe(observedAsset(router, "10.0.1.2", "", time.Now(), Attributes{
+		AttrUDIDI: {Value: "PUMP-2", Provenance: "HL7 PRT-16", Confidence: 0.9},
+	}))
+	if n := inv.Len(); n != 2 {
+		t.Errorf("Expected 2 records, got %d", n)
+	}
+}
+
+func TestInventoryForgetsOldAddresses(t *testing.T) {
+	stats = *NewStats()
+	inv := NewInventory(0)
+	attrs := Attributes{AttrUDIDI: {Value: "UDI-1", Provenance: "HL7 PRT-16", Confidence: 0.9}}
+
+	// The device moves from 10.0.0.1 to 10.0.0.2, and a new device without
+	// an identifier takes its old address.
+	inv.Observe(observedAsset("aa:aa:aa:aa:aa:aa", "10.0.0.1", "", time.Now(), attrs))
+	inv.Observe(observedAsset("bb:bb:bb:bb:bb:bb", "10.0.0.2", "", time.Now(), attrs))
+	inv.Observe(observedAsset("cc:cc:cc:cc:cc:cc", "10.0.0.1", "", time.Now(), nil))
+	if n := inv.Len(); n != 2 {
+		t.Errorf("Expected 2 records, got %d", n)
+	}
+}
@@ -14,12 +14,23 @@ feed of network traffic (e.g., a SPAN port).
  # Load packets from a pcap file
  tapirx -pcap foo.pcap [...]
 
+ # Load packets from several pcap files, merged in timestamp order
+ tapirx -pcap foo.pcap -pcap bar.pcap -pcap /captures/ -pcap '/archive/*.pcap' [...]
+
+ # Read a pcap stream from standard input, or over TCP ("PCAP-over-IP")
+ ssh sensor tcpdump -U -w - | tapirx -pcap - [...]
+ tapirx -pcapconnect broker.example.com:57012 [...]
+ tapirx -pcaplisten :57012 [...]
+
  # List available network interfaces and exit
  tapirx -interfaces
 
  # Read packets from the eth0 interface
  tapirx -iface eth0 [...]
 
+ # Read packets from two interfaces at once, with a BPF filter on the second
+ tapirx -iface eth0 -iface "eth1=port 2575" [...]
+
 You can use standard BPF expressions to filter the traffic you capture live or
 extract from pcap files.
 
@@ -55,12 +66,12 @@ import (
 	"io"
 	"io/ioutil"
 	"log"
+	"net"
 	"os"
 	"runtime"
-	"sync"
+	"time"
 
 	"github.com/google/gopacket"
-	"github.com/google/gopacket/pcap"
 
 	// import layers to run its init function
 	_ "github.com/google/gopacket/layers"
@@ -81,23 +92,6 @@ func setupLogging(debug bool) {
 	logger = log.New(traceDest, "INFO: ", log.LstdFlags)
 }
 
-func listInterfaces() {
-	ifaces, err := pcap.FindAllDevs()
-	if err != nil {
-		panic(err)
-	}
-	for _, iface := range ifaces {
-		if runtime.GOOS == "windows" {
-			// On Windows, device names are ugly, like
-			// "\Device\NPF_{XXXXXXXX-XXXX-XXXX-XXXX-XXXXXXXXXXXX}",
-			// so display a more descriptive name too.
-			fmt.Printf("%s\t(%s)\n", iface.Name, iface.Description)
-		} else {
-			fmt.Println(iface.Name)
-		}
-	}
-}
-
 func main() {
 	// Default client ID is this computer's hostname
 	hostname, err := os.Hostname()
@@ -109,18 +103,36 @@ func main() {
 	// parse command-line flags
 	flag.BoolVar(&verbose, "verbose", false, "Show verbose output")
 	debug := flag.Bool("debug", false, "Show debug output")
-	ifaceName := flag.String("iface", "eth0", "Interface to listen on")
+	var ifaceSpecs stringList
+	flag.Var(&ifaceSpecs, "iface", "Interface to listen on, optionally as name=filter (may be repeated; default eth0)")
 	bpfExpr := flag.String("bpf", "", "BPF filtering expression")
-	fileName := flag.String("pcap", "", "pcap file to read")
+	snaplen := flag.Int("snaplen", 65535, "Bytes of each packet to capture from interfaces")
+	promisc := flag.Bool("promisc", true, "Capture in promiscuous mode (-promisc=false to disable)")
+	bufferSize := flag.Int("buffersize", 0, "Kernel capture buffer size in bytes, 0 for the default")
+	immediate := flag.Bool("immediate", false, "Deliver captured packets as they arrive instead of in batches")
+	var captureNames stringList
+	flag.Var(&captureNames, "pcap", "pcap file, directory or glob to read (may be repeated), or - for standard input")
+	pcapConnect := flag.String("pcapconnect", "", "Read a PCAP-over-IP stream from this host:port, reconnecting as needed")
+	pcapListen := flag.String("pcaplisten", "", "Accept PCAP-over-IP streams on this [host]:port")
+	progress := flag.Bool("progress", false, "Report progress through pcap files on standard error")
 	apiURL := flag.String("apiurl", "", "Upload API url")
 	apiToken := flag.String("apitoken", "", "Upload API token")
+	apiEventURL := flag.String("apieventurl", "", "Upload API url for asset change events (default is -apiurl)")
 	apiLimit := flag.Int("apilimit", 10, "Limit of concurrent requests to API")
 	clientID := flag.String("clientid", hostname, "Client ID sent with API requests")
 	statsFlag := flag.Bool("stats", false, "Show statistics (as JSON data) before exiting")
 	version := flag.Bool("version", false, "Show version information and exit")
 	packetLimit := flag.Int("limit", 0, "Exit after N packets, 0 for unlimited")
-	sequential := flag.Bool("sequential", false, "Process packets sequentially")
+	sequential := flag.Bool("sequential", false, "Process packets sequentially (same as -workers 1)")
+	workers := flag.Int("workers", runtime.NumCPU(), "Number of packet-handling workers")
+	queueSize := flag.Int("queue", 10000, "Number of packets that may wait for a worker")
+	dropWhenFull := flag.Bool("drop", false, "Drop packets when the queue is full instead of waiting")
+	hl7FieldsFilename := flag.String("hl7fields", "", "Read HL7 fields to extract from this JSON file")
+	streamTimeout := flag.Duration("streamtimeout", 2*time.Minute, "Forget idle TCP streams after this long")
 	csvFilename := flag.String("csv", "", "Stream assets to CSV file")
+	eventCSVFilename := flag.String("eventcsv", "", "Stream asset change events to CSV file")
+	lostTimeout := flag.Duration("losttimeout", time.Hour, "Report devices not seen for this long as lost, 0 for never")
+	inventoryFilename := flag.String("inventory", "", "Keep the asset inventory in this file across restarts")
 	listIfaces := flag.Bool("interfaces", false, "List all network interfaces and exit")
 	flag.Parse()
 
@@ -137,40 +149,80 @@ func main() {
 		os.Exit(0)
 	}
 
-	if *statsFlag {
-		// Print stats before exit via Ctrl-C-esque interrupt
-		registerInterruptHandler()
-	}
-
 	logger.Printf("starting %s %s (%s)\n", ProductName, Version, runtime.GOOS)
 	defer logger.Printf("exiting %s\n", ProductName)
 
-	var handle *pcap.Handle
-	// Read from file or from interface (and bail if there's a failure)
-	if *fileName != "" {
-		logger.Printf("read from file %v\n", *fileName)
-		handle, err = pcap.OpenOffline(*fileName)
-	} else {
-		logger.Printf("listen on interface %v\n", *ifaceName)
-		handle, err = pcap.OpenLive(*ifaceName, 1600, true, pcap.BlockForever)
-	}
-	if err != nil {
-		panic(err)
-	}
-
-	// Set a Berkeley Packet Filter (BPF) filter if one is provided
 	if *bpfExpr != "" {
 		logger.Printf("BPF filter expression: [%s]\n", *bpfExpr)
-		if err := handle.SetBPFFilter(*bpfExpr); err != nil {
+	}
+
+	// Read from files, streams or interfaces (and bail if there's a failure)
+	var packets chan gopacket.Packet
+	captureNames = append(captureNames, flag.Args()...)
+	sources := 0
+	for _, given := range []bool{len(captureNames) > 0, *pcapConnect != "", *pcapListen != ""} {
+		if given {
+			sources++
+		}
+	}
+	if sources > 1 {
+		panic("Choose one of -pcap, -pcapconnect and -pcaplisten")
+	}
+	for _, name := range captureNames {
+		if name == "-" && len(captureNames) > 1 {
+			panic("-pcap - reads standard input and cannot be combined with other capture files")
+		}
+	}
+	live := true // whether packets are captured as they are sent
+	switch {
+	case len(captureNames) == 1 && captureNames[0] == "-":
+		live = false
+		packets = readStdin(*bpfExpr)
+	case len(captureNames) > 0:
+		live = false
+		files, err := expandCaptureFiles(captureNames)
+		if err != nil {
+			panic(err)
+		}
+		var progressDest io.Writer
+		if *progress {
+			progressDest = os.Stderr
+		}
+		merger, err := NewCaptureFileMerger(files, *bpfExpr, progressDest)
+		if err != nil {
+			panic(err)
+		}
+		packets = merger.Packets()
+	case *pcapConnect != "":
+		packets = connectStream(*pcapConnect, *bpfExpr, nil)
+	case *pcapListen != "":
+		listener, err := net.Listen("tcp", *pcapListen)
+		if err != nil {
+			panic(err)
+		}
+		packets = listenStream(listener, *bpfExpr)
+	default:
+		if len(ifaceSpecs) == 0 {
+			ifaceSpecs = stringList{"eth0"}
+		}
+		config := captureConfig{
+			snaplen:    *snaplen,
+			promisc:    *promisc,
+			bufferSize: *bufferSize,
+			immediate:  *immediate,
+		}
+		packets, err = openInterfaces(ifaceSpecs, *bpfExpr, config)
+		if err != nil {
 			panic(err)
 		}
 	}
 
-	packetSource := gopacket.NewPacketSource(handle, handle.LinkType())
-
 	// Configure the API client module
 	apiClientEnabled := *apiURL != ""
 	apiClient := NewAPIClient(*apiURL, *apiToken, *clientID, *apiLimit, apiClientEnabled)
+	if *apiEventURL != "" {
+		apiClient.eventURL = *apiEventURL
+	}
 
 	// Configure CSV writer module
 	assetCSVWriter, err := NewAssetCSVWriter(*csvFilename)
@@ -180,14 +232,23 @@ func main() {
 	if assetCSVWriter != nil {
 		defer assetCSVWriter.Close()
 	}
-
-	// A WaitGroup will let us wait until all threads have finished before exit
-	// http://goinbigdata.com/golang-wait-for-all-goroutines-to-finish/
-	var waitGroup sync.WaitGroup
+	eventCSVWriter, err := NewEventCSVWriter(*eventCSVFilename)
+	if err != nil {
+		panic(err)
+	}
+	if eventCSVWriter != nil {
+		defer eventCSVWriter.Close()
+	}
 
 	// Make a set of decoders against which each incoming packet will be tested.
+	hl7Decoder := &HL7Decoder{}
+	if *hl7FieldsFilename != "" {
+		if hl7Decoder.fieldConfig, err = LoadHL7FieldConfig(*hl7FieldsFilename); err != nil {
+			panic(err)
+		}
+	}
 	appLayerDecoders := []PayloadDecoder{
-		&HL7Decoder{},
+		hl7Decoder,
 		&DicomDecoder{},
 	}
 	for _, decoder := range appLayerDecoders {
@@ -196,25 +257,96 @@ func main() {
 		}
 	}
 
-	// Handle a sequence of packets. If sequential is set, handle every packet in the main thread.
-	// Otherwise, spawn a goroutine for each packet.
+	// Merge observations into one record per device, and report records as
+	// they are created or change, along with events describing the changes.
+	inventory := NewInventory(*lostTimeout)
+	inventory.OnChange(func(asset *Asset) {
+		reportAsset(asset, apiClient, assetCSVWriter)
+	})
+	inventory.OnEvent(func(event *AssetEvent) {
+		reportEvent(event, apiClient, eventCSVWriter)
+	})
+
+	// Prerecorded traffic is judged by its own timestamps, but during live
+	// capture devices must be reported lost even when all traffic stops.
+	if live && *lostTimeout > 0 {
+		go func() {
+			for now := range time.Tick(lostCheckInterval) {
+				inventory.CheckLost(now)
+			}
+		}()
+	}
+
+	// Remember the inventory across restarts if requested by the user.
+	var store *InventoryStore
+	if *inventoryFilename != "" {
+		store, err = OpenInventoryStore(*inventoryFilename)
+		if err != nil {
+			panic(err)
+		}
+		defer store.Close()
+		inventory.UseStore(store)
+		go func() {
+			for range time.Tick(inventorySyncInterval) {
+				if err := inventory.Sync(); err != nil {
+					logger.Println("Failed to sync inventory:", err)
+				}
+			}
+		}()
+	}
+
+	// A live capture runs until interrupted, so save the inventory and print
+	// stats (if requested) before exiting via Ctrl-C-esque interrupt.
+	registerInterruptHandler(func() {
+		if err := inventory.Sync(); err != nil {
+			logger.Println("Failed to sync inventory:", err)
+		}
+		if store != nil {
+			if err := store.Close(); err != nil {
+				logger.Println("Failed to close inventory:", err)
+			}
+		}
+		if *statsFlag {
+			fmt.Println(stats.String())
+		}
+	})
+
+	// Reassemble TCP streams so that messages spanning several segments are
+	// decoded whole.
+	reassembler := NewTCPReassembler(appLayerDecoders, *streamTimeout, inventory.Observe)
+
+	// Handle packets in a fixed pool of workers.
+	if *sequential {
+		*workers = 1
+	}
+	packetWorkers := NewPacketWorkers(*workers, *queueSize, *dropWhenFull, func(packet gopacket.Packet) {
+		handlePacket(packet, appLayerDecoders, reassembler, inventory)
+	})
+	defragmenter := NewDefragmenter()
 	nPackets := 0
-	for packet := range packetSource.Packets() {
+	for packet := range packets {
 		if *packetLimit > 0 && nPackets >= *packetLimit {
 			logger.Printf("Packet limit %d reached; exiting.\n", *packetLimit)
 			break
 		}
-		waitGroup.Add(1)
-		if *sequential {
-			handlePacket(packet, appLayerDecoders, apiClient, assetCSVWriter, &waitGroup)
-		} else {
-			go handlePacket(packet, appLayerDecoders, apiClient, assetCSVWriter, &waitGroup)
-		}
 		nPackets++
+
+		// Reassemble fragments and strip tunnels before choosing a worker,
+		// so that packets are assigned by their inner flows.
+		if packet = preparePacket(packet, defragmenter); packet != nil {
+			packetWorkers.Submit(packet)
+		}
 	}
 
-	// Block until we receive a notification from the workers.
-	waitGroup.Wait()
+	// Block until the workers have handled every queued packet.
+	packetWorkers.Close()
+
+	// Decode whatever is left in streams that never finished.
+	reassembler.FlushAll()
+	if err := inventory.Sync(); err != nil {
+		logger.Println("Failed to sync inventory:", err)
+	}
+	inventory.WaitEvents()
 
 	// Print stats
 	if *statsFlag {
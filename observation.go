@@ -0,0 +1,185 @@
+// Copyright 2019 Virta Laboratories, Inc.  All rights reserved.
+/*
+Observations: what a decoder learned about a device from one message.
+
+A decoder may learn several things from one message (a UDI device identifier,
+a lot number, a serial number, ...), and each comes from a different place in
+the message and deserves a different degree of trust.  An Observation records
+each of these as a named Attribute with its own provenance and confidence.
+*/
+
+package main
+
+// Names of attributes that decoders may report.
+const (
+	AttrUDIDI           = "udi_di"
+	AttrEquipmentID     = "equipment_id"
+	AttrSerialNumber    = "serial_number"
+	AttrManufacturer    = "manufacturer"
+	AttrModel           = "model"
+	AttrSoftwareVersion = "software_version"
+	AttrAETitle         = "ae_title"
+	AttrHostname        = "hostname"
+	AttrLotNumber       = "lot_number"
+	AttrManufactureDate = "manufacture_date"
+	AttrExpiryDate      = "expiry_date"
+	AttrDonationID      = "donation_id"
+	AttrDeviceType      = "device_type"
+	AttrUDIIssuer       = "udi_issuer"
+	AttrEUI64           = "eui64"
+
+	AttrEquipmentNamespace = "equipment_namespace"
+
+	AttrSendingApplication   = "sending_application"
+	AttrSendingFacility      = "sending_facility"
+	AttrReceivingApplication = "receiving_application"
+	AttrReceivingFacility    = "receiving_facility"
+	AttrHL7Version           = "hl7_version"
+	AttrHL7CharacterSet      = "hl7_character_set"
+	AttrHL7Role              = "hl7_role"
+)
+
+// attributeNames lists every well-known attribute in the order in which they
+// appear in CSV output.
+var attributeNames = []string{
+	AttrUDIDI,
+	AttrEquipmentID,
+	AttrSerialNumber,
+	AttrManufacturer,
+	AttrModel,
+	AttrSoftwareVersion,
+	AttrAETitle,
+	AttrHostname,
+	AttrLotNumber,
+	AttrManufactureDate,
+	AttrExpiryDate,
+	AttrDonationID,
+	AttrDeviceType,
+	AttrUDIIssuer,
+	AttrEUI64,
+	AttrEquipmentNamespace,
+	AttrSendingApplication,
+	AttrSendingFacility,
+	AttrReceivingApplication,
+	AttrReceivingFacility,
+	AttrHL7Version,
+	AttrHL7CharacterSet,
+	AttrHL7Role,
+}
+
+// identifierAttributes lists the attributes that may serve as an Asset's
+// primary identifier, most specific first.
+var identifierAttributes = []string{
+	AttrUDIDI,
+	AttrEquipmentID,
+	AttrEUI64,
+	AttrSerialNumber,
+	AttrAETitle,
+	AttrHostname,
+}
+
+// An Attribute is one fact about a device, along with where it came from and
+// how much it should be trusted (from 0 to 1).
+//
+// A decoder that reads an attribute from several sources in order of
+// preference gives each source a Rank, 0 for the first.  Of two Attributes that
+// are trusted equally, the one with the lower Rank wins.
+type Attribute struct {
+	Value      string  `json:"value"`
+	Provenance string  `json:"provenance"`
+	Confidence float64 `json:"confidence"`
+	Rank       int     `json:"rank,omitempty"`
+}
+
+// outranks returns true if an Attribute should win over another.
+func (attr Attribute) outranks(other Attribute) bool {
+	if attr.Confidence != other.Confidence {
+		return attr.Confidence > other.Confidence
+	}
+	return attr.Rank < other.Rank
+}
+
+// Attributes maps attribute names to Attributes.
+type Attributes map[string]Attribute
+
+// Merge adds an Attribute, keeping an existing one with the same name unless
+// the new one is more trustworthy.  Empty values are ignored.
+func (attrs Attributes) Merge(name string, attr Attribute) {
+	if attr.Value == "" {
+		return
+	}
+	if existing, ok := attrs[name]; ok && !attr.outranks(existing) {
+		return
+	}
+	attrs[name] = attr
+}
+
+// Update adds a newer Attribute, replacing an existing one with the same name
+// unless the existing one is more trustworthy.  Empty values are ignored.  It
+// returns true if the value changed.
+func (attrs Attributes) Update(name string, attr Attribute) bool {
+	if attr.Value == "" {
+		return false
+	}
+	existing, ok := attrs[name]
+	if ok && existing.outranks(attr) {
+		return false
+	}
+	attrs[name] = attr
+	return !ok || existing.Value != attr.Value
+}
+
+// Identifier returns the most specific identifying Attribute, if any.
+func (attrs Attributes) Identifier() (Attribute, bool) {
+	for _, name := range identifierAttributes {
+		if attr, ok := attrs[name]; ok {
+			return attr, true
+		}
+	}
+	return Attribute{}, false
+}
+
+// An Observation holds everything a decoder learned from one message.
+type Observation struct {
+	Attributes Attributes
+
+	// The type of the message, such as "ORU^R01", if the protocol has them
+	MessageType string
+
+	// An ID of the message that is unique among its sender's messages and,
+	// if it is an acknowledgment, the ID of the message it acknowledges and
+	// its acknowledgment code
+	MessageID    string
+	Acknowledges string
+	AckCode      string
+
+	// Observations of other devices that the message describes, such as the
+	// devices behind a gateway
+	Devices []*Observation
+}
+
+// NewObservation returns a new, empty Observation.
+func NewObservation() *Observation {
+	return &Observation{Attributes: make(Attributes)}
+}
+
+// Add records an attribute learned from a message.
+func (obs *Observation) Add(name, value, provenance string, confidence float64) {
+	obs.AddRanked(name, value, provenance, confidence, 0)
+}
+
+// AddRanked records an attribute learned from a message, read from a source of
+// the given rank among those the decoder prefers it from.
+func (obs *Observation) AddRanked(name, value, provenance string, confidence float64, rank int) {
+	obs.Attributes.Merge(name, Attribute{
+		Value:      value,
+		Provenance: provenance,
+		Confidence: confidence,
+		Rank:       rank,
+	})
+}
+
+// Empty returns true if nothing was learned.
+func (obs *Observation) Empty() bool {
+	return obs == nil || (len(obs.Attributes) == 0 && obs.MessageType == "")
+}
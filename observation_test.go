@@ -0,0 +1,62 @@
+/*
+Unit tests for observations and attributes.
+*/
+package main
+
+import "testing"
+
+func TestObservationAdd(t *testing.T) {
+	obs := NewObservation()
+	if !obs.Empty() {
+		t.Errorf("New observation should be empty")
+	}
+
+	obs.Add(AttrModel, "", "HL7 PRT-10", 0.9)
+	if !obs.Empty() {
+		t.Errorf("Empty values should be ignored")
+	}
+
+	obs.Add(AttrModel, "Plum A+", "HL7 PRT-10", 0.5)
+	obs.Add(AttrModel, "Plum A+ 3", "HL7 OBX-18", 0.9)
+	obs.Add(AttrModel, "Plum", "DICOM", 0.9)
+	if attr := obs.Attributes[AttrModel]; attr.Value != "Plum A+ 3" || attr.Provenance != "HL7 OBX-18" {
+		t.Errorf("Expected the first most confident value to win, got %v", attr)
+	}
+}
+
+func TestAttributesIdentifier(t *testing.T) {
+	attrs := make(Attributes)
+	if _, ok := attrs.Identifier(); ok {
+		t.Errorf("Got an identifier from empty attributes")
+	}
+
+	attrs.Merge(AttrLotNumber, Attribute{Value: "LOT123", Confidence: 0.9})
+	if _, ok := attrs.Identifier(); ok {
+		t.Errorf("A lot number is not an identifier")
+	}
+
+	attrs.Merge(AttrAETitle, Attribute{Value: "PUMP1", Provenance: "DICOM", Confidence: 0.6})
+	attrs.Merge(AttrUDIDI, Attribute{Value: "00643169007222", Provenance: "HL7 PRT-16", Confidence: 0.9})
+	if ident, _ := attrs.Identifier(); ident.Value != "00643169007222" {
+		t.Errorf("Expected the UDI-DI to be the identifier, got '%s'", ident.Value)
+	}
+}
+
+func TestAssetAddObservation(t *testing.T) {
+	obs := NewObservation()
+	obs.Add(AttrAETitle, "PUMP1", "DICOM", 0.6)
+	obs.Add(AttrSoftwareVersion, "1.2.3", "DICOM implementation version", 0.8)
+
+	template := Asset{MACAddress: "11:22:33:44:55:66"}
+	asset := template
+	asset.AddObservation(obs)
+	if asset.Identifier != "PUMP1" || asset.Provenance != "DICOM" {
+		t.Errorf("Wrong identifier '%s' (provenance '%s')", asset.Identifier, asset.Provenance)
+	}
+	if len(asset.Attributes) != 2 {
+		t.Errorf("Expected 2 attributes, got %d", len(asset.Attributes))
+	}
+	if template.Attributes != nil {
+		t.Errorf("Adding an observation modified the template")
+	}
+}
@@ -8,29 +8,69 @@ package main
 import (
 	"encoding/json"
 	"fmt"
-	"sync"
+	"strconv"
 	"time"
 
 	"github.com/google/gopacket"
 	"github.com/google/gopacket/layers"
 )
 
+// ARPHRD_ETHER, the SLL address type of Ethernet addresses
+const arphrdEther = 1
+
+// vlanTags decodes 802.1Q tags like layers.Dot1Q, but remembers the VLAN ID of
+// every tag in a stack (as in 802.1ad QinQ), outermost first.
+type vlanTags struct {
+	layers.Dot1Q
+	ids []uint16
+}
+
+// DecodeFromBytes implements gopacket.DecodingLayer.
+func (v *vlanTags) DecodeFromBytes(data []byte, df gopacket.DecodeFeedback) error {
+	if err := v.Dot1Q.DecodeFromBytes(data, df); err != nil {
+		return err
+	}
+	v.ids = append(v.ids, v.VLANIdentifier)
+	return nil
+}
+
+// linkLayerType returns the type of the first layer of a packet, which the
+// packet source chose according to the link type of its capture.  Packets that
+// could not be decoded at all are assumed to be Ethernet frames.
+func linkLayerType(packet gopacket.Packet) gopacket.LayerType {
+	if packetLayers := packet.Layers(); len(packetLayers) > 0 {
+		if first := packetLayers[0].LayerType(); first != gopacket.LayerTypeDecodeFailure {
+			return first
+		}
+	}
+	return layers.LayerTypeEthernet
+}
+
 // decodeLayers extracts information from packets and stuffs any discovered
 // metadata into the provided Asset object.
 func decodeLayers(packet gopacket.Packet, asset *Asset) error {
 	// Decode link, network, and transport layers to extract metadata about a
 	// packet that may represent an asset.
 	//
+	// Decoding starts from the packet's link type, so that captures from Linux
+	// "any" devices (SLL), raw IP captures and loopback captures are understood
+	// as well as Ethernet.
+	//
 	// Ignore errors produced by DecodeLayer() because we can still get
 	// information from the layers that didn't produce an error.
 	//
 	// Docs:
 	// https://godoc.org/github.com/google/gopacket#hdr-Fast_Decoding_With_DecodingLayerParser
 	var eth layers.Ethernet
+	var sll layers.LinuxSLL
+	var loop layers.Loopback
+	var vlan vlanTags
 	var ip4 layers.IPv4
 	var ip6 layers.IPv6
 	var tcp layers.TCP
-	parser := gopacket.NewDecodingLayerParser(layers.LayerTypeEthernet, &eth, &ip4, &ip6, &tcp)
+	var udp layers.UDP
+	parser := gopacket.NewDecodingLayerParser(linkLayerType(packet),
+		&eth, &sll, &loop, &vlan, &ip4, &ip6, &tcp, &udp)
 	decoded := []gopacket.LayerType{}
 	logger.Println("Decode packet")
 	parser.DecodeLayers(packet.Data(), &decoded)
@@ -40,6 +80,19 @@ func decodeLayers(packet gopacket.Packet, asset *Asset) error {
 			asset.MACAddress = eth.SrcMAC.String()
 			stats.AddLayer("Ethernet")
 			logger.Println("  Eth", eth.SrcMAC, eth.DstMAC)
+		case layers.LayerTypeLinuxSLL:
+			// The link-layer address in an SLL header is the sender's.
+			if sll.AddrType == arphrdEther && sll.AddrLen == 6 {
+				asset.MACAddress = sll.Addr.String()
+			}
+			stats.AddLayer("LinuxSLL")
+			logger.Println("  SLL", sll.Addr)
+		case layers.LayerTypeLoopback:
+			stats.AddLayer("Loopback")
+			logger.Println("  Loopback")
+		case layers.LayerTypeDot1Q:
+			stats.AddLayer("Dot1Q")
+			logger.Println("  VLAN", vlan.VLANIdentifier)
 		case layers.LayerTypeIPv4:
 			asset.IPv4Address = ip4.SrcIP.String()
 			stats.AddLayer("IPv4")
@@ -69,17 +122,53 @@ func decodeLayers(packet gopacket.Packet, asset *Asset) error {
 					logger.Printf("  TCP client to :%s\n", tcp.DstPort)
 				}
 			}
+		case layers.LayerTypeUDP:
+			logger.Printf("UDP %d->%d\n", udp.SrcPort, udp.DstPort)
+			stats.AddLayer("UDP")
+			// UDP has no handshake, so guess that the lower port belongs to
+			// the service: a datagram sent from it comes from a server, and
+			// one sent to it comes from a client.  Peers that use the same
+			// port (as in mDNS or NTP) are both servers.
+			if udp.SrcPort <= udp.DstPort {
+				asset.ListensOnPortUDP = udp.SrcPort.String()
+				logger.Printf("  UDP server on %s\n", udp.SrcPort)
+			} else {
+				asset.ConnectsToPortUDP = udp.DstPort.String()
+				logger.Printf("  UDP client to :%s\n", udp.DstPort)
+			}
+		}
+	}
+
+	// The innermost tag identifies the network segment; an outer tag, if
+	// any, was added by the service provider.
+	if n := len(vlan.ids); n > 0 {
+		asset.VLANID = strconv.Itoa(int(vlan.ids[n-1]))
+		if n > 1 {
+			asset.OuterVLANID = strconv.Itoa(int(vlan.ids[0]))
 		}
 	}
 	return nil
 }
 
 // parseApplicationLayer extracts information from a packet's application layer,
-// if one exists, and updates a provided Asset object.
-func parseApplicationLayer(packet gopacket.Packet, decoders []PayloadDecoder, asset *Asset) error {
-	app := packet.ApplicationLayer()
-	if app == nil {
-		return fmt.Errorf("No application layer")
+// if one exists, and returns a copy of the provided Asset object for each
+// identified message.
+//
+// The payloads of UDP datagrams are only given to decoders that implement
+// DatagramDecoder and accept them.  Most are not decoded at all.
+func parseApplicationLayer(packet gopacket.Packet, decoders []PayloadDecoder, asset *Asset) ([]*Asset, error) {
+	var payload []byte
+	isUDP := false
+	if udp, ok := packet.TransportLayer().(*layers.UDP); ok {
+		// gopacket may have decoded the payload as some protocol it knows,
+		// but we want the bytes.
+		payload = udp.LayerPayload()
+		isUDP = true
+	} else if app := packet.ApplicationLayer(); app != nil {
+		payload = app.Payload()
+	}
+	if len(payload) == 0 {
+		return nil, fmt.Errorf("No application layer")
 	}
 
 	// Update statstics
@@ -88,54 +177,144 @@ func parseApplicationLayer(packet gopacket.Packet, decoders []PayloadDecoder, as
 	// Try to decode the application layer using each available decoder in turn,
 	// stopping when a decoder succeeds or there are no decoders remaining.
 	for _, decoder := range decoders {
-		decoderName := decoder.Name()
-		identifier, provenance, err := decoder.DecodePayload(&app)
-		if err == nil {
+		if isUDP && !decodesUDP(decoder) {
+			continue
+		}
+		assets, ok := decodeMessages(decoder, payload, asset)
+		if ok {
 			// Success, we're done
-			asset.Identifier = identifier
-			asset.Provenance = provenance
-			stats.AddLayer("Application/" + decoderName)
-			break
+			if len(assets) == 0 {
+				break
+			}
+			return assets, nil
 		}
 	}
-	if asset.Identifier == "" {
-		return fmt.Errorf("failed to find a decoder, no identifier")
+	return nil, fmt.Errorf("failed to find a decoder, no identifier")
+}
+
+// decodesUDP returns true if a decoder accepts the payloads of UDP datagrams.
+func decodesUDP(decoder PayloadDecoder) bool {
+	datagramDecoder, ok := decoder.(DatagramDecoder)
+	return ok && datagramDecoder.DecodesUDP()
+}
+
+// decodeMessages runs a decoder against every message in a payload.  It returns
+// a copy of the template Asset for each device about which the decoder learned
+// something, and reports whether the decoder understood the payload at all.
+func decodeMessages(decoder PayloadDecoder, payload []byte, template *Asset) ([]*Asset, bool) {
+	messages := [][]byte{payload}
+	if splitter, ok := decoder.(MessageSplitter); ok {
+		messages = splitter.SplitMessages(payload)
+	}
+
+	var assets []*Asset
+	recognized := false
+	for _, message := range messages {
+		app := gopacket.ApplicationLayer(gopacket.Payload(message))
+		obs, err := decoder.DecodePayload(&app)
+		if err != nil {
+			continue
+		}
+		recognized = true
+		stats.AddLayer("Application/" + decoder.Name())
+		if correlator, ok := decoder.(CorrelatingDecoder); ok {
+			correlator.Correlate(obs, template)
+		}
+		for _, device := range append([]*Observation{obs}, obs.Devices...) {
+			if device.Empty() {
+				continue
+			}
+			asset := *template
+			asset.AddObservation(device)
+			assets = append(assets, &asset)
+		}
 	}
+	return assets, recognized
+}
 
-	return nil
+// preparePacket puts fragmented datagrams back together and strips tunnels,
+// including from datagrams fragmented inside a tunnel.  It returns nil if the
+// packet is a fragment of a datagram that is not yet complete.
+func preparePacket(packet gopacket.Packet, defragmenter *Defragmenter) gopacket.Packet {
+	if packet = defragmenter.Defragment(packet); packet == nil {
+		return nil
+	}
+	inner := decapsulate(packet)
+	if inner == packet {
+		return packet
+	}
+	return defragmenter.Defragment(inner)
 }
 
 // handlePacket extracts information from packets, invokes decoding functions
 // that attempt to interpret the contents of application layers, updates
-// packet-processing statistics, and optionally uploads its findings to a REST
-// API endpoint.
+// packet-processing statistics, and merges its findings into an inventory.
+//
+// Packets should already have been prepared by preparePacket; the tunnel a
+// packet arrived through, the interface it was captured on and its pcapng
+// comment, if any, are recorded on the Asset.
+//
+// If reassembler is not nil, TCP packets are handed to it so that messages
+// spanning several segments can be decoded once they are complete.  Otherwise
+// each packet's application layer is decoded on its own.
 func handlePacket(
 	packet gopacket.Packet,
 	appLayerDecoders []PayloadDecoder,
-	apiClient *APIClient,
-	assetCSVWriter *AssetCSVWriter,
-	waitGroup *sync.WaitGroup,
+	reassembler *TCPReassembler,
+	inventory *Inventory,
 ) {
-	if waitGroup != nil {
-		defer waitGroup.Done()
-	}
-
 	// Initialize an empty Asset to store information learned during dissection
 	asset := &Asset{}
-	asset.LastSeen = time.Now()
+	asset.LastSeen = captureTime(packet)
+	if tunnel, ok := packetTunnel(packet); ok {
+		asset.Tunnel = tunnel.Type
+		asset.TunnelID = tunnel.ID
+	}
+	asset.Interface = packetInterface(packet)
+	asset.CaptureComment = packetComment(packet)
 
 	// Decode packet and update statistics
 	stats.AddPacket()
 	if err := decodeLayers(packet, asset); err != nil {
 		stats.AddError(err)
 		return
-	} else if err := parseApplicationLayer(packet, appLayerDecoders, asset); err != nil {
+	}
+	if reassembler != nil {
+		if tcp, ok := packet.TransportLayer().(*layers.TCP); ok {
+			reassembler.Assemble(packet, tcp, asset)
+			return
+		}
+	}
+	assets, err := parseApplicationLayer(packet, appLayerDecoders, asset)
+	if _, isUDP := packet.TransportLayer().(*layers.UDP); isUDP && err != nil {
+		// No decoder understands most UDP traffic, and that is not an
+		// error, but the ports a device uses are still worth knowing.
+		assets = []*Asset{asset}
+	} else if err != nil {
 		stats.AddError(err)
 		return
-	} else {
+	}
+	for _, asset := range assets {
 		stats.AddAsset(asset)
+		if inventory != nil {
+			inventory.Observe(asset)
+		}
 	}
+}
+
+// captureTime returns the time at which a packet was captured, or the current
+// time if the packet source did not say.
+func captureTime(packet gopacket.Packet) time.Time {
+	if ts := packet.Metadata().Timestamp; !ts.IsZero() {
+		return ts
+	}
+	return time.Now()
+}
 
+// reportAsset writes an Asset to standard output, a CSV file, and a REST API
+// endpoint, as requested by the user.  It is called whenever an inventory
+// record is created or changes.
+func reportAsset(asset *Asset, apiClient *APIClient, assetCSVWriter *AssetCSVWriter) {
 	// Write to stdout and stderr
 	bytesRepresentation, err := json.Marshal(asset)
 	if err != nil {
@@ -156,7 +335,7 @@ func handlePacket(
 
 	// Upload to API if requested by the user.  If the user did not specify a
 	// URL with a command line flag, the URL will be empty.
-	if apiClient.enabled {
+	if apiClient != nil && apiClient.enabled {
 		if _, err := apiClient.Upload(asset); err != nil {
 			logger.Println("API Upload error:", err)
 			stats.AddUploadError(err)
@@ -1,11 +1,13 @@
 package main
 
 import (
+	"fmt"
+	"strings"
 	"testing"
+	"time"
 
 	"github.com/google/gopacket"
 	"github.com/google/gopacket/layers"
-	"github.com/google/gopacket/pcap"
 
 	// import layers to run its init function
 	_ "github.com/google/gopacket/layers"
@@ -33,24 +35,26 @@ func TestPacketParseSimple(t *testing.T) {
 
 	// Initialize objects later used by handlePacket
 	stats = *NewStats()
-	apiClient := NewAPIClient("", "", "", 1, false)
-	assetCSVWriter, err := NewAssetCSVWriter("")
-	if err != nil {
-		panic(err)
-	}
+	inventory := NewInventory(0)
 
 	// Read a pcap file
-	handle, err := pcap.OpenOffline("testdata/HL7-ADT-UDI-PRT.pcap")
+	handle, closeHandle, err := openOffline("testdata/HL7-ADT-UDI-PRT.pcap", "")
 	if err != nil {
 		panic(err)
 	}
+	defer closeHandle()
 	packetSource := gopacket.NewPacketSource(handle, handle.LinkType())
 
 	// Handle each packet from the pcap file
 	var numPackets uint64
+	var firstTime, lastTime time.Time
 	for packet := range packetSource.Packets() {
-		handlePacket(packet, testDecoders, apiClient, assetCSVWriter, nil)
+		handlePacket(packet, testDecoders, nil, inventory)
 		numPackets++
+		if firstTime.IsZero() {
+			firstTime = packet.Metadata().Timestamp
+		}
+		lastTime = packet.Metadata().Timestamp
 	}
 
 	// Check stats
@@ -60,6 +64,16 @@ func TestPacketParseSimple(t *testing.T) {
 	if nPkts := stats.TotalPacketCount; nPkts != numPackets {
 		t.Errorf("Wrong total packet count: %d (wanted %d)", nPkts, numPackets)
 	}
+	// The sender, and the receiver that acknowledged its message
+	if n := inventory.Len(); n != 2 {
+		t.Fatalf("Wrong inventory size: %d (wanted %d)", n, 2)
+	}
+
+	// Times come from the capture, not the clock.
+	record := inventory.Assets()[0]
+	if record.LastSeen.Before(firstTime) || record.LastSeen.After(lastTime) {
+		t.Errorf("Last seen time %v is outside the capture (%v to %v)", record.LastSeen, firstTime, lastTime)
+	}
 
 }
 
@@ -68,7 +82,7 @@ func TestSkipEmptyPacket(t *testing.T) {
 	var data []byte
 	pkt := gopacket.NewPacket(data, layers.LayerTypeEthernet, gopacket.Default)
 	stats = *NewStats()
-	handlePacket(pkt, testDecoders, nil, nil, nil)
+	handlePacket(pkt, testDecoders, nil, nil)
 
 	if stats.TotalPacketCount != 1 {
 		t.Errorf("Wrong number of packets")
@@ -85,6 +99,186 @@ func BenchmarkSkipEmptyPacket(b *testing.B) {
 	pkt := gopacket.NewPacket(data, layers.LayerTypeEthernet, gopacket.Default)
 	stats = *NewStats()
 	for i := 0; i < b.N; i++ {
-		handlePacket(pkt, testDecoders, nil, nil, nil)
+		handlePacket(pkt, testDecoders, nil, nil)
+	}
+}
+
+// serializeIPv4TCP serializes an IPv4 TCP SYN from the test client, preceded by
+// the given link-layer headers.
+func serializeIPv4TCP(linkLayers ...gopacket.SerializableLayer) []byte {
+	ip4 := &layers.IPv4{
+		Version:  4,
+		TTL:      64,
+		Protocol: layers.IPProtocolTCP,
+		SrcIP:    testClientIP,
+		DstIP:    testServerIP,
+	}
+	tcp := &layers.TCP{SrcPort: testClientPort, DstPort: testServerPort, SYN: true}
+	tcp.SetNetworkLayerForChecksum(ip4)
+	buf := gopacket.NewSerializeBuffer()
+	opts := gopacket.SerializeOptions{FixLengths: true, ComputeChecksums: true}
+	all := append(linkLayers, ip4, tcp)
+	if err := gopacket.SerializeLayers(buf, opts, all...); err != nil {
+		panic(err)
+	}
+	return buf.Bytes()
+}
+
+func TestDecodeLayersLinkTypes(t *testing.T) {
+	setupLogging(false)
+	stats = *NewStats()
+
+	// Linux "cooked" capture header: incoming, ARPHRD_ETHER, 6-byte address
+	sll := append([]byte{0, 0, 0, 1, 0, 6}, testClientMAC...)
+	sll = append(sll, 0, 0, 0x08, 0x00)
+
+	cases := []struct {
+		name     string
+		data     []byte
+		linkType layers.LinkType
+		mac      string
+	}{
+		{"SLL", append(sll, serializeIPv4TCP()...), layers.LinkTypeLinuxSLL, testClientMAC.String()},
+		{"raw IP", serializeIPv4TCP(), layers.LinkTypeRaw, ""},
+		{"loopback", serializeIPv4TCP(&layers.Loopback{Family: layers.ProtocolFamilyIPv4}), layers.LinkTypeNull, ""},
+	}
+	for _, c := range cases {
+		pkt := gopacket.NewPacket(c.data, c.linkType, gopacket.Default)
+		asset := &Asset{}
+		decodeLayers(pkt, asset)
+		if asset.IPv4Address != testClientIP.String() {
+			t.Errorf("%s: wrong IPv4 address '%s'", c.name, asset.IPv4Address)
+		}
+		if asset.ConnectsToPort != testServerPort.String() {
+			t.Errorf("%s: wrong port '%s'", c.name, asset.ConnectsToPort)
+		}
+		if asset.MACAddress != c.mac {
+			t.Errorf("%s: wrong MAC address '%s'", c.name, asset.MACAddress)
+		}
+	}
+}
+
+func TestDecodeLayersVLAN(t *testing.T) {
+	setupLogging(false)
+	stats = *NewStats()
+	eth := &layers.Ethernet{
+		SrcMAC:       testClientMAC,
+		DstMAC:       testServerMAC,
+		EthernetType: layers.EthernetTypeQinQ,
+	}
+	outer := &layers.Dot1Q{VLANIdentifier: 100, Type: layers.EthernetTypeDot1Q}
+	inner := &layers.Dot1Q{VLANIdentifier: 10, Type: layers.EthernetTypeIPv4}
+	pkt := gopacket.NewPacket(serializeIPv4TCP(eth, outer, inner), layers.LinkTypeEthernet, gopacket.Default)
+
+	asset := &Asset{}
+	decodeLayers(pkt, asset)
+	if asset.VLANID != "10" || asset.OuterVLANID != "100" {
+		t.Errorf("Wrong VLAN IDs '%s' (outer '%s')", asset.VLANID, asset.OuterVLANID)
+	}
+	if asset.IPv4Address != testClientIP.String() {
+		t.Errorf("Wrong IPv4 address '%s'", asset.IPv4Address)
+	}
+}
+
+// buildUDPPacket serializes one UDP datagram from the test client.
+func buildUDPPacket(srcPort, dstPort layers.UDPPort, payload string) gopacket.Packet {
+	eth := &layers.Ethernet{
+		SrcMAC:       testClientMAC,
+		DstMAC:       testServerMAC,
+		EthernetType: layers.EthernetTypeIPv4,
+	}
+	ip4 := &layers.IPv4{
+		Version:  4,
+		TTL:      64,
+		Protocol: layers.IPProtocolUDP,
+		SrcIP:    testClientIP,
+		DstIP:    testServerIP,
+	}
+	udp := &layers.UDP{SrcPort: srcPort, DstPort: dstPort}
+	udp.SetNetworkLayerForChecksum(ip4)
+	buf := gopacket.NewSerializeBuffer()
+	opts := gopacket.SerializeOptions{FixLengths: true, ComputeChecksums: true}
+	if err := gopacket.SerializeLayers(buf, opts, eth, ip4, udp, gopacket.Payload(payload)); err != nil {
+		panic(err)
+	}
+	return gopacket.NewPacket(buf.Bytes(), layers.LayerTypeEthernet, gopacket.Default)
+}
+
+// helloDecoder is a test decoder that identifies devices saying "HELLO <name>"
+// over UDP.
+type helloDecoder struct{}
+
+func (decoder *helloDecoder) Name() string      { return "Hello" }
+func (decoder *helloDecoder) String() string    { return decoder.Name() }
+func (decoder *helloDecoder) Initialize() error { return nil }
+func (decoder *helloDecoder) DecodesUDP() bool  { return true }
+func (decoder *helloDecoder) DecodePayload(app *gopacket.ApplicationLayer) (*Observation, error) {
+	payload := string((*app).Payload())
+	if !strings.HasPrefix(payload, "HELLO ") {
+		return nil, fmt.Errorf("Not a greeting")
+	}
+	obs := NewObservation()
+	obs.Add(AttrHostname, strings.TrimPrefix(payload, "HELLO "), "Hello", 0.5)
+	return obs, nil
+}
+
+func TestDecodeLayersUDPPorts(t *testing.T) {
+	setupLogging(false)
+	stats = *NewStats()
+
+	asset := &Asset{}
+	decodeLayers(buildUDPPacket(50000, 161, ""), asset)
+	if asset.ConnectsToPortUDP != layers.UDPPort(161).String() || asset.ListensOnPortUDP != "" {
+		t.Errorf("Wrong UDP ports for client: '%s' '%s'", asset.ConnectsToPortUDP, asset.ListensOnPortUDP)
+	}
+
+	asset = &Asset{}
+	decodeLayers(buildUDPPacket(161, 50000, ""), asset)
+	if asset.ListensOnPortUDP != layers.UDPPort(161).String() || asset.ConnectsToPortUDP != "" {
+		t.Errorf("Wrong UDP ports for server: '%s' '%s'", asset.ListensOnPortUDP, asset.ConnectsToPortUDP)
+	}
+	if asset.ListensOnPort != "" || asset.ConnectsToPort != "" {
+		t.Errorf("UDP ports recorded as TCP ports")
+	}
+}
+
+func TestUDPDecoderDispatch(t *testing.T) {
+	setupLogging(false)
+	stats = *NewStats()
+	decoders := append([]PayloadDecoder{&helloDecoder{}}, testDecoders...)
+	inventory := NewInventory(0)
+
+	handlePacket(buildUDPPacket(40000, 40001, "HELLO pump-7"), decoders, nil, inventory)
+	if n := inventory.Len(); n != 1 {
+		t.Fatalf("Expected 1 asset, got %d", n)
+	}
+	if record := inventory.Assets()[0]; record.Identifier != "pump-7" {
+		t.Errorf("Wrong identifier '%s'", record.Identifier)
+	}
+
+	// TCP-only decoders never see UDP payloads.
+	handlePacket(buildUDPPacket(40000, 2575, okHL7Header), testDecoders, nil, inventory)
+	if stats.PacketLayers["Application/HL7"] != 0 {
+		t.Errorf("UDP payload was given to the HL7 decoder")
+	}
+}
+
+func TestUndecodedUDP(t *testing.T) {
+	setupLogging(false)
+	stats = *NewStats()
+	inventory := NewInventory(0)
+
+	// Nothing decodes SNMP, but the device's use of it is still recorded.
+	handlePacket(buildUDPPacket(50000, 161, "not decoded"), testDecoders, nil, inventory)
+	handlePacket(buildUDPPacket(50001, 162, ""), testDecoders, nil, inventory)
+	if n := inventory.Len(); n != 1 {
+		t.Fatalf("Expected 1 asset, got %d", n)
+	}
+	record := inventory.Assets()[0]
+	if strings.Join(record.ConnectsToPortsUDP, ";") != "161(snmp);162(snmptrap)" {
+		t.Errorf("Wrong UDP ports %v", record.ConnectsToPortsUDP)
+	}
+	if len(stats.Errors) != 0 {
+		t.Errorf("Undecoded UDP counted as errors: %v", stats.Errors)
 	}
 }
@@ -0,0 +1,324 @@
+// Copyright 2019 Virta Laboratories, Inc.  All rights reserved.
+/*
+Reading pcapng captures.
+
+Wireshark and dumpcap write pcapng, which describes each capturing interface
+(its name, link type and timestamp resolution) and lets analysts attach
+comments to packets.  gopacket's reader throws packet comments away, so we read
+pcapng ourselves.  Each packet carries the name of its interface and its
+comment, if any, as ancillary capture data, and a capture made on interfaces
+of different link types is decoded according to each packet's interface.
+*/
+
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/binary"
+	"fmt"
+	"io"
+	"math/bits"
+	"strings"
+	"time"
+
+	"github.com/google/gopacket"
+	"github.com/google/gopacket/layers"
+)
+
+// pcapng block types
+const (
+	pcapngSectionHeader       = 0x0a0d0d0a
+	pcapngInterfaceDescriptor = 1
+	pcapngObsoletePacket      = 2
+	pcapngSimplePacket        = 3
+	pcapngEnhancedPacket      = 6
+)
+
+// pcapng option codes
+const (
+	pcapngOptEnd         = 0
+	pcapngOptComment     = 1
+	pcapngOptIfName      = 2
+	pcapngOptIfDesc      = 3
+	pcapngOptIfTSResol   = 9
+	pcapngOptIfTSOffset  = 14
+	pcapngByteOrderMagic = 0x1a2b3c4d
+
+	// Largest block we are willing to read, to survive corrupt files
+	pcapngMaxBlockLength = 16 * 1024 * 1024
+)
+
+// Every pcapng stream begins with a section header block.
+var pcapngMagic = []byte{0x0a, 0x0d, 0x0d, 0x0a}
+
+// A CaptureComment is a comment attached to a packet in a pcapng capture.
+type CaptureComment string
+
+// A pcapngInterface describes an interface on which packets were captured.
+type pcapngInterface struct {
+	name        string
+	description string
+	linkType    layers.LinkType
+	snaplen     uint32
+	unitsPerSec uint64 // timestamp resolution
+	offset      int64  // seconds added to every timestamp
+}
+
+// A pcapngReader reads packets from a pcapng stream.
+type pcapngReader struct {
+	r        *bufio.Reader
+	order    binary.ByteOrder
+	ifaces   []pcapngInterface
+	linkType layers.LinkType // of the first interface
+}
+
+// newPcapngReader reads a pcapng stream's section header and the description
+// of its first interface.  A capture that ends without describing any
+// interface simply has no packets.
+func newPcapngReader(r *bufio.Reader) (*pcapngReader, error) {
+	reader := &pcapngReader{r: r, linkType: layers.LinkTypeEthernet}
+	for len(reader.ifaces) == 0 {
+		typ, body, err := reader.readBlock()
+		if err == io.EOF && reader.order != nil {
+			break
+		}
+		if err != nil {
+			return nil, err
+		}
+		switch typ {
+		case pcapngInterfaceDescriptor:
+			if err := reader.addInterface(body); err != nil {
+				return nil, err
+			}
+		case pcapngObsoletePacket, pcapngSimplePacket, pcapngEnhancedPacket:
+			return nil, fmt.Errorf("Pcapng packet before any interface description")
+		}
+	}
+	if len(reader.ifaces) > 0 {
+		reader.linkType = reader.ifaces[0].linkType
+	}
+	return reader, nil
+}
+
+// LinkType returns the link type of the first interface.
+func (r *pcapngReader) LinkType() layers.LinkType {
+	return r.linkType
+}
+
+// readBlock reads the next block, returning its type and its body without the
+// block's header and trailer.  A section header sets the byte order of the
+// blocks that follow it and forgets the interfaces of the previous section.
+func (r *pcapngReader) readBlock() (uint32, []byte, error) {
+	var header [12]byte
+	if _, err := io.ReadFull(r.r, header[:8]); err != nil {
+		return 0, nil, err
+	}
+	if bytes.Equal(header[:4], pcapngMagic) {
+		if _, err := io.ReadFull(r.r, header[8:12]); err != nil {
+			return 0, nil, noEOF(err)
+		}
+		switch {
+		case binary.BigEndian.Uint32(header[8:12]) == pcapngByteOrderMagic:
+			r.order = binary.BigEndian
+		case binary.LittleEndian.Uint32(header[8:12]) == pcapngByteOrderMagic:
+			r.order = binary.LittleEndian
+		default:
+			return 0, nil, fmt.Errorf("Bad pcapng byte-order magic")
+		}
+		r.ifaces = nil
+	} else if r.order == nil {
+		return 0, nil, fmt.Errorf("Pcapng stream does not begin with a section header")
+	}
+
+	typ := r.order.Uint32(header[:4])
+	length := r.order.Uint32(header[4:8])
+	consumed := uint32(8)
+	if typ == pcapngSectionHeader {
+		consumed = 12
+	}
+	if length < consumed+4 || length%4 != 0 || length > pcapngMaxBlockLength {
+		return 0, nil, fmt.Errorf("Bad pcapng block length %d", length)
+	}
+	body := make([]byte, length-consumed)
+	if _, err := io.ReadFull(r.r, body); err != nil {
+		return 0, nil, noEOF(err)
+	}
+	if typ == pcapngSectionHeader && (len(body) < 6 || r.order.Uint16(body[:2]) != 1) {
+		return 0, nil, fmt.Errorf("Unsupported pcapng version")
+	}
+	return typ, body[:len(body)-4], nil
+}
+
+// noEOF turns the end of a stream in the middle of a block into an error.
+func noEOF(err error) error {
+	if err == io.EOF {
+		return io.ErrUnexpectedEOF
+	}
+	return err
+}
+
+// options calls a function for each option in a block's options.
+func (r *pcapngReader) options(data []byte, fn func(code uint16, value []byte)) {
+	for len(data) >= 4 {
+		code := r.order.Uint16(data[:2])
+		length := int(r.order.Uint16(data[2:4]))
+		data = data[4:]
+		if code == pcapngOptEnd || length > len(data) {
+			return
+		}
+		fn(code, data[:length])
+		if padded := (length + 3) &^ 3; padded < len(data) {
+			data = data[padded:]
+		} else {
+			data = nil
+		}
+	}
+}
+
+// addInterface records an interface description block.
+func (r *pcapngReader) addInterface(body []byte) error {
+	if len(body) < 8 {
+		return fmt.Errorf("Short pcapng interface description")
+	}
+	iface := pcapngInterface{
+		linkType:    layers.LinkType(r.order.Uint16(body[:2])),
+		snaplen:     r.order.Uint32(body[4:8]),
+		unitsPerSec: 1000000,
+	}
+	r.options(body[8:], func(code uint16, value []byte) {
+		switch code {
+		case pcapngOptIfName:
+			iface.name = string(value)
+		case pcapngOptIfDesc:
+			iface.description = string(value)
+		case pcapngOptIfTSResol:
+			if len(value) < 1 {
+				return
+			}
+			exponent := uint(value[0] & 0x7f)
+			if value[0]&0x80 != 0 && exponent < 64 {
+				iface.unitsPerSec = 1 << exponent
+			} else if value[0]&0x80 == 0 && exponent < 20 {
+				iface.unitsPerSec = 1
+				for i := uint(0); i < exponent; i++ {
+					iface.unitsPerSec *= 10
+				}
+			}
+		case pcapngOptIfTSOffset:
+			if len(value) == 8 {
+				iface.offset = int64(r.order.Uint64(value))
+			}
+		}
+	})
+	logger.Printf("pcapng interface %d: %q (%s), link type %s, %d timestamp units per second\n",
+		len(r.ifaces), iface.name, iface.description, iface.linkType, iface.unitsPerSec)
+	r.ifaces = append(r.ifaces, iface)
+	return nil
+}
+
+// timestamp converts a timestamp in an interface's units to a time.
+func (iface *pcapngInterface) timestamp(ts uint64) time.Time {
+	secs := ts / iface.unitsPerSec
+	hi, lo := bits.Mul64(ts%iface.unitsPerSec, uint64(time.Second))
+	nanos, _ := bits.Div64(hi, lo, iface.unitsPerSec)
+	return time.Unix(int64(secs)+iface.offset, int64(nanos)).UTC()
+}
+
+// ReadPacketData returns the next packet, skipping blocks that do not hold
+// packets.  The packet's ancillary data includes its link type, the name of
+// its interface and its comment if it has them.
+func (r *pcapngReader) ReadPacketData() ([]byte, gopacket.CaptureInfo, error) {
+	for {
+		typ, body, err := r.readBlock()
+		if err != nil {
+			return nil, gopacket.CaptureInfo{}, err
+		}
+		switch typ {
+		case pcapngInterfaceDescriptor:
+			if err := r.addInterface(body); err != nil {
+				return nil, gopacket.CaptureInfo{}, err
+			}
+		case pcapngEnhancedPacket, pcapngObsoletePacket:
+			if len(body) < 20 {
+				return nil, gopacket.CaptureInfo{}, fmt.Errorf("Short pcapng packet block")
+			}
+			index := int(r.order.Uint32(body[:4]))
+			if typ == pcapngObsoletePacket {
+				index = int(r.order.Uint16(body[:2]))
+			}
+			ts := uint64(r.order.Uint32(body[4:8]))<<32 | uint64(r.order.Uint32(body[8:12]))
+			ci := gopacket.CaptureInfo{
+				CaptureLength:  int(r.order.Uint32(body[12:16])),
+				Length:         int(r.order.Uint32(body[16:20])),
+				InterfaceIndex: index,
+			}
+			return r.packet(body[20:], ci, &ts)
+		case pcapngSimplePacket:
+			if len(body) < 4 {
+				return nil, gopacket.CaptureInfo{}, fmt.Errorf("Short pcapng packet block")
+			}
+			if len(r.ifaces) == 0 {
+				return nil, gopacket.CaptureInfo{}, fmt.Errorf("Pcapng packet from undescribed interface 0")
+			}
+			ci := gopacket.CaptureInfo{
+				CaptureLength: len(body) - 4,
+				Length:        int(r.order.Uint32(body[:4])),
+			}
+			if ci.Length < ci.CaptureLength {
+				ci.CaptureLength = ci.Length
+			}
+			if snaplen := int(r.ifaces[0].snaplen); snaplen > 0 && snaplen < ci.CaptureLength {
+				ci.CaptureLength = snaplen
+			}
+			return r.packet(body[4:], ci, nil)
+		}
+	}
+}
+
+// packet finishes reading a packet block, whose body begins with the packet
+// data and continues with options.  Simple packet blocks have no timestamp.
+func (r *pcapngReader) packet(body []byte, ci gopacket.CaptureInfo, ts *uint64) ([]byte, gopacket.CaptureInfo, error) {
+	if ci.InterfaceIndex >= len(r.ifaces) {
+		return nil, ci, fmt.Errorf("Pcapng packet from undescribed interface %d", ci.InterfaceIndex)
+	}
+	if ci.CaptureLength > len(body) {
+		return nil, ci, fmt.Errorf("Pcapng packet longer than its block")
+	}
+	iface := &r.ifaces[ci.InterfaceIndex]
+	if ts != nil {
+		ci.Timestamp = iface.timestamp(*ts)
+	}
+	data := body[:ci.CaptureLength]
+
+	ci.AncillaryData = []interface{}{iface.linkType}
+	if name := iface.name; name != "" || iface.description != "" {
+		if name == "" {
+			name = iface.description
+		}
+		ci.AncillaryData = append(ci.AncillaryData, CaptureInterface(name))
+	}
+	var comments []string
+	if options := (len(data) + 3) &^ 3; options < len(body) {
+		r.options(body[options:], func(code uint16, value []byte) {
+			if code == pcapngOptComment {
+				comments = append(comments, string(value))
+			}
+		})
+	}
+	if len(comments) > 0 {
+		ci.AncillaryData = append(ci.AncillaryData, CaptureComment(strings.Join(comments, "; ")))
+	}
+	return data, ci, nil
+}
+
+// packetComment returns the comment attached to a packet in a pcapng capture,
+// or "" if there is none.
+func packetComment(packet gopacket.Packet) string {
+	for _, data := range packet.Metadata().AncillaryData {
+		if comment, ok := data.(CaptureComment); ok {
+			return string(comment)
+		}
+	}
+	return ""
+}
@@ -0,0 +1,173 @@
+/*
+Unit tests for reading pcapng captures.
+*/
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/binary"
+	"io"
+	"testing"
+	"time"
+
+	"github.com/google/gopacket"
+	"github.com/google/gopacket/layers"
+)
+
+// pcapngOption encodes a pcapng option, padded to a multiple of four bytes.
+func pcapngOption(code uint16, value []byte) []byte {
+	option := make([]byte, 4, 4+len(value)+3)
+	binary.LittleEndian.PutUint16(option[:2], code)
+	binary.LittleEndian.PutUint16(option[2:4], uint16(len(value)))
+	option = append(option, value...)
+	for len(option)%4 != 0 {
+		option = append(option, 0)
+	}
+	return option
+}
+
+// pcapngBlock encodes a little-endian pcapng block.
+func pcapngBlock(typ uint32, body ...[]byte) []byte {
+	data := bytes.Join(body, nil)
+	for len(data)%4 != 0 {
+		data = append(data, 0)
+	}
+	length := uint32(len(data) + 12)
+	block := make([]byte, 8, length)
+	binary.LittleEndian.PutUint32(block[:4], typ)
+	binary.LittleEndian.PutUint32(block[4:8], length)
+	block = append(block, data...)
+	return append(block, block[4:8]...)
+}
+
+// pcapngInterfaceBlock encodes an interface description block.
+func pcapngInterfaceBlock(linkType layers.LinkType, name string, tsresol byte) []byte {
+	fixed := make([]byte, 8)
+	binary.LittleEndian.PutUint16(fixed[:2], uint16(linkType))
+	return pcapngBlock(pcapngInterfaceDescriptor, fixed,
+		pcapngOption(pcapngOptIfName, []byte(name)),
+		pcapngOption(pcapngOptIfTSResol, []byte{tsresol}),
+		pcapngOption(pcapngOptEnd, nil))
+}
+
+// pcapngPacketBlock encodes an enhanced packet block with optional comments.
+func pcapngPacketBlock(iface uint32, ts uint64, data []byte, comments ...string) []byte {
+	fixed := make([]byte, 20)
+	binary.LittleEndian.PutUint32(fixed[:4], iface)
+	binary.LittleEndian.PutUint32(fixed[4:8], uint32(ts>>32))
+	binary.LittleEndian.PutUint32(fixed[8:12], uint32(ts))
+	binary.LittleEndian.PutUint32(fixed[12:16], uint32(len(data)))
+	binary.LittleEndian.PutUint32(fixed[16:20], uint32(len(data)))
+	padded := append([]byte(nil), data...)
+	for len(padded)%4 != 0 {
+		padded = append(padded, 0)
+	}
+	body := [][]byte{fixed, padded}
+	for _, comment := range comments {
+		body = append(body, pcapngOption(pcapngOptComment, []byte(comment)))
+	}
+	if len(comments) > 0 {
+		body = append(body, pcapngOption(pcapngOptEnd, nil))
+	}
+	return pcapngBlock(pcapngEnhancedPacket, body...)
+}
+
+// mixedCapture returns a pcapng capture made on an Ethernet interface, "eth1",
+// with nanosecond timestamps, and a raw IP interface, "tun0", with microsecond
+// timestamps.  Each saw one greeting; the Ethernet frame has a comment.
+func mixedCapture() []byte {
+	frame := buildUDPPacket(40000, 40001, "HELLO pump-7").Data()
+	shb := make([]byte, 16)
+	binary.LittleEndian.PutUint32(shb[:4], pcapngByteOrderMagic)
+	binary.LittleEndian.PutUint16(shb[4:6], 1)
+	binary.LittleEndian.PutUint64(shb[8:16], ^uint64(0))
+	return bytes.Join([][]byte{
+		pcapngBlock(pcapngSectionHeader, shb),
+		pcapngInterfaceBlock(layers.LinkTypeEthernet, "eth1", 9),
+		pcapngInterfaceBlock(layers.LinkTypeRaw, "tun0", 6),
+		pcapngPacketBlock(0, 1546300800*1000000000+123, frame, "Pump on bed 4", "checked"),
+		pcapngBlock(5, make([]byte, 12)), // interface statistics, skipped
+		pcapngPacketBlock(1, 1546300801*1000000+5, frame[14:]),
+	}, nil)
+}
+
+func TestPcapngInterfacesAndComments(t *testing.T) {
+	setupLogging(false)
+	reader, err := newPacketStreamReader(bytes.NewReader(mixedCapture()))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if reader.LinkType() != layers.LinkTypeEthernet {
+		t.Errorf("Wrong link type %s", reader.LinkType())
+	}
+	source := &packetSource{reader}
+
+	first, err := source.NextPacket()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if packetInterface(first) != "eth1" || packetComment(first) != "Pump on bed 4; checked" {
+		t.Errorf("Wrong interface %q or comment %q", packetInterface(first), packetComment(first))
+	}
+	if ts := first.Metadata().Timestamp; !ts.Equal(time.Unix(1546300800, 123)) {
+		t.Errorf("Wrong nanosecond timestamp %v", ts)
+	}
+
+	second, err := source.NextPacket()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if packetInterface(second) != "tun0" || packetComment(second) != "" {
+		t.Errorf("Wrong interface %q or comment %q", packetInterface(second), packetComment(second))
+	}
+	if ts := second.Metadata().Timestamp; !ts.Equal(time.Unix(1546300801, 5000)) {
+		t.Errorf("Wrong microsecond timestamp %v", ts)
+	}
+	if second.Layer(layers.LayerTypeIPv4) == nil || second.Layer(layers.LayerTypeEthernet) != nil {
+		t.Errorf("Raw IP packet decoded as %v", second.Layers())
+	}
+
+	if _, err := source.NextPacket(); err != io.EOF {
+		t.Errorf("Expected end of capture, got %v", err)
+	}
+}
+
+func TestPcapngEvidence(t *testing.T) {
+	setupLogging(false)
+	stats = *NewStats()
+	c := make(chan gopacket.Packet, 2)
+	if _, err := readPacketStream(bytes.NewReader(mixedCapture()), "udp", c); err != io.EOF {
+		t.Fatal(err)
+	}
+	close(c)
+
+	inventory := NewInventory(0)
+	for packet := range c {
+		handlePacket(packet, []PayloadDecoder{&helloDecoder{}}, nil, inventory)
+	}
+	found := false
+	for _, asset := range inventory.Assets() {
+		if asset.CaptureComment == "Pump on bed 4; checked" && len(asset.Interfaces) > 0 && asset.Interfaces[0] == "eth1" {
+			found = true
+		}
+	}
+	if !found {
+		t.Errorf("Interface and comment not recorded: %+v", inventory.Assets())
+	}
+}
+
+func TestPcapngTruncated(t *testing.T) {
+	setupLogging(false)
+	capture := mixedCapture()
+	reader, err := newPcapngReader(bufio.NewReader(bytes.NewReader(capture[:len(capture)-10])))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, _, err := reader.ReadPacketData(); err != nil {
+		t.Fatal(err)
+	}
+	if _, _, err := reader.ReadPacketData(); err != io.ErrUnexpectedEOF {
+		t.Errorf("Expected truncated capture, got %v", err)
+	}
+}
@@ -0,0 +1,342 @@
+// Copyright 2019 Virta Laboratories, Inc.  All rights reserved.
+/*
+TCP stream reassembly.
+
+Application-layer messages such as HL7 ORU^R01 batches or DICOM associate
+requests often span several TCP segments.  Rather than hand each segment to the
+payload decoders, TCP packets are fed to a gopacket reassembly.Assembler, which
+puts segments back in order, and each direction of each connection accumulates
+bytes until a stream decoder reports that it holds a complete message.
+
+Memory use is bounded in three ways: the assembler buffers a limited number of
+pages while waiting for out-of-order segments, each direction of a connection
+buffers at most maxStreamBufferSize bytes while waiting for the end of a
+message, and connections that go quiet are flushed and forgotten after a
+timeout.
+
+Docs:
+https://godoc.org/github.com/google/gopacket/reassembly
+*/
+
+package main
+
+import (
+	"fmt"
+	"sync"
+	"time"
+
+	"github.com/google/gopacket"
+	"github.com/google/gopacket/layers"
+	"github.com/google/gopacket/reassembly"
+)
+
+const (
+	// Upper limit on bytes buffered for one direction of a connection while
+	// waiting for the end of a message.  Longer messages are skipped.
+	maxStreamBufferSize = 1 << 20
+
+	// Upper limits on 4 KiB pages held by the assembler while waiting for
+	// out-of-order segments.
+	maxBufferedPagesTotal         = 16384
+	maxBufferedPagesPerConnection = 256
+
+	// How often (in capture time) to look for idle connections
+	streamFlushInterval = 10 * time.Second
+)
+
+// assemblerContext carries per-packet information through the assembler so
+// that streams can attribute reassembled messages to the sending endpoint.
+type assemblerContext struct {
+	captureInfo gopacket.CaptureInfo
+	asset       Asset
+}
+
+// GetCaptureInfo implements reassembly.AssemblerContext.
+func (ctx *assemblerContext) GetCaptureInfo() gopacket.CaptureInfo {
+	return ctx.captureInfo
+}
+
+// TCPReassembler reassembles TCP streams and runs stream decoders against
+// complete application-layer messages.
+type TCPReassembler struct {
+	sync.Mutex
+	assembler *reassembly.Assembler
+	factory   *tcpStreamFactory
+	report    func(*Asset)
+	timeout   time.Duration
+	lastFlush time.Time
+}
+
+// NewTCPReassembler creates a TCPReassembler that hands complete messages to
+// decoders and passes each resulting Asset to report.  Connections idle for
+// longer than timeout are flushed.
+func NewTCPReassembler(
+	decoders []PayloadDecoder,
+	timeout time.Duration,
+	report func(*Asset),
+) *TCPReassembler {
+	factory := new(tcpStreamFactory)
+	for _, decoder := range decoders {
+		if streamDecoder, ok := decoder.(StreamDecoder); ok {
+			factory.decoders = append(factory.decoders, streamDecoder)
+		}
+	}
+
+	r := new(TCPReassembler)
+	r.assembler = reassembly.NewAssembler(reassembly.NewStreamPool(factory))
+	r.factory = factory
+	r.report = report
+	r.assembler.MaxBufferedPagesTotal = maxBufferedPagesTotal
+	r.assembler.MaxBufferedPagesPerConnection = maxBufferedPagesPerConnection
+	r.timeout = timeout
+	return r
+}
+
+// Assemble adds a TCP packet to its stream.  The Asset carries whatever the
+// lower layers revealed about the packet's sender.
+func (r *TCPReassembler) Assemble(packet gopacket.Packet, tcp *layers.TCP, asset *Asset) {
+	netLayer := packet.NetworkLayer()
+	if netLayer == nil {
+		return
+	}
+	ctx := &assemblerContext{
+		captureInfo: packet.Metadata().CaptureInfo,
+		asset:       *asset,
+	}
+
+	r.Lock()
+	r.assembler.AssembleWithContext(netLayer.NetworkFlow(), tcp, ctx)
+	r.flushIdle(ctx.captureInfo.Timestamp)
+	decoded := r.factory.takeDecoded()
+	r.Unlock()
+	r.reportAll(decoded)
+}
+
+// reportAll reports decoded Assets.  Reporting may be slow (it may upload to
+// an API), so it is done outside of the lock, leaving other workers free to
+// assemble their packets.
+func (r *TCPReassembler) reportAll(decoded []*Asset) {
+	for _, asset := range decoded {
+		r.report(asset)
+	}
+}
+
+// flushIdle closes connections that have been idle for longer than the
+// timeout.  Time is measured by capture timestamps so that prerecorded traffic
+// is handled the same way as live traffic.
+func (r *TCPReassembler) flushIdle(now time.Time) {
+	if now.Sub(r.lastFlush) < streamFlushInterval {
+		return
+	}
+	r.lastFlush = now
+	cutoff := now.Add(-r.timeout)
+	flushed, closed := r.assembler.FlushWithOptions(reassembly.FlushOptions{T: cutoff, TC: cutoff})
+	if flushed > 0 || closed > 0 {
+		logger.Printf("Flushed %d and closed %d idle TCP streams\n", flushed, closed)
+	}
+}
+
+// FlushAll delivers any data still buffered and closes every stream.
+func (r *TCPReassembler) FlushAll() {
+	r.Lock()
+	closed := r.assembler.FlushAll()
+	logger.Printf("Closed %d TCP streams\n", closed)
+	decoded := r.factory.takeDecoded()
+	r.Unlock()
+	r.reportAll(decoded)
+}
+
+// tcpStreamFactory creates a tcpStream for each new TCP connection.  Its
+// streams collect the Assets they decode until the TCPReassembler takes them.
+type tcpStreamFactory struct {
+	decoders []StreamDecoder
+	decoded  []*Asset
+}
+
+// takeDecoded returns the Assets decoded since it was last called.
+func (f *tcpStreamFactory) takeDecoded() []*Asset {
+	decoded := f.decoded
+	f.decoded = nil
+	return decoded
+}
+
+// New implements reassembly.StreamFactory.
+func (f *tcpStreamFactory) New(
+	netFlow, tcpFlow gopacket.Flow,
+	tcp *layers.TCP,
+	ac reassembly.AssemblerContext,
+) reassembly.Stream {
+	stats.AddLayer("TCP/stream")
+	logger.Printf("New TCP stream %v %v\n", netFlow, tcpFlow)
+	return &tcpStream{factory: f}
+}
+
+// halfStream holds the state of one direction of a TCP connection.
+type halfStream struct {
+	buf     []byte
+	skip    int           // bytes of an oversized message still to be discarded
+	decoder StreamDecoder // decoder that recognized this direction, if any
+	sender  Asset         // what lower layers revealed about the sender
+
+	// Ports revealed by the sender's part in the handshake, which carries no
+	// messages of its own
+	listensOnPort  string
+	connectsToPort string
+}
+
+// tcpStream implements reassembly.Stream for one TCP connection.
+type tcpStream struct {
+	factory *tcpStreamFactory
+	halves  [2]halfStream // indexed by reassembly.TCPFlowDirection
+}
+
+func (s *tcpStream) half(dir reassembly.TCPFlowDirection) *halfStream {
+	if dir == reassembly.TCPDirClientToServer {
+		return &s.halves[0]
+	}
+	return &s.halves[1]
+}
+
+// Accept implements reassembly.Stream.  Every segment is accepted, and streams
+// whose handshake was not captured are picked up mid-connection.  The ports
+// revealed by the handshake are remembered for the messages that follow.
+func (s *tcpStream) Accept(
+	tcp *layers.TCP,
+	ci gopacket.CaptureInfo,
+	dir reassembly.TCPFlowDirection,
+	nextSeq reassembly.Sequence,
+	start *bool,
+	ac reassembly.AssemblerContext,
+) bool {
+	*start = true
+	if ctx, ok := ac.(*assemblerContext); ok {
+		half := s.half(dir)
+		if port := ctx.asset.ListensOnPort; port != "" {
+			half.listensOnPort = port
+		}
+		if port := ctx.asset.ConnectsToPort; port != "" {
+			half.connectsToPort = port
+		}
+	}
+	return true
+}
+
+// ReassembledSG implements reassembly.Stream.  It appends in-order data to the
+// buffer for its direction and decodes any complete messages.
+func (s *tcpStream) ReassembledSG(sg reassembly.ScatterGather, ac reassembly.AssemblerContext) {
+	dir, _, _, skip := sg.Info()
+	half := s.half(dir)
+	if ctx, ok := ac.(*assemblerContext); ok {
+		half.sender = ctx.asset
+		half.sender.ListensOnPort = half.listensOnPort
+		half.sender.ConnectsToPort = half.connectsToPort
+	}
+
+	if skip != 0 {
+		// Bytes were lost, so whatever we had buffered cannot be completed.
+		stats.AddError(fmt.Errorf("TCP stream missing bytes"))
+		half.reset()
+	}
+
+	length, _ := sg.Lengths()
+	if length == 0 {
+		return
+	}
+	data := sg.Fetch(length)
+	if half.skip > 0 {
+		if len(data) <= half.skip {
+			half.skip -= len(data)
+			return
+		}
+		data = data[half.skip:]
+		half.skip = 0
+	}
+	half.buf = append(half.buf, data...)
+	s.drain(half, false)
+}
+
+// ReassemblyComplete implements reassembly.Stream.  Whatever remains buffered
+// is decoded as a final message.
+func (s *tcpStream) ReassemblyComplete(ac reassembly.AssemblerContext) bool {
+	for i := range s.halves {
+		s.drain(&s.halves[i], true)
+		s.halves[i].reset()
+	}
+	return true
+}
+
+// drain decodes every complete message at the front of a half stream's
+// buffer.  If final is set, no more data will arrive.
+func (s *tcpStream) drain(half *halfStream, final bool) {
+	for len(half.buf) > 0 {
+		if half.decoder == nil {
+			half.decoder = s.factory.detectDecoder(half.buf, final)
+			if half.decoder == nil {
+				// Nothing we understand; don't keep it around.
+				half.reset()
+				return
+			}
+		}
+
+		n, err := half.decoder.MessageLength(half.buf, final)
+		if err != nil {
+			logger.Printf("Lost %s message framing: %s\n", half.decoder.Name(), err)
+			half.reset()
+			return
+		}
+		if n == 0 {
+			// Need more data
+			if len(half.buf) > maxStreamBufferSize {
+				stats.AddError(fmt.Errorf("TCP stream message too large"))
+				half.reset()
+			}
+			return
+		}
+		if n > len(half.buf) {
+			if n > maxStreamBufferSize {
+				// Message is too long to be worth buffering; skip it.
+				half.skip = n - len(half.buf)
+				half.buf = nil
+				stats.AddError(fmt.Errorf("TCP stream message too large"))
+			}
+			return
+		}
+
+		s.decodeMessage(half, half.buf[:n])
+		half.buf = half.buf[n:]
+	}
+	half.buf = nil
+}
+
+// decodeMessage runs a half stream's decoder against one complete message and
+// collects the resulting Assets for reporting.
+func (s *tcpStream) decodeMessage(half *halfStream, message []byte) {
+	stats.AddLayer("Application")
+	assets, _ := decodeMessages(half.decoder, message, &half.sender)
+	if len(assets) == 0 {
+		stats.AddError(fmt.Errorf("failed to find a decoder, no identifier"))
+		return
+	}
+	for _, asset := range assets {
+		stats.AddAsset(asset)
+		s.factory.decoded = append(s.factory.decoded, asset)
+	}
+}
+
+// reset discards all buffered data and forgets the detected protocol.
+func (half *halfStream) reset() {
+	half.buf = nil
+	half.skip = 0
+	half.decoder = nil
+}
+
+// detectDecoder returns the first stream decoder that recognizes the start of
+// buf, or nil if none does.
+func (f *tcpStreamFactory) detectDecoder(buf []byte, final bool) StreamDecoder {
+	for _, decoder := range f.decoders {
+		if _, err := decoder.MessageLength(buf, final); err == nil {
+			return decoder
+		}
+	}
+	return nil
+}
@@ -0,0 +1,266 @@
+/*
+Unit tests for TCP stream reassembly.
+*/
+package main
+
+import (
+	"net"
+	"testing"
+	"time"
+
+	"github.com/google/gopacket"
+	"github.com/google/gopacket/layers"
+)
+
+var (
+	testClientMAC  = net.HardwareAddr{0x11, 0x22, 0x33, 0x44, 0x55, 0x66}
+	testServerMAC  = net.HardwareAddr{0x11, 0x22, 0x33, 0x44, 0x55, 0x67}
+	testClientIP   = net.IP{10, 0, 0, 1}
+	testServerIP   = net.IP{10, 0, 0, 2}
+	testClientPort = layers.TCPPort(49242)
+	testServerPort = layers.TCPPort(2575)
+	testStartTime  = time.Date(2019, 1, 1, 0, 0, 0, 0, time.UTC)
+)
+
+// buildTCPPacket serializes one client-to-server TCP segment with the given
+// sequence number and payload.
+func buildTCPPacket(seq uint32, payload string) gopacket.Packet {
+	return buildTCPPacketFrom(testClientMAC, testClientIP, testClientPort,
+		testServerMAC, testServerIP, testServerPort, seq, payload)
+}
+
+// buildTCPPacketFrom serializes one TCP segment between the given endpoints.
+func buildTCPPacketFrom(
+	srcMAC net.HardwareAddr, srcIP net.IP, srcPort layers.TCPPort,
+	dstMAC net.HardwareAddr, dstIP net.IP, dstPort layers.TCPPort,
+	seq uint32, payload string,
+) gopacket.Packet {
+	tcp := &layers.TCP{
+		SrcPort: srcPort,
+		DstPort: dstPort,
+		Seq:     seq,
+		ACK:     true,
+		PSH:     true,
+		Window:  65535,
+	}
+	return buildTCPSegment(srcMAC, srcIP, dstMAC, dstIP, tcp, payload)
+}
+
+// buildTCPSegment serializes a TCP segment between the given hosts.
+func buildTCPSegment(
+	srcMAC net.HardwareAddr, srcIP net.IP,
+	dstMAC net.HardwareAddr, dstIP net.IP,
+	tcp *layers.TCP, payload string,
+) gopacket.Packet {
+	eth := &layers.Ethernet{
+		SrcMAC:       srcMAC,
+		DstMAC:       dstMAC,
+		EthernetType: layers.EthernetTypeIPv4,
+	}
+	ip4 := &layers.IPv4{
+		Version:  4,
+		TTL:      64,
+		Protocol: layers.IPProtocolTCP,
+		SrcIP:    srcIP,
+		DstIP:    dstIP,
+	}
+	tcp.SetNetworkLayerForChecksum(ip4)
+
+	buf := gopacket.NewSerializeBuffer()
+	opts := gopacket.SerializeOptions{FixLengths: true, ComputeChecksums: true}
+	if err := gopacket.SerializeLayers(buf, opts, eth, ip4, tcp, gopacket.Payload(payload)); err != nil {
+		panic(err)
+	}
+	packet := gopacket.NewPacket(buf.Bytes(), layers.LayerTypeEthernet, gopacket.Default)
+	packet.Metadata().Timestamp = testStartTime.Add(time.Duration(tcp.Seq) * time.Millisecond)
+	packet.Metadata().CaptureLength = len(buf.Bytes())
+	packet.Metadata().Length = len(buf.Bytes())
+	return packet
+}
+
+// buildHandshakePacket serializes the test client's SYN or, if fromServer is
+// set, the test server's SYN/ACK.
+func buildHandshakePacket(fromServer bool, seq uint32) gopacket.Packet {
+	if fromServer {
+		tcp := &layers.TCP{SrcPort: testServerPort, DstPort: testClientPort, Seq: seq, SYN: true, ACK: true, Window: 65535}
+		return buildTCPSegment(testServerMAC, testServerIP, testClientMAC, testClientIP, tcp, "")
+	}
+	tcp := &layers.TCP{SrcPort: testClientPort, DstPort: testServerPort, Seq: seq, SYN: true, Window: 65535}
+	return buildTCPSegment(testClientMAC, testClientIP, testServerMAC, testServerIP, tcp, "")
+}
+
+// reassembleSegments runs a sequence of TCP segments through a TCPReassembler
+// and returns the Assets it reports.
+func reassembleSegments(segments []gopacket.Packet) []*Asset {
+	setupLogging(false)
+	stats = *NewStats()
+
+	var assets []*Asset
+	reassembler := NewTCPReassembler(testDecoders, time.Minute, func(asset *Asset) {
+		assets = append(assets, asset)
+	})
+	for _, packet := range segments {
+		handlePacket(packet, testDecoders, reassembler, nil)
+	}
+	reassembler.FlushAll()
+	return assets
+}
+
+// An MLLP-framed HL7 message whose identifier lies beyond the first segment
+var splitHL7Message = "\x0b" + okHL7Header +
+	"PID|1|12345|12345^^^MIE&1.2.840.114398.1.100&ISO^MR||MOUSE^MINNIE^S||19240101|F\r" +
+	"OBX|" + getNRecordString(17) + "|Grospira Peach B+\r" +
+	"\x1c\x0d"
+
+func TestReassembleHL7InOrder(t *testing.T) {
+	first := splitHL7Message[:100]
+	second := splitHL7Message[100:]
+	assets := reassembleSegments([]gopacket.Packet{
+		buildTCPPacket(1000, first),
+		buildTCPPacket(1000+uint32(len(first)), second),
+	})
+
+	if len(assets) != 1 {
+		t.Fatalf("Expected 1 asset, got %d", len(assets))
+	}
+	if assets[0].Identifier != "Grospira Peach B+" {
+		t.Errorf("Wrong identifier: '%s'", assets[0].Identifier)
+	}
+	if assets[0].IPv4Address != testClientIP.String() {
+		t.Errorf("Wrong IPv4 address: '%s'", assets[0].IPv4Address)
+	}
+	if assets[0].MACAddress != testClientMAC.String() {
+		t.Errorf("Wrong MAC address: '%s'", assets[0].MACAddress)
+	}
+
+	// The message was seen when its last segment was captured.
+	if want := testStartTime.Add(1100 * time.Millisecond); !assets[0].LastSeen.Equal(want) {
+		t.Errorf("Wrong last seen time: %v (wanted %v)", assets[0].LastSeen, want)
+	}
+}
+
+func TestReassembleRemembersHandshakePorts(t *testing.T) {
+	setupLogging(false)
+	stats = *NewStats()
+	inventory := NewInventory(0)
+	reassembler := NewTCPReassembler(testDecoders, time.Minute, inventory.Observe)
+	ack := "\x0bMSH|^~\\&|Receiver|Facility|Sender|Facility|20190101||ACK^R01|2|P|2.5\rMSA|AA|1\r\x1c\x0d"
+	for _, packet := range []gopacket.Packet{
+		buildHandshakePacket(false, 999),
+		buildHandshakePacket(true, 4999),
+		buildTCPPacket(1000, splitHL7Message),
+		buildTCPPacketFrom(testServerMAC, testServerIP, testServerPort,
+			testClientMAC, testClientIP, testClientPort, 5000, ack),
+	} {
+		handlePacket(packet, testDecoders, reassembler, inventory)
+	}
+	reassembler.FlushAll()
+
+	records := inventory.Assets()
+	if len(records) != 2 {
+		t.Fatalf("Expected 2 assets, got %d", len(records))
+	}
+	for _, record := range records {
+		switch record.IPv4Address {
+		case testClientIP.String():
+			if len(record.ConnectsToPorts) != 1 || record.ConnectsToPorts[0] != testServerPort.String() {
+				t.Errorf("Wrong client ports %v", record.ConnectsToPorts)
+			}
+		case testServerIP.String():
+			if len(record.ListensOnPorts) != 1 || record.ListensOnPorts[0] != testServerPort.String() {
+				t.Errorf("Wrong server ports %v", record.ListensOnPorts)
+			}
+		}
+	}
+}
+
+func TestReassembleReportsOutsideLock(t *testing.T) {
+	setupLogging(false)
+	stats = *NewStats()
+	var reassembler *TCPReassembler
+	reported := 0
+	reassembler = NewTCPReassembler(testDecoders, time.Minute, func(asset *Asset) {
+		// A slow report must not hold up other workers' packets.
+		if !reassembler.TryLock() {
+			t.Errorf("Asset reported while the reassembler is locked")
+			return
+		}
+		reassembler.Unlock()
+		reported++
+	})
+	handlePacket(buildTCPPacket(1000, splitHL7Message), testDecoders, reassembler, nil)
+	reassembler.FlushAll()
+	if reported != 1 {
+		t.Errorf("Expected 1 asset, got %d", reported)
+	}
+}
+
+func TestReassembleHL7OutOfOrder(t *testing.T) {
+	first := splitHL7Message[:50]
+	second := splitHL7Message[50:120]
+	third := splitHL7Message[120:]
+	assets := reassembleSegments([]gopacket.Packet{
+		buildTCPPacket(1000, first),
+		buildTCPPacket(1000+uint32(len(first)+len(second)), third),
+		buildTCPPacket(1000+uint32(len(first)), second),
+	})
+
+	if len(assets) != 1 {
+		t.Fatalf("Expected 1 asset, got %d", len(assets))
+	}
+	if assets[0].Identifier != "Grospira Peach B+" {
+		t.Errorf("Wrong identifier: '%s'", assets[0].Identifier)
+	}
+}
+
+func TestReassembleHL7TwoMessages(t *testing.T) {
+	// Two back-to-back messages, the second of which starts mid-segment
+	payload := splitHL7Message + splitHL7Message
+	first := payload[:len(splitHL7Message)+10]
+	second := payload[len(first):]
+	assets := reassembleSegments([]gopacket.Packet{
+		buildTCPPacket(1000, first),
+		buildTCPPacket(1000+uint32(len(first)), second),
+	})
+
+	if len(assets) != 2 {
+		t.Fatalf("Expected 2 assets, got %d", len(assets))
+	}
+}
+
+func TestReassembleIgnoresUnknownProtocol(t *testing.T) {
+	assets := reassembleSegments([]gopacket.Packet{
+		buildTCPPacket(1000, "GET / HTTP/1.1\r\nHost: example.com\r\n\r\n"),
+	})
+
+	if len(assets) != 0 {
+		t.Errorf("Expected no assets, got %d", len(assets))
+	}
+}
+
+func TestReassembleDicomFile(t *testing.T) {
+	// The associate request in this file spans two TCP segments.
+	handle, closeHandle, err := openOffline("testdata/dicom_arq_2_get_testclient.pcap", "")
+	if err != nil {
+		panic(err)
+	}
+	defer closeHandle()
+	var segments []gopacket.Packet
+	packetSource := gopacket.NewPacketSource(handle, handle.LinkType())
+	for packet := range packetSource.Packets() {
+		segments = append(segments, packet)
+	}
+
+	assets := reassembleSegments(segments)
+	if len(assets) != 1 {
+		t.Fatalf("Expected 1 asset, got %d", len(assets))
+	}
+	if assets[0].Identifier != "testclient" {
+		t.Errorf("Wrong identifier: '%s'", assets[0].Identifier)
+	}
+
+	// The implementation version lies beyond the first segment.
+	if attr := assets[0].Attributes[AttrSoftwareVersion]; attr.Value != "GODICOM_1_1" {
+		t.Errorf("Wrong implementation version: '%s'", attr.Value)
+	}
+}
@@ -6,20 +6,20 @@ Signal handling.
 package main
 
 import (
-	"fmt"
 	"os"
 	"os/signal"
 	"syscall"
 )
 
 // registerInterruptHandler spawns a goroutine that listens for an interrupt
-// signal (e.g., Ctrl-C) and prints the global Stats object to standard output.
-func registerInterruptHandler() {
+// signal (e.g., Ctrl-C) or a request to terminate, and calls shutdown before
+// exiting.
+func registerInterruptHandler(shutdown func()) {
 	sig := make(chan os.Signal, 1)
 	signal.Notify(sig, syscall.SIGINT, syscall.SIGTERM)
 	go func() {
 		<-sig // eat the signal
-		fmt.Println(stats.String())
+		shutdown()
 		os.Exit(0)
 	}()
 }
@@ -0,0 +1,483 @@
+// Copyright 2019 Virta Laboratories, Inc.  All rights reserved.
+/*
+Reading packets from capture files and network interfaces.
+
+Packet brokers and long-running captures rotate their output into many files,
+so several capture files may be read in one run.  Each command-line name may be
+a file, a directory (standing for the files directly inside it) or a glob
+pattern.  Packets from all files are merged into a single stream in timestamp
+order: rotated files are simply read one after another, while captures made at
+the same time in different places are interleaved.  Only files whose packets
+overlap in time are open at once.  Compressed files are decompressed as they
+are read.
+
+Likewise a sensor may capture on several interfaces at once, such as two SPAN
+ports, each with its own BPF filter.  Their packets feed one pipeline, and
+each carries the name of its interface as ancillary capture data so that we
+know which mirror saw a device.
+*/
+
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"container/heap"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"math"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/google/gopacket"
+)
+
+const (
+	// Per-packet overhead of the pcap file format, used to estimate how far
+	// through a file we are
+	pcapRecordHeaderLength = 16
+
+	// How often to report progress through a long capture file
+	progressInterval = 10 * time.Second
+
+	// How often to collect the packet counts of live capture
+	captureCountsInterval = 10 * time.Second
+)
+
+// stringList is a flag.Value for flags that may be given more than once.
+type stringList []string
+
+func (l *stringList) String() string {
+	return strings.Join(*l, ",")
+}
+
+func (l *stringList) Set(value string) error {
+	*l = append(*l, value)
+	return nil
+}
+
+// A CaptureInterface names the network interface a packet was captured on.
+type CaptureInterface string
+
+// A captureConfig tunes live capture on network interfaces.
+type captureConfig struct {
+	snaplen    int  // bytes of each packet to capture
+	promisc    bool // capture packets not addressed to the interface
+	bufferSize int  // bytes of kernel buffer, 0 for the default
+	immediate  bool // deliver packets as they arrive rather than in batches
+}
+
+// A captureCounter returns the packet counts of capture on an interface.
+type captureCounter func() (CaptureCounts, error)
+
+// parseInterfaceSpec splits an -iface argument of the form "name" or
+// "name=filter" into an interface name and a BPF filter expression, which is
+// the default expression if none is given.
+func parseInterfaceSpec(spec string, defaultBPF string) (string, string) {
+	if i := strings.Index(spec, "="); i >= 0 {
+		return spec[:i], spec[i+1:]
+	}
+	return spec, defaultBPF
+}
+
+// openInterfaces starts capturing on each of the given interfaces and returns a
+// channel of the packets from all of them.  The packet counts of each
+// interface are collected periodically into the statistics.
+func openInterfaces(specs []string, defaultBPF string, config captureConfig) (chan gopacket.Packet, error) {
+	sources := make(map[string]chan gopacket.Packet)
+	for _, spec := range specs {
+		name, bpfExpr := parseInterfaceSpec(spec, defaultBPF)
+		if _, ok := sources[name]; ok {
+			return nil, fmt.Errorf("Interface %s given more than once", name)
+		}
+		logger.Printf("listen on interface %v (%s)\n", name, captureBackend)
+		if bpfExpr != "" {
+			logger.Printf("BPF filter expression for %s: [%s]\n", name, bpfExpr)
+		}
+		source, counter, err := openLive(name, bpfExpr, config)
+		if err != nil {
+			return nil, fmt.Errorf("%s: %v", name, err)
+		}
+		sources[name] = source.Packets()
+		go func(name string) {
+			var last CaptureCounts
+			for range time.Tick(captureCountsInterval) {
+				last = updateCaptureCounts(name, counter, last)
+			}
+		}(name)
+	}
+	return mergeInterfaces(sources), nil
+}
+
+// updateCaptureCounts collects the packet counts of capture on an interface
+// into the statistics, warning if packets have been dropped since the last
+// counts.  It returns the new counts.
+func updateCaptureCounts(name string, counter captureCounter, last CaptureCounts) CaptureCounts {
+	counts, err := counter()
+	if err != nil {
+		logger.Printf("Failed to count packets on %s: %v\n", name, err)
+		stats.AddError(fmt.Errorf("Failed to count captured packets"))
+		return last
+	}
+	dropped := countSince(counts.Dropped, last.Dropped)
+	ifDropped := countSince(counts.IfDropped, last.IfDropped)
+	if dropped > 0 || ifDropped > 0 {
+		logger.Printf("%s dropped %d packets (%d by the interface) in the last %v\n", name,
+			dropped, ifDropped, captureCountsInterval)
+	}
+	stats.SetCaptureCounts(name, counts)
+	return counts
+}
+
+// countSince returns how much a packet counter has grown since its last value.
+// libpcap's counters are 32 bits wide, so one that went down has wrapped
+// around, unless its last value was too large for that, in which case it was
+// reset and counts from zero.
+func countSince(now, last uint64) uint64 {
+	switch {
+	case now >= last:
+		return now - last
+	case last <= math.MaxUint32:
+		return now + (math.MaxUint32 - last) + 1
+	default:
+		return now
+	}
+}
+
+// mergeInterfaces combines the packets captured on several interfaces into one
+// channel, recording in each packet's ancillary data the interface it came
+// from.  The channel is closed once every interface's channel has been.
+func mergeInterfaces(sources map[string]chan gopacket.Packet) chan gopacket.Packet {
+	c := make(chan gopacket.Packet, 1000)
+	var wg sync.WaitGroup
+	for name, packets := range sources {
+		wg.Add(1)
+		go func(name CaptureInterface, packets chan gopacket.Packet) {
+			defer wg.Done()
+			for packet := range packets {
+				ci := &packet.Metadata().CaptureInfo
+				ci.AncillaryData = append(ci.AncillaryData, name)
+				c <- packet
+			}
+		}(CaptureInterface(name), packets)
+	}
+	go func() {
+		wg.Wait()
+		close(c)
+	}()
+	return c
+}
+
+// packetInterface returns the name of the interface a packet was captured on,
+// or "" if it is not known.
+func packetInterface(packet gopacket.Packet) string {
+	for _, data := range packet.Metadata().AncillaryData {
+		if name, ok := data.(CaptureInterface); ok {
+			return string(name)
+		}
+	}
+	return ""
+}
+
+// expandCaptureFiles turns the names given on the command line into a list of
+// capture files.  Directories stand for the regular files directly inside them
+// (skipping hidden files), and glob patterns for the files they match.
+func expandCaptureFiles(names []string) ([]string, error) {
+	var files []string
+	for _, name := range names {
+		if strings.ContainsAny(name, "*?[") {
+			matches, err := filepath.Glob(name)
+			if err != nil {
+				return nil, err
+			}
+			if len(matches) == 0 {
+				return nil, fmt.Errorf("No capture files match %s", name)
+			}
+			files = append(files, matches...)
+			continue
+		}
+
+		info, err := os.Stat(name)
+		if err != nil {
+			return nil, err
+		}
+		if !info.IsDir() {
+			files = append(files, name)
+			continue
+		}
+		entries, err := ioutil.ReadDir(name)
+		if err != nil {
+			return nil, err
+		}
+		found := false
+		for _, entry := range entries {
+			if entry.Mode().IsRegular() && !strings.HasPrefix(entry.Name(), ".") {
+				files = append(files, filepath.Join(name, entry.Name()))
+				found = true
+			}
+		}
+		if !found {
+			return nil, fmt.Errorf("No capture files in %s", name)
+		}
+	}
+	return files, nil
+}
+
+// A captureFile is one of the files read by a CaptureFileMerger.
+type captureFile struct {
+	name   string
+	number int // position in the list of files, counting from 1
+	size   int64
+	first  time.Time // timestamp of the first packet, before filtering
+
+	close   func()
+	source  *packetSource
+	counter *countingReader // bytes read from a compressed file
+	next    gopacket.Packet // earliest packet not yet merged
+	packets uint64
+	bytes   int64 // estimated number of bytes read
+	done    bool
+}
+
+// A countingReader counts the bytes read through it.
+type countingReader struct {
+	r io.Reader
+	n int64
+}
+
+func (r *countingReader) Read(p []byte) (int, error) {
+	n, err := r.r.Read(p)
+	r.n += int64(n)
+	return n, err
+}
+
+// openCaptureFile opens a capture file, applying a BPF filter expression if one
+// is given.  Files compressed with gzip, bzip2 or xz are decompressed as they
+// are read, and pcapng files are read in Go to keep their interface names and
+// packet comments; in either case the returned countingReader tells how much
+// of the file has been read.
+func openCaptureFile(name string, bpfExpr string) (packetStreamReader, func(), *countingReader, error) {
+	f, err := os.Open(name)
+	if err != nil {
+		return nil, nil, nil, err
+	}
+	counter := &countingReader{r: f}
+	br := bufio.NewReader(counter)
+	magic, _ := br.Peek(len(pcapngMagic))
+	if compression(br) != "" || bytes.Equal(magic, pcapngMagic) {
+		reader, err := newPacketStreamReader(br)
+		if err == nil {
+			reader, err = filterPacketStream(reader, bpfExpr)
+		}
+		if err != nil {
+			f.Close()
+			return nil, nil, nil, err
+		}
+		return reader, func() { f.Close() }, counter, nil
+	}
+	f.Close()
+
+	reader, closeFile, err := openOffline(name, bpfExpr)
+	return reader, closeFile, nil, err
+}
+
+// A captureHeap holds the open capture files, earliest next packet first.
+type captureHeap []*captureFile
+
+func (h captureHeap) Len() int { return len(h) }
+
+func (h captureHeap) Less(i, j int) bool {
+	ti := h[i].next.Metadata().Timestamp
+	tj := h[j].next.Metadata().Timestamp
+	if ti.Equal(tj) {
+		return h[i].number < h[j].number
+	}
+	return ti.Before(tj)
+}
+
+func (h captureHeap) Swap(i, j int) { h[i], h[j] = h[j], h[i] }
+
+func (h *captureHeap) Push(x interface{}) { *h = append(*h, x.(*captureFile)) }
+
+func (h *captureHeap) Pop() interface{} {
+	old := *h
+	file := old[len(old)-1]
+	*h = old[:len(old)-1]
+	return file
+}
+
+// A CaptureFileMerger reads packets from several capture files in timestamp
+// order.
+type CaptureFileMerger struct {
+	bpfExpr  string
+	progress io.Writer // where to report progress, if anywhere
+
+	pending   []*captureFile // not yet opened, earliest first
+	open      captureHeap
+	count     int
+	totalSize int64
+	doneSize  int64
+	lastShown time.Time
+}
+
+// NewCaptureFileMerger prepares to read the named capture files, applying a
+// BPF filter expression to each if one is given.  Every file is opened briefly
+// to find the timestamp of its first packet; files that cannot be read are
+// reported as errors.
+func NewCaptureFileMerger(names []string, bpfExpr string, progress io.Writer) (*CaptureFileMerger, error) {
+	m := &CaptureFileMerger{bpfExpr: bpfExpr, progress: progress, count: len(names)}
+	for i, name := range names {
+		file := &captureFile{name: name, number: i + 1}
+		if info, err := os.Stat(name); err == nil {
+			file.size = info.Size()
+		}
+		reader, closeFile, _, err := openCaptureFile(name, "")
+		if err != nil {
+			return nil, fmt.Errorf("%s: %v", name, err)
+		}
+		if _, ci, err := reader.ReadPacketData(); err == nil {
+			file.first = ci.Timestamp
+		}
+		closeFile()
+		m.pending = append(m.pending, file)
+		m.totalSize += file.size
+	}
+	sort.SliceStable(m.pending, func(i, j int) bool {
+		return m.pending[i].first.Before(m.pending[j].first)
+	})
+	m.lastShown = time.Now()
+	return m, nil
+}
+
+// Packets returns a channel of the packets in all capture files, in timestamp
+// order.  The channel is closed after the last packet.
+func (m *CaptureFileMerger) Packets() chan gopacket.Packet {
+	c := make(chan gopacket.Packet, 1000)
+	go func() {
+		defer close(c)
+		for {
+			packet := m.NextPacket()
+			if packet == nil {
+				return
+			}
+			c <- packet
+		}
+	}()
+	return c
+}
+
+// NextPacket returns the earliest packet not yet read from any capture file,
+// or nil once every file has been read.
+func (m *CaptureFileMerger) NextPacket() gopacket.Packet {
+	// Open every file that starts before the packets we already have.
+	for len(m.pending) > 0 {
+		file := m.pending[0]
+		if len(m.open) > 0 && file.first.After(m.open[0].next.Metadata().Timestamp) {
+			break
+		}
+		m.pending = m.pending[1:]
+		m.start(file)
+	}
+	if len(m.open) == 0 {
+		return nil
+	}
+
+	file := m.open[0]
+	packet := file.next
+	if m.advance(file) {
+		heap.Fix(&m.open, 0)
+	} else {
+		heap.Pop(&m.open)
+	}
+	m.showProgress(file)
+	return packet
+}
+
+// start opens a capture file and reads its first packet.
+func (m *CaptureFileMerger) start(file *captureFile) {
+	logger.Printf("read from file %v\n", file.name)
+	reader, closeFile, counter, err := openCaptureFile(file.name, m.bpfExpr)
+	if err != nil {
+		stats.AddError(err)
+		m.finish(file)
+		return
+	}
+	file.close = closeFile
+	file.counter = counter
+	file.source = &packetSource{reader}
+	if m.advance(file) {
+		heap.Push(&m.open, file)
+	}
+}
+
+// advance reads the next packet from a capture file, and returns false once the
+// file has been read completely.
+func (m *CaptureFileMerger) advance(file *captureFile) bool {
+	packet, err := file.source.NextPacket()
+	if err != nil {
+		if err != io.EOF {
+			stats.AddError(fmt.Errorf("Capture file ended early: %v", err))
+		}
+		file.close()
+		m.finish(file)
+		return false
+	}
+	file.next = packet
+	file.packets++
+	if file.counter != nil {
+		file.bytes = file.counter.n
+	} else {
+		file.bytes += int64(packet.Metadata().CaptureLength + pcapRecordHeaderLength)
+	}
+	return true
+}
+
+// finish records that a capture file has been read.
+func (m *CaptureFileMerger) finish(file *captureFile) {
+	file.done = true
+	m.doneSize += file.size
+	stats.AddCaptureFile(file.name, file.packets)
+	if m.progress != nil {
+		fmt.Fprintf(m.progress, "[%d/%d] %s: %d packets (%s)\n",
+			file.number, m.count, file.name, file.packets, m.percentDone())
+	}
+}
+
+// showProgress reports how far through a capture file we are, if it has been a
+// while since the last report.
+func (m *CaptureFileMerger) showProgress(file *captureFile) {
+	if m.progress == nil || time.Since(m.lastShown) < progressInterval {
+		return
+	}
+	m.lastShown = time.Now()
+	fileDone := 100.0
+	if file.size > 0 && file.bytes < file.size {
+		fileDone = 100 * float64(file.bytes) / float64(file.size)
+	}
+	fmt.Fprintf(m.progress, "[%d/%d] %s: %d packets, %.0f%% of file (%s)\n",
+		file.number, m.count, file.name, file.packets, fileDone, m.percentDone())
+}
+
+// percentDone describes how much of all capture files has been read.
+func (m *CaptureFileMerger) percentDone() string {
+	if m.totalSize == 0 {
+		return "100% of input"
+	}
+	done := m.doneSize
+	for _, file := range m.open {
+		if file.done {
+			continue
+		}
+		if file.bytes < file.size {
+			done += file.bytes
+		} else {
+			done += file.size
+		}
+	}
+	return fmt.Sprintf("%.0f%% of input", 100*float64(done)/float64(m.totalSize))
+}
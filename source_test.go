@@ -0,0 +1,226 @@
+/*
+Unit tests for reading packets from capture files.
+*/
+package main
+
+import (
+	"bytes"
+	"fmt"
+	"io/ioutil"
+	"math"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"testing"
+
+	"github.com/google/gopacket"
+	"github.com/google/gopacket/layers"
+	"github.com/google/gopacket/pcapgo"
+)
+
+// writeCaptureFile writes TCP packets with the given sequence numbers (and
+// therefore timestamps) to a pcap file.
+func writeCaptureFile(t *testing.T, name string, seqs ...uint32) {
+	f, err := os.Create(name)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer f.Close()
+	w := pcapgo.NewWriter(f)
+	if err := w.WriteFileHeader(65536, layers.LinkTypeEthernet); err != nil {
+		t.Fatal(err)
+	}
+	for _, seq := range seqs {
+		packet := buildTCPPacket(seq, "x")
+		if err := w.WritePacket(packet.Metadata().CaptureInfo, packet.Data()); err != nil {
+			t.Fatal(err)
+		}
+	}
+}
+
+func TestExpandCaptureFiles(t *testing.T) {
+	dir, err := ioutil.TempDir("", "tapirx")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	for _, name := range []string{"a.pcap", "b.pcap", "c.pcapng", ".hidden"} {
+		writeCaptureFile(t, filepath.Join(dir, name))
+	}
+	if err := os.Mkdir(filepath.Join(dir, "sub"), 0755); err != nil {
+		t.Fatal(err)
+	}
+
+	files, err := expandCaptureFiles([]string{dir})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(files) != 3 {
+		t.Errorf("Expected 3 files in directory, got %v", files)
+	}
+
+	files, err = expandCaptureFiles([]string{filepath.Join(dir, "*.pcap"), filepath.Join(dir, "c.pcapng")})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(files) != 3 {
+		t.Errorf("Expected 3 files from glob and name, got %v", files)
+	}
+
+	if _, err := expandCaptureFiles([]string{filepath.Join(dir, "*.cap")}); err == nil {
+		t.Errorf("Glob matching nothing was accepted")
+	}
+	if _, err := expandCaptureFiles([]string{filepath.Join(dir, "sub")}); err == nil {
+		t.Errorf("Empty directory was accepted")
+	}
+}
+
+func TestCaptureFileMergerOrder(t *testing.T) {
+	setupLogging(false)
+	stats = *NewStats()
+	dir, err := ioutil.TempDir("", "tapirx")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	// Two simultaneous captures and a later rotated file, given out of order
+	early := filepath.Join(dir, "early.pcap")
+	interleaved := filepath.Join(dir, "interleaved.pcap")
+	late := filepath.Join(dir, "late.pcap")
+	writeCaptureFile(t, early, 0, 2, 4, 6)
+	writeCaptureFile(t, interleaved, 1, 3, 5)
+	writeCaptureFile(t, late, 7, 8, 9)
+
+	var progress bytes.Buffer
+	merger, err := NewCaptureFileMerger([]string{late, interleaved, early}, "", &progress)
+	if err != nil {
+		t.Fatal(err)
+	}
+	var order []uint32
+	for packet := range merger.Packets() {
+		order = append(order, packet.TransportLayer().(*layers.TCP).Seq)
+	}
+
+	if len(order) != 10 || !sort.SliceIsSorted(order, func(i, j int) bool { return order[i] < order[j] }) {
+		t.Errorf("Packets merged out of order: %v", order)
+	}
+	if stats.CaptureFiles[early] != 4 || stats.CaptureFiles[interleaved] != 3 || stats.CaptureFiles[late] != 3 {
+		t.Errorf("Wrong per-file packet counts: %v", stats.CaptureFiles)
+	}
+	lines := strings.Split(strings.TrimSpace(progress.String()), "\n")
+	if len(lines) != 3 || !strings.HasPrefix(lines[2], "[1/3] "+late) || !strings.HasSuffix(lines[2], "(100% of input)") {
+		t.Errorf("Wrong progress report:\n%s", progress.String())
+	}
+}
+
+func TestCaptureFileMergerBadFile(t *testing.T) {
+	setupLogging(false)
+	dir, err := ioutil.TempDir("", "tapirx")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	name := filepath.Join(dir, "notes.txt")
+	if err := ioutil.WriteFile(name, []byte("not a capture file"), 0644); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := NewCaptureFileMerger([]string{name}, "", nil); err == nil {
+		t.Errorf("File that is not a capture was accepted")
+	}
+}
+
+func TestParseInterfaceSpec(t *testing.T) {
+	cases := []struct {
+		spec, name, bpf string
+	}{
+		{"eth0", "eth0", "port 104"},
+		{"eth1=port 2575", "eth1", "port 2575"},
+		{"eth2=tcp[13]=2", "eth2", "tcp[13]=2"},
+		{"eth3=", "eth3", ""},
+	}
+	for _, c := range cases {
+		name, bpf := parseInterfaceSpec(c.spec, "port 104")
+		if name != c.name || bpf != c.bpf {
+			t.Errorf("%s: got %q %q", c.spec, name, bpf)
+		}
+	}
+}
+
+func TestMergeInterfaces(t *testing.T) {
+	setupLogging(false)
+	stats = *NewStats()
+	sources := map[string]chan gopacket.Packet{
+		"eth0": make(chan gopacket.Packet, 1),
+		"eth1": make(chan gopacket.Packet, 1),
+	}
+	sources["eth0"] <- buildUDPPacket(40000, 40001, "HELLO pump-7")
+	sources["eth1"] <- buildUDPPacket(40000, 40001, "HELLO pump-7")
+	close(sources["eth0"])
+	close(sources["eth1"])
+
+	inventory := NewInventory(0)
+	seen := make(map[string]bool)
+	for packet := range mergeInterfaces(sources) {
+		seen[packetInterface(packet)] = true
+		handlePacket(packet, []PayloadDecoder{&helloDecoder{}}, nil, inventory)
+	}
+	if !seen["eth0"] || !seen["eth1"] {
+		t.Errorf("Packets not tagged with their interfaces: %v", seen)
+	}
+
+	records := inventory.Assets()
+	if len(records) != 1 {
+		t.Fatalf("Expected 1 asset, got %d", len(records))
+	}
+	if interfaces := strings.Join(records[0].Interfaces, ","); interfaces != "eth0,eth1" {
+		t.Errorf("Wrong interfaces %s", interfaces)
+	}
+	if packetInterface(buildTCPPacket(1000, "hello")) != "" {
+		t.Errorf("Packet from nowhere has an interface")
+	}
+}
+
+func TestUpdateCaptureCounts(t *testing.T) {
+	setupLogging(false)
+	stats = *NewStats()
+	reports := []CaptureCounts{{Received: 100}, {Received: 250, Dropped: 7, IfDropped: 1}}
+	counter := func() (CaptureCounts, error) {
+		if len(reports) == 0 {
+			return CaptureCounts{}, fmt.Errorf("socket closed")
+		}
+		counts := reports[0]
+		reports = reports[1:]
+		return counts, nil
+	}
+
+	var last CaptureCounts
+	for i := 0; i < 3; i++ {
+		last = updateCaptureCounts("eth1", counter, last)
+	}
+	if counts := stats.CaptureCounts["eth1"]; counts != (CaptureCounts{Received: 250, Dropped: 7, IfDropped: 1}) {
+		t.Errorf("Wrong capture counts %+v", counts)
+	}
+	if last != stats.CaptureCounts["eth1"] {
+		t.Errorf("Failure to count packets forgot the last counts")
+	}
+	if stats.Errors["Failed to count captured packets"] != 1 {
+		t.Errorf("Failure to count packets not reported: %v", stats.Errors)
+	}
+}
+
+func TestCountSince(t *testing.T) {
+	for _, test := range []struct {
+		now, last, expected uint64
+	}{
+		{7, 7, 0},
+		{10, 7, 3},
+		{2, math.MaxUint32 - 2, 5},  // a 32-bit counter wrapped
+		{2, math.MaxUint32 + 10, 2}, // a 64-bit counter was reset
+	} {
+		if count := countSince(test.now, test.last); count != test.expected {
+			t.Errorf("countSince(%d, %d) = %d, expected %d", test.now, test.last, count, test.expected)
+		}
+	}
+}
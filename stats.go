@@ -9,21 +9,52 @@ import (
 	"encoding/json"
 	"sort"
 	"sync"
+	"time"
 )
 
 // Stats stores statistics about observed Assets and packets.
 type Stats struct {
 	sync.Mutex
-	TotalPacketCount uint64            `json:"packet_count"`   // Grand total number of packets
-	PacketLayers     map[string]uint64 `json:"packet_layers"`  // Count of each packet layer type
-	IPv4Addresses    map[string]uint64 `json:"ipv4_addresses"` // Unique sender IPv4 addresses
-	IPv6Addresses    map[string]uint64 `json:"ipv6_addresses"` // Unique sender IPv6 addresses
-	Ports            map[string]uint64 `json:"ports"`          // Unique sender TCP ports
-	MACs             map[string]uint64 `json:"mac_addresses"`  // Unique sender MAC addresses
-	Identifiers      map[string]uint64 `json:"identifiers"`    // Unique device identification strings
-	Provenances      map[string]uint64 `json:"provenances"`    // Count of identifier provenance
-	Errors           map[string]uint64 `json:"errors"`         // Count of errors
-	UploadResults    map[string]uint64 `json:"uploads"`        // Count upload outcodes
+	TotalPacketCount uint64            `json:"packet_count"`      // Grand total number of packets
+	PacketLayers     map[string]uint64 `json:"packet_layers"`     // Count of each packet layer type
+	IPv4Addresses    map[string]uint64 `json:"ipv4_addresses"`    // Unique sender IPv4 addresses
+	IPv6Addresses    map[string]uint64 `json:"ipv6_addresses"`    // Unique sender IPv6 addresses
+	Ports            map[string]uint64 `json:"ports"`             // Unique sender TCP ports
+	UDPPorts         map[string]uint64 `json:"udp_ports"`         // Unique sender UDP ports
+	MACs             map[string]uint64 `json:"mac_addresses"`     // Unique sender MAC addresses
+	Identifiers      map[string]uint64 `json:"identifiers"`       // Unique device identification strings
+	Provenances      map[string]uint64 `json:"provenances"`       // Count of identifier provenance
+	Errors           map[string]uint64 `json:"errors"`            // Count of errors
+	UploadResults    map[string]uint64 `json:"uploads"`           // Count upload outcodes
+	InventoryAssets  uint64            `json:"inventory_assets"`  // Number of distinct devices in the inventory
+	MaxQueueDepth    uint64            `json:"max_queue_depth"`   // Most packets waiting in all worker queues at once
+	DroppedPackets   uint64            `json:"dropped_packets"`   // Packets dropped because the queue was full
+	FragmentOverlaps uint64            `json:"fragment_overlaps"` // Datagrams discarded for overlapping fragments
+	CaptureFiles     map[string]uint64 `json:"capture_files"`     // Packets read from each capture file
+
+	// Packets received and dropped on each interface, as last reported by
+	// the kernel or libpcap
+	CaptureCounts map[string]CaptureCounts `json:"capture_counts"`
+
+	// Acknowledgments of each HL7 sender's messages, by sender address
+	HL7Acknowledgments map[string]HL7AckCounts `json:"hl7_acknowledgments"`
+}
+
+// CaptureCounts are the packet counts of live capture on one interface.
+type CaptureCounts struct {
+	Received  uint64 `json:"received"`   // Packets received by the filter
+	Dropped   uint64 `json:"dropped"`    // Packets dropped because the buffer was full
+	IfDropped uint64 `json:"if_dropped"` // Packets dropped by the interface or its driver
+}
+
+// HL7AckCounts count the acknowledgments of one sender's HL7 messages.
+type HL7AckCounts struct {
+	Accepted       uint64  `json:"accepted"`        // AA or CA
+	Errors         uint64  `json:"errors"`          // AE or CE, rejected for their content
+	Rejected       uint64  `json:"rejected"`        // AR or CR
+	Unacknowledged uint64  `json:"unacknowledged"`  // Never acknowledged
+	MeanLatency    float64 `json:"mean_latency_ms"` // Mean time to acknowledgment
+	MaxLatency     float64 `json:"max_latency_ms"`  // Longest time to acknowledgment
 }
 
 // NewStats returns a new, empty container for statistics.
@@ -33,11 +64,15 @@ func NewStats() *Stats {
 	s.IPv4Addresses = make(map[string]uint64)
 	s.IPv6Addresses = make(map[string]uint64)
 	s.Ports = make(map[string]uint64)
+	s.UDPPorts = make(map[string]uint64)
 	s.MACs = make(map[string]uint64)
 	s.Identifiers = make(map[string]uint64)
 	s.Provenances = make(map[string]uint64)
 	s.Errors = make(map[string]uint64)
 	s.UploadResults = make(map[string]uint64)
+	s.CaptureFiles = make(map[string]uint64)
+	s.CaptureCounts = make(map[string]CaptureCounts)
+	s.HL7Acknowledgments = make(map[string]HL7AckCounts)
 	return s
 }
 
@@ -80,6 +115,12 @@ func (s *Stats) AddAsset(asset *Asset) {
 	if asset.ConnectsToPort != "" {
 		s.Ports[asset.ConnectsToPort]++
 	}
+	if asset.ListensOnPortUDP != "" {
+		s.UDPPorts[asset.ListensOnPortUDP]++
+	}
+	if asset.ConnectsToPortUDP != "" {
+		s.UDPPorts[asset.ConnectsToPortUDP]++
+	}
 	if asset.MACAddress != "" {
 		s.MACs[asset.MACAddress]++
 	}
@@ -91,6 +132,89 @@ func (s *Stats) AddAsset(asset *Asset) {
 	}
 }
 
+// AddInventoryAsset reports that a new device was added to the inventory.
+func (s *Stats) AddInventoryAsset() {
+	s.Lock()
+	defer s.Unlock()
+	s.InventoryAssets++
+}
+
+// UpdateQueueDepth reports the number of packets waiting for workers, in all
+// their queues together.
+func (s *Stats) UpdateQueueDepth(depth int) {
+	s.Lock()
+	defer s.Unlock()
+	if uint64(depth) > s.MaxQueueDepth {
+		s.MaxQueueDepth = uint64(depth)
+	}
+}
+
+// AddDroppedPacket reports that a packet was dropped because the queue was
+// full.
+func (s *Stats) AddDroppedPacket() {
+	s.Lock()
+	defer s.Unlock()
+	s.DroppedPackets++
+}
+
+// AddFragmentOverlap reports that a datagram was discarded because its
+// fragments overlapped.
+func (s *Stats) AddFragmentOverlap() {
+	s.Lock()
+	defer s.Unlock()
+	s.FragmentOverlaps++
+}
+
+// AddCaptureFile reports that a capture file has been read.
+func (s *Stats) AddCaptureFile(name string, packets uint64) {
+	s.Lock()
+	defer s.Unlock()
+	s.CaptureFiles[name] += packets
+}
+
+// SetCaptureCounts records the latest packet counts of capture on an
+// interface.
+func (s *Stats) SetCaptureCounts(name string, counts CaptureCounts) {
+	s.Lock()
+	defer s.Unlock()
+	s.CaptureCounts[name] = counts
+}
+
+// AddHL7Acknowledgment reports that a sender's HL7 message was acknowledged
+// with the given code after the given time.  Unknown codes are ignored.
+func (s *Stats) AddHL7Acknowledgment(sender, code string, latency time.Duration) {
+	s.Lock()
+	defer s.Unlock()
+	counts := s.HL7Acknowledgments[sender]
+	switch code {
+	case "AA", "CA":
+		counts.Accepted++
+	case "AE", "CE":
+		counts.Errors++
+	case "AR", "CR":
+		counts.Rejected++
+	default:
+		return
+	}
+	n := float64(counts.Accepted + counts.Errors + counts.Rejected)
+	ms := float64(latency) / float64(time.Millisecond)
+	counts.MeanLatency += (ms - counts.MeanLatency) / n
+	if ms > counts.MaxLatency {
+		counts.MaxLatency = ms
+	}
+	s.HL7Acknowledgments[sender] = counts
+}
+
+// AddHL7Unacknowledged reports that a sender's HL7 message was never
+// acknowledged.
+func (s *Stats) AddHL7Unacknowledged(sender string) {
+	s.Lock()
+	defer s.Unlock()
+	counts := s.HL7Acknowledgments[sender]
+	counts.Unacknowledged++
+	s.HL7Acknowledgments[sender] = counts
+}
+
 // AddUpload reports that an API upload succeeded.
 func (s *Stats) AddUpload() {
 	s.Lock()
@@ -0,0 +1,261 @@
+// Copyright 2019 Virta Laboratories, Inc.  All rights reserved.
+/*
+Reading packets from pcap streams.
+
+A capture need not be a file.  tcpdump can write one to standard output, to be
+piped into Tapirx from a remote machine over ssh, and packet brokers can export
+captures over TCP in the "PCAP-over-IP" style.  Tapirx reads a pcap or pcapng
+stream, compressed or not, from standard input ("-pcap -"), from a TCP
+connection it makes (-pcapconnect), reconnecting whenever the connection fails,
+or from TCP connections it accepts (-pcaplisten).
+*/
+
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"os"
+	"sync"
+	"time"
+
+	"github.com/google/gopacket"
+	"github.com/google/gopacket/layers"
+	"github.com/google/gopacket/pcapgo"
+)
+
+const (
+	// Capture length assumed when compiling BPF filters for streams
+	streamSnaplen = 65535
+
+	// Delays before reconnecting to a PCAP-over-IP server that has failed,
+	// doubling after each failure
+	streamRetryMin = time.Second
+	streamRetryMax = time.Minute
+)
+
+// A packetStreamReader is a pcapgo.Reader or a pcapngReader.
+type packetStreamReader interface {
+	gopacket.PacketDataSource
+	LinkType() layers.LinkType
+}
+
+// newPacketStreamReader reads the header of a pcap or pcapng stream, which may
+// be compressed.
+func newPacketStreamReader(r io.Reader) (packetStreamReader, error) {
+	decompressed, err := decompress(bufio.NewReader(r))
+	if err != nil {
+		return nil, err
+	}
+	br := bufio.NewReader(decompressed)
+	magic, err := br.Peek(len(pcapngMagic))
+	if err != nil {
+		return nil, err
+	}
+	if bytes.Equal(magic, pcapngMagic) {
+		return newPcapngReader(br)
+	}
+	return pcapgo.NewReader(br)
+}
+
+// packetLinkType returns the link type of a packet read from a stream, which
+// differs from the stream's own link type in a pcapng capture made on
+// interfaces of different types.
+func packetLinkType(ci gopacket.CaptureInfo, streamType layers.LinkType) layers.LinkType {
+	for _, data := range ci.AncillaryData {
+		if linkType, ok := data.(layers.LinkType); ok {
+			return linkType
+		}
+	}
+	return streamType
+}
+
+// A filteredPacketReader passes on only the packets that match a BPF filter.
+// The filter is compiled separately for each link type in the stream.
+type filteredPacketReader struct {
+	packetStreamReader
+	bpfExpr string
+	filters map[layers.LinkType]packetFilter
+}
+
+func (r *filteredPacketReader) ReadPacketData() ([]byte, gopacket.CaptureInfo, error) {
+	for {
+		data, ci, err := r.packetStreamReader.ReadPacketData()
+		if err != nil {
+			return data, ci, err
+		}
+		linkType := packetLinkType(ci, r.LinkType())
+		filter, ok := r.filters[linkType]
+		if !ok {
+			if filter, err = compileFilter(linkType, r.bpfExpr); err != nil {
+				return nil, ci, err
+			}
+			r.filters[linkType] = filter
+		}
+		if filter.Matches(ci, data) {
+			return data, ci, nil
+		}
+	}
+}
+
+// filterPacketStream applies a BPF filter expression, if one is given, to a
+// packet stream.
+func filterPacketStream(reader packetStreamReader, bpfExpr string) (packetStreamReader, error) {
+	if bpfExpr == "" {
+		return reader, nil
+	}
+	filter, err := compileFilter(reader.LinkType(), bpfExpr)
+	if err != nil {
+		return nil, err
+	}
+	filters := map[layers.LinkType]packetFilter{reader.LinkType(): filter}
+	return &filteredPacketReader{reader, bpfExpr, filters}, nil
+}
+
+// A packetSource decodes the packets read from a stream, like
+// gopacket.PacketSource, but according to each packet's own link type.
+type packetSource struct {
+	reader packetStreamReader
+}
+
+// NextPacket reads and decodes the next packet.
+func (s *packetSource) NextPacket() (gopacket.Packet, error) {
+	data, ci, err := s.reader.ReadPacketData()
+	if err != nil {
+		return nil, err
+	}
+	packet := gopacket.NewPacket(data, packetLinkType(ci, s.reader.LinkType()), gopacket.Default)
+	m := packet.Metadata()
+	m.CaptureInfo = ci
+	m.Truncated = m.Truncated || ci.CaptureLength < ci.Length
+	return packet, nil
+}
+
+// readPacketStream reads a pcap or pcapng stream, which may be compressed, into
+// a channel of packets, applying a BPF filter expression if one is given.  It
+// returns the number of packets read and the error that ended the stream,
+// which is io.EOF if the stream ended cleanly.
+func readPacketStream(r io.Reader, bpfExpr string, c chan<- gopacket.Packet) (int, error) {
+	reader, err := newPacketStreamReader(r)
+	if err != nil {
+		return 0, err
+	}
+	if reader, err = filterPacketStream(reader, bpfExpr); err != nil {
+		return 0, err
+	}
+	source := &packetSource{reader}
+	n := 0
+	for {
+		packet, err := source.NextPacket()
+		if err != nil {
+			return n, err
+		}
+		c <- packet
+		n++
+	}
+}
+
+// readStdin returns a channel of the packets in a pcap stream on standard
+// input.  The channel is closed when the stream ends.
+func readStdin(bpfExpr string) chan gopacket.Packet {
+	logger.Println("read from standard input")
+	c := make(chan gopacket.Packet, 1000)
+	go func() {
+		defer close(c)
+		if _, err := readPacketStream(os.Stdin, bpfExpr, c); err != io.EOF {
+			logger.Println("Failed to read standard input:", err)
+			stats.AddError(fmt.Errorf("Pcap stream ended early"))
+		}
+	}()
+	return c
+}
+
+// connectStream returns a channel of the packets sent by a PCAP-over-IP server.
+// Whenever the connection fails or the server ends its stream, we connect
+// again, waiting longer after each attempt that yields no packets.  The channel
+// is closed once stop is closed and the current stream has ended.
+func connectStream(address string, bpfExpr string, stop <-chan struct{}) chan gopacket.Packet {
+	c := make(chan gopacket.Packet, 1000)
+	go func() {
+		defer close(c)
+		retry := streamRetryMin
+		for {
+			select {
+			case <-stop:
+				return
+			default:
+			}
+
+			logger.Printf("connect to PCAP-over-IP server %s\n", address)
+			n := 0
+			conn, err := net.Dial("tcp", address)
+			if err == nil {
+				n, err = readPacketStream(conn, bpfExpr, c)
+				conn.Close()
+			}
+			if err != io.EOF {
+				logger.Printf("PCAP-over-IP stream from %s failed: %v\n", address, err)
+				stats.AddError(fmt.Errorf("PCAP-over-IP stream failed"))
+			}
+			if n > 0 {
+				retry = streamRetryMin
+				continue
+			}
+			select {
+			case <-stop:
+				return
+			case <-time.After(retry):
+			}
+			if retry *= 2; retry > streamRetryMax {
+				retry = streamRetryMax
+			}
+		}
+	}()
+	return c
+}
+
+// listenStream returns a channel of the packets sent by PCAP-over-IP clients
+// that connect to a listener.  Any number of clients may send streams at once.
+// The channel is closed once the listener is closed and every client's stream
+// has ended.
+func listenStream(listener net.Listener, bpfExpr string) chan gopacket.Packet {
+	logger.Printf("listen for PCAP-over-IP clients on %s\n", listener.Addr())
+	c := make(chan gopacket.Packet, 1000)
+	go func() {
+		var wg sync.WaitGroup
+		defer func() {
+			wg.Wait()
+			close(c)
+		}()
+		for {
+			conn, err := listener.Accept()
+			if err != nil {
+				// Keep accepting clients after a timeout, and stop when
+				// the listener is closed or fails.
+				var ne net.Error
+				if errors.As(err, &ne) && ne.Timeout() {
+					continue
+				}
+				if !errors.Is(err, net.ErrClosed) {
+					logger.Printf("Stopped accepting PCAP-over-IP clients: %v\n", err)
+					stats.AddError(fmt.Errorf("PCAP-over-IP listener failed"))
+				}
+				return
+			}
+			wg.Add(1)
+			go func() {
+				defer wg.Done()
+				defer conn.Close()
+				if _, err := readPacketStream(conn, bpfExpr, c); err != io.EOF {
+					logger.Printf("PCAP-over-IP stream from %s failed: %v\n", conn.RemoteAddr(), err)
+					stats.AddError(fmt.Errorf("PCAP-over-IP stream failed"))
+				}
+			}()
+		}
+	}()
+	return c
+}
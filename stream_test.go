@@ -0,0 +1,142 @@
+/*
+Unit tests for reading packets from pcap streams.
+*/
+package main
+
+import (
+	"bytes"
+	"io"
+	"net"
+	"testing"
+	"time"
+
+	"github.com/google/gopacket"
+	"github.com/google/gopacket/layers"
+	"github.com/google/gopacket/pcapgo"
+)
+
+// writeCaptureStream writes TCP packets with the given sequence numbers as a
+// pcap stream.
+func writeCaptureStream(t *testing.T, w io.Writer, seqs ...uint32) {
+	pw := pcapgo.NewWriter(w)
+	if err := pw.WriteFileHeader(65536, layers.LinkTypeEthernet); err != nil {
+		t.Error(err)
+	}
+	for _, seq := range seqs {
+		packet := buildTCPPacket(seq, "x")
+		if err := pw.WritePacket(packet.Metadata().CaptureInfo, packet.Data()); err != nil {
+			t.Error(err)
+		}
+	}
+}
+
+// receiveSeqs reads the sequence numbers of n packets from a channel.
+func receiveSeqs(t *testing.T, c chan gopacket.Packet, n int) []uint32 {
+	var seqs []uint32
+	for len(seqs) < n {
+		select {
+		case packet := <-c:
+			seqs = append(seqs, packet.TransportLayer().(*layers.TCP).Seq)
+		case <-time.After(5 * time.Second):
+			t.Fatalf("Timed out after %d packets", len(seqs))
+		}
+	}
+	return seqs
+}
+
+func TestReadPacketStream(t *testing.T) {
+	setupLogging(false)
+	var pcapStream bytes.Buffer
+	writeCaptureStream(t, &pcapStream, 1, 2, 3)
+
+	var ngStream bytes.Buffer
+	w, err := pcapgo.NewNgWriter(&ngStream, layers.LinkTypeEthernet)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, seq := range []uint32{1, 2, 3} {
+		packet := buildTCPPacket(seq, "x")
+		if err := w.WritePacket(packet.Metadata().CaptureInfo, packet.Data()); err != nil {
+			t.Fatal(err)
+		}
+	}
+	w.Flush()
+
+	for name, stream := range map[string]*bytes.Buffer{"pcap": &pcapStream, "pcapng": &ngStream} {
+		c := make(chan gopacket.Packet, 10)
+		n, err := readPacketStream(stream, "", c)
+		if n != 3 || err != io.EOF {
+			t.Errorf("%s: read %d packets, error %v", name, n, err)
+		}
+		packet := <-c
+		if !packet.Metadata().Timestamp.Equal(testStartTime.Add(time.Millisecond)) {
+			t.Errorf("%s: wrong timestamp %v", name, packet.Metadata().Timestamp)
+		}
+	}
+}
+
+func TestConnectStreamReconnects(t *testing.T) {
+	setupLogging(false)
+	stats = *NewStats()
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// The server sends one stream, hangs up, and sends another.
+	go func() {
+		for _, seq := range []uint32{1, 2} {
+			conn, err := listener.Accept()
+			if err != nil {
+				return
+			}
+			writeCaptureStream(t, conn, seq)
+			conn.Close()
+		}
+	}()
+
+	stop := make(chan struct{})
+	c := connectStream(listener.Addr().String(), "", stop)
+	seqs := receiveSeqs(t, c, 2)
+	if seqs[0] != 1 || seqs[1] != 2 {
+		t.Errorf("Wrong packets %v", seqs)
+	}
+
+	close(stop)
+	listener.Close()
+	for range c {
+	}
+}
+
+func TestListenStream(t *testing.T) {
+	setupLogging(false)
+	stats = *NewStats()
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	c := listenStream(listener, "")
+
+	for _, seq := range []uint32{1, 2} {
+		conn, err := net.Dial("tcp", listener.Addr().String())
+		if err != nil {
+			t.Fatal(err)
+		}
+		writeCaptureStream(t, conn, seq)
+		conn.Close()
+	}
+	receiveSeqs(t, c, 2)
+
+	listener.Close()
+	select {
+	case _, ok := <-c:
+		if ok {
+			t.Errorf("Unexpected packet after closing listener")
+		}
+	case <-time.After(5 * time.Second):
+		t.Errorf("Channel not closed with listener")
+	}
+	if len(stats.Errors) != 0 {
+		t.Errorf("Unexpected errors %v", stats.Errors)
+	}
+}
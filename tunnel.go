@@ -0,0 +1,200 @@
+// Copyright 2019 Virta Laboratories, Inc.  All rights reserved.
+/*
+Decapsulation of mirrored traffic.
+
+Mirrored traffic is often delivered to a sensor through a tunnel rather than a
+SPAN port: Cisco ERSPAN and plain GRE, VXLAN (as used by AWS and Azure traffic
+mirroring), or TZSP (as used by MikroTik).  Every packet then appears to come
+from the mirroring device, so before anything else we strip the encapsulation
+and handle the inner frame as if it had been captured directly.  The kind of
+tunnel and its identifier (GRE key, ERSPAN session ID or VXLAN network
+identifier) travel with the inner packet as ancillary capture data.
+
+Docs:
+https://tools.ietf.org/html/rfc2890 (GRE)
+https://tools.ietf.org/html/draft-foschiano-erspan-03 (ERSPAN)
+https://tools.ietf.org/html/rfc7348 (VXLAN)
+https://web.archive.org/web/2019/http://www.babel-eng.com/tzsp.html (TZSP)
+*/
+
+package main
+
+import (
+	"encoding/binary"
+	"strconv"
+
+	"github.com/google/gopacket"
+	"github.com/google/gopacket/layers"
+)
+
+const (
+	// Tunnels may be nested, but not very deeply.
+	maxTunnelDepth = 4
+
+	// GRE protocol type of ERSPAN type III
+	ethernetTypeERSPANIII = 0x22eb
+
+	// ERSPAN header lengths
+	erspanIIHeaderLength       = 8
+	erspanIIIHeaderLength      = 12
+	erspanIIIPlatformSubheader = 8
+
+	// TZSP is carried over UDP to this port.
+	tzspPort = 37008
+
+	// TZSP header values
+	tzspVersion          = 1
+	tzspTypeReceived     = 0
+	tzspTypeTransmit     = 1
+	tzspProtocolEthernet = 1
+	tzspTagPadding       = 0
+	tzspTagEnd           = 1
+)
+
+// A Tunnel describes the encapsulation a packet arrived in.
+type Tunnel struct {
+	Type string // "GRE", "ERSPAN", "VXLAN" or "TZSP"
+	ID   string // GRE key, ERSPAN session ID or VXLAN network identifier
+}
+
+// decapsulate returns the innermost packet carried by a tunnel, or the packet
+// itself if it was not encapsulated.  The inner packet's capture information
+// is that of the outer one, with the innermost Tunnel added to its ancillary
+// data.
+func decapsulate(packet gopacket.Packet) gopacket.Packet {
+	for depth := 0; depth < maxTunnelDepth; depth++ {
+		data, first, tunnel, ok := innerFrame(packet)
+		if !ok {
+			break
+		}
+		stats.AddLayer("Tunnel/" + tunnel.Type)
+		logger.Printf("  %s tunnel %s\n", tunnel.Type, tunnel.ID)
+
+		ci := packet.Metadata().CaptureInfo
+		ci.CaptureLength = len(data)
+		ci.Length = len(data)
+		ci.AncillaryData = append(append([]interface{}(nil), ci.AncillaryData...), tunnel)
+		packet = gopacket.NewPacket(data, first, gopacket.Default)
+		packet.Metadata().CaptureInfo = ci
+	}
+	return packet
+}
+
+// packetTunnel returns the Tunnel a packet arrived in, if any.
+func packetTunnel(packet gopacket.Packet) (Tunnel, bool) {
+	found := false
+	var tunnel Tunnel
+	for _, data := range packet.Metadata().AncillaryData {
+		if t, ok := data.(Tunnel); ok {
+			tunnel = t
+			found = true
+		}
+	}
+	return tunnel, found
+}
+
+// innerFrame finds the frame carried by the outermost tunnel in a packet, along
+// with the type of its first layer.
+func innerFrame(packet gopacket.Packet) ([]byte, gopacket.LayerType, Tunnel, bool) {
+	for _, layer := range packet.Layers() {
+		switch layer := layer.(type) {
+		case *layers.GRE:
+			return greFrame(layer)
+		case *layers.VXLAN:
+			tunnel := Tunnel{Type: "VXLAN", ID: strconv.Itoa(int(layer.VNI))}
+			return layer.LayerPayload(), layers.LayerTypeEthernet, tunnel, true
+		case *layers.UDP:
+			if layer.DstPort == tzspPort {
+				return tzspFrame(layer.LayerPayload())
+			}
+		}
+	}
+	return nil, 0, Tunnel{}, false
+}
+
+// greFrame finds the frame carried by GRE, which may be an Ethernet frame, an
+// IP packet, or an ERSPAN-encapsulated Ethernet frame.
+func greFrame(gre *layers.GRE) ([]byte, gopacket.LayerType, Tunnel, bool) {
+	payload := gre.LayerPayload()
+	tunnel := Tunnel{Type: "GRE"}
+	if gre.KeyPresent {
+		tunnel.ID = strconv.FormatUint(uint64(gre.Key), 10)
+	}
+
+	switch gre.Protocol {
+	case layers.EthernetTypeTransparentEthernetBridging:
+		return payload, layers.LayerTypeEthernet, tunnel, true
+	case layers.EthernetTypeIPv4:
+		return payload, layers.LayerTypeIPv4, tunnel, true
+	case layers.EthernetTypeIPv6:
+		return payload, layers.LayerTypeIPv6, tunnel, true
+	case layers.EthernetTypeERSPAN:
+		// Type I has no header of its own, and GRE carries no sequence
+		// number.  Type II has an 8-byte header.
+		tunnel = Tunnel{Type: "ERSPAN"}
+		if !gre.SeqPresent {
+			return payload, layers.LayerTypeEthernet, tunnel, true
+		}
+		if len(payload) < erspanIIHeaderLength {
+			return nil, 0, tunnel, false
+		}
+		tunnel.ID = erspanSessionID(payload)
+		return payload[erspanIIHeaderLength:], layers.LayerTypeEthernet, tunnel, true
+	case ethernetTypeERSPANIII:
+		// Type III has a 12-byte header, optionally followed by an 8-byte
+		// platform-specific subheader.
+		tunnel = Tunnel{Type: "ERSPAN"}
+		if len(payload) < erspanIIIHeaderLength {
+			return nil, 0, tunnel, false
+		}
+		headerLength := erspanIIIHeaderLength
+		if payload[11]&0x01 != 0 {
+			headerLength += erspanIIIPlatformSubheader
+		}
+		if len(payload) < headerLength {
+			return nil, 0, tunnel, false
+		}
+		tunnel.ID = erspanSessionID(payload)
+		return payload[headerLength:], layers.LayerTypeEthernet, tunnel, true
+	}
+	return nil, 0, tunnel, false
+}
+
+// erspanSessionID extracts the 10-bit session ID common to ERSPAN types II and
+// III.
+func erspanSessionID(header []byte) string {
+	return strconv.Itoa(int(binary.BigEndian.Uint16(header[2:4]) & 0x3ff))
+}
+
+// tzspFrame finds the Ethernet frame carried by TZSP, after a 4-byte header and
+// a list of tagged fields.
+func tzspFrame(payload []byte) ([]byte, gopacket.LayerType, Tunnel, bool) {
+	tunnel := Tunnel{Type: "TZSP"}
+	if len(payload) < 4 || payload[0] != tzspVersion {
+		return nil, 0, tunnel, false
+	}
+	if payload[1] != tzspTypeReceived && payload[1] != tzspTypeTransmit {
+		return nil, 0, tunnel, false
+	}
+	if binary.BigEndian.Uint16(payload[2:4]) != tzspProtocolEthernet {
+		return nil, 0, tunnel, false
+	}
+
+	// Padding and end tags are one byte long; other tags have a length byte.
+	i := 4
+	for i < len(payload) {
+		tag := payload[i]
+		if tag == tzspTagEnd {
+			return payload[i+1:], layers.LayerTypeEthernet, tunnel, true
+		}
+		if tag == tzspTagPadding {
+			i++
+			continue
+		}
+		if i+1 >= len(payload) {
+			break
+		}
+		i += 2 + int(payload[i+1])
+	}
+	return nil, 0, tunnel, false
+}
@@ -0,0 +1,129 @@
+/*
+Unit tests for decapsulation of mirrored traffic.
+*/
+package main
+
+import (
+	"net"
+	"testing"
+
+	"github.com/google/gopacket"
+	"github.com/google/gopacket/layers"
+)
+
+var (
+	testMirrorMAC = net.HardwareAddr{0x02, 0x00, 0x00, 0x00, 0x00, 0x99}
+	testMirrorIP  = net.IP{192, 168, 99, 1}
+	testSensorIP  = net.IP{192, 168, 99, 2}
+)
+
+// innerTestFrame serializes an Ethernet frame from the test client.
+func innerTestFrame() []byte {
+	eth := &layers.Ethernet{
+		SrcMAC:       testClientMAC,
+		DstMAC:       testServerMAC,
+		EthernetType: layers.EthernetTypeIPv4,
+	}
+	return serializeIPv4TCP(eth)
+}
+
+// encapsulate serializes an IPv4 packet from the mirroring device to the sensor
+// holding the given layers.
+func encapsulate(protocol layers.IPProtocol, tunnelLayers ...gopacket.SerializableLayer) gopacket.Packet {
+	eth := &layers.Ethernet{
+		SrcMAC:       testMirrorMAC,
+		DstMAC:       testServerMAC,
+		EthernetType: layers.EthernetTypeIPv4,
+	}
+	ip4 := &layers.IPv4{
+		Version:  4,
+		TTL:      64,
+		Protocol: protocol,
+		SrcIP:    testMirrorIP,
+		DstIP:    testSensorIP,
+	}
+	for _, layer := range tunnelLayers {
+		if udp, ok := layer.(*layers.UDP); ok {
+			udp.SetNetworkLayerForChecksum(ip4)
+		}
+	}
+	buf := gopacket.NewSerializeBuffer()
+	opts := gopacket.SerializeOptions{FixLengths: true, ComputeChecksums: true}
+	all := append([]gopacket.SerializableLayer{eth, ip4}, tunnelLayers...)
+	if err := gopacket.SerializeLayers(buf, opts, all...); err != nil {
+		panic(err)
+	}
+	return gopacket.NewPacket(buf.Bytes(), layers.LayerTypeEthernet, gopacket.Default)
+}
+
+func TestDecapsulate(t *testing.T) {
+	setupLogging(false)
+	stats = *NewStats()
+	inner := gopacket.Payload(innerTestFrame())
+
+	// ERSPAN type II header: version 1, session 123
+	erspanII := gopacket.Payload(append([]byte{0x10, 0x00, 0x00, 123, 0, 0, 0, 0}, inner...))
+
+	// TZSP header: version 1, received, Ethernet, one padding tag, end tag
+	tzsp := gopacket.Payload(append([]byte{1, 0, 0, 1, 0, 1}, inner...))
+
+	cases := []struct {
+		name   string
+		packet gopacket.Packet
+		tunnel Tunnel
+	}{
+		{
+			"GRE",
+			encapsulate(layers.IPProtocolGRE,
+				&layers.GRE{Protocol: layers.EthernetTypeTransparentEthernetBridging, KeyPresent: true, Key: 42},
+				inner),
+			Tunnel{Type: "GRE", ID: "42"},
+		},
+		{
+			"ERSPAN",
+			encapsulate(layers.IPProtocolGRE,
+				&layers.GRE{Protocol: layers.EthernetTypeERSPAN, SeqPresent: true, Seq: 1},
+				erspanII),
+			Tunnel{Type: "ERSPAN", ID: "123"},
+		},
+		{
+			"VXLAN",
+			encapsulate(layers.IPProtocolUDP,
+				&layers.UDP{SrcPort: 50000, DstPort: 4789},
+				&layers.VXLAN{ValidIDFlag: true, VNI: 5001},
+				inner),
+			Tunnel{Type: "VXLAN", ID: "5001"},
+		},
+		{
+			"TZSP",
+			encapsulate(layers.IPProtocolUDP,
+				&layers.UDP{SrcPort: 50000, DstPort: tzspPort},
+				tzsp),
+			Tunnel{Type: "TZSP"},
+		},
+	}
+	for _, c := range cases {
+		packet := decapsulate(c.packet)
+		tunnel, ok := packetTunnel(packet)
+		if !ok || tunnel != c.tunnel {
+			t.Errorf("%s: wrong tunnel %+v (wanted %+v)", c.name, tunnel, c.tunnel)
+		}
+
+		asset := &Asset{}
+		decodeLayers(packet, asset)
+		if asset.MACAddress != testClientMAC.String() || asset.IPv4Address != testClientIP.String() {
+			t.Errorf("%s: asset attributed to %s %s", c.name, asset.MACAddress, asset.IPv4Address)
+		}
+	}
+}
+
+func TestDecapsulateLeavesPlainPacketsAlone(t *testing.T) {
+	setupLogging(false)
+	packet := buildTCPPacket(1000, "hello")
+	if decapsulate(packet) != packet {
+		t.Errorf("Plain packet was replaced")
+	}
+	if _, ok := packetTunnel(packet); ok {
+		t.Errorf("Plain packet has a tunnel")
+	}
+}
@@ -0,0 +1,476 @@
+// Copyright 2019 Virta Laboratories, Inc.  All rights reserved.
+/*
+Parsing FDA Unique Device Identifiers.
+
+A UDI carrier, such as the full label text that HL7 puts in PRT-10, combines a
+device identifier (DI) with production identifiers (lot, serial number, dates)
+in the format of one of three issuing agencies:
+
+ GS1:    (01)00643169007222(17)230101(10)LOT123(21)SN456
+         or the same without parentheses, variable-length elements ending
+         with a group separator (ASCII 29) or the end of the text
+ HIBCC:  +A99912345/$$3230101LOT123/SSN4565
+ ICCBBA: =/A9999XYZ100T0944=A99971312345600=>014032&,1000000000000XYZ123
+
+GS1 check digits and HIBCC check characters are verified, so that a garbled
+label is not mistaken for a real device.  Dates are given as YYYYMMDD, like the
+dates in PRT-17 and PRT-18.
+*/
+
+package main
+
+import (
+	"fmt"
+	"strings"
+	"time"
+)
+
+// UDI issuing agencies
+const (
+	udiGS1    = "GS1"
+	udiHIBCC  = "HIBCC"
+	udiICCBBA = "ICCBBA"
+)
+
+// A UDI holds the parts of a Unique Device Identifier.  Parts that were not
+// given are empty.
+type UDI struct {
+	Issuer          string
+	DeviceID        string
+	LotNumber       string
+	SerialNumber    string
+	ManufactureDate string
+	ExpiryDate      string
+	DonationID      string
+}
+
+// ParseUDI parses a UDI carrier in GS1, HIBCC or ICCBBA format.
+func ParseUDI(carrier string) (*UDI, error) {
+	carrier = strings.TrimSpace(carrier)
+	// Barcode scanners may prefix a symbology identifier, such as "]d2".
+	if len(carrier) > 3 && carrier[0] == ']' {
+		carrier = carrier[3:]
+	}
+	switch {
+	case strings.HasPrefix(carrier, "+"):
+		return parseHIBCC(carrier)
+	case strings.HasPrefix(carrier, "=") || strings.HasPrefix(carrier, "&"):
+		return parseICCBBA(carrier)
+	case strings.HasPrefix(carrier, "(") || strings.HasPrefix(carrier, "01"):
+		return parseGS1(carrier)
+	}
+	return nil, fmt.Errorf("Unknown UDI format")
+}
+
+// attributes returns the parts of a UDI as attributes, empty where a part was
+// not given.
+func (udi *UDI) attributes() map[string]string {
+	return map[string]string{
+		AttrUDIDI:           udi.DeviceID,
+		AttrUDIIssuer:       udi.Issuer,
+		AttrLotNumber:       udi.LotNumber,
+		AttrSerialNumber:    udi.SerialNumber,
+		AttrManufactureDate: udi.ManufactureDate,
+		AttrExpiryDate:      udi.ExpiryDate,
+		AttrDonationID:      udi.DonationID,
+	}
+}
+
+// GS1 group separator, which ends a variable-length element
+const gs1Separator = "\x1d"
+
+// GS1 application identifiers that we understand, and the lengths of their
+// data (negative for variable lengths, up to the given maximum)
+var gs1Elements = map[string]int{
+	"01": 14,  // GTIN, the device identifier
+	"10": -20, // batch or lot number
+	"11": 6,   // production date, YYMMDD
+	"17": 6,   // expiration date, YYMMDD
+	"21": -20, // serial number
+}
+
+// parseGS1 parses a GS1 UDI, in human-readable form (with application
+// identifiers in parentheses) or as encoded in a barcode.
+func parseGS1(carrier string) (*UDI, error) {
+	elements := make(map[string]string)
+	if strings.HasPrefix(carrier, "(") {
+		for _, part := range strings.Split(carrier[1:], "(") {
+			end := strings.Index(part, ")")
+			if end < 0 {
+				return nil, fmt.Errorf("Bad GS1 UDI")
+			}
+			ai, value := part[:end], strings.TrimSuffix(part[end+1:], gs1Separator)
+			length, ok := gs1Elements[ai]
+			if !ok {
+				continue // an element we do not need
+			}
+			if (length > 0 && len(value) != length) || (length < 0 && len(value) > -length) {
+				return nil, fmt.Errorf("Bad GS1 UDI element (%s)", ai)
+			}
+			elements[ai] = value
+		}
+	} else {
+		for rest := carrier; rest != ""; {
+			rest = strings.TrimPrefix(rest, gs1Separator)
+			if len(rest) < 2 {
+				return nil, fmt.Errorf("Bad GS1 UDI")
+			}
+			ai := rest[:2]
+			length, ok := gs1Elements[ai]
+			if !ok {
+				// Without parentheses we cannot know where an unknown
+				// element ends.
+				return nil, fmt.Errorf("Unknown GS1 UDI element (%s)", ai)
+			}
+			rest = rest[2:]
+			end := length
+			if length < 0 {
+				if end = strings.Index(rest, gs1Separator); end < 0 {
+					end = len(rest)
+				}
+				if end > -length {
+					return nil, fmt.Errorf("Bad GS1 UDI element (%s)", ai)
+				}
+			} else if len(rest) < length {
+				return nil, fmt.Errorf("Bad GS1 UDI element (%s)", ai)
+			}
+			elements[ai], rest = rest[:end], rest[end:]
+		}
+	}
+
+	gtin, ok := elements["01"]
+	if !ok {
+		return nil, fmt.Errorf("GS1 UDI without a GTIN")
+	}
+	if !validGTIN(gtin) {
+		return nil, fmt.Errorf("Bad GS1 check digit")
+	}
+	udi := &UDI{
+		Issuer:       udiGS1,
+		DeviceID:     gtin,
+		LotNumber:    elements["10"],
+		SerialNumber: elements["21"],
+	}
+	var err error
+	if udi.ManufactureDate, err = gs1Date(elements["11"]); err != nil {
+		return nil, err
+	}
+	if udi.ExpiryDate, err = gs1Date(elements["17"]); err != nil {
+		return nil, err
+	}
+	return udi, nil
+}
+
+// validGTIN verifies the check digit of a GTIN.
+func validGTIN(gtin string) bool {
+	if len(gtin) < 8 {
+		return false
+	}
+	sum := 0
+	for i := 0; i < len(gtin); i++ {
+		digit := int(gtin[len(gtin)-1-i] - '0')
+		if digit < 0 || digit > 9 {
+			return false
+		}
+		// Weights alternate 3, 1, ... leftwards from the digit before
+		// the check digit.
+		if i%2 == 1 {
+			digit *= 3
+		}
+		sum += digit
+	}
+	return sum%10 == 0
+}
+
+// gs1Date converts a GS1 date (YYMMDD, where a day of 00 means the end of the
+// month) to YYYYMMDD.  Years are taken to be in this century.
+func gs1Date(date string) (string, error) {
+	if date == "" {
+		return "", nil
+	}
+	yy, ok1 := number(date[:2])
+	mm, ok2 := number(date[2:4])
+	dd, ok3 := number(date[4:6])
+	if ok1 && ok2 && ok3 {
+		if ymd, ok := udiDate(2000+yy, mm, dd); ok {
+			return ymd, nil
+		}
+	}
+	return "", fmt.Errorf("Bad GS1 UDI date")
+}
+
+// Characters of the HIBCC character set, in the order of their values for
+// computing check characters
+const hibccCharset = "0123456789ABCDEFGHIJKLMNOPQRSTUVWXYZ-. $/+%"
+
+// parseHIBCC parses a HIBCC UDI: a primary data structure holding the
+// labeler identification code, product code and unit of measure, optionally
+// followed by "/" and a secondary data structure holding a lot or serial
+// number and dates, and finally a check character.
+func parseHIBCC(carrier string) (*UDI, error) {
+	carrier = strings.ToUpper(carrier)
+	if len(carrier) < 8 {
+		return nil, fmt.Errorf("Bad HIBCC UDI")
+	}
+	sum := 0
+	for _, c := range carrier[:len(carrier)-1] {
+		value := strings.IndexRune(hibccCharset, c)
+		if value < 0 {
+			return nil, fmt.Errorf("Bad HIBCC UDI character")
+		}
+		sum += value
+	}
+	if hibccCharset[sum%43] != carrier[len(carrier)-1] {
+		return nil, fmt.Errorf("Bad HIBCC check character")
+	}
+
+	parts := strings.Split(carrier[1:len(carrier)-1], "/")
+	primary := parts[0]
+	if len(primary) < 6 || primary[0] < 'A' || primary[0] > 'Z' {
+		return nil, fmt.Errorf("Bad HIBCC UDI primary data")
+	}
+	udi := &UDI{Issuer: udiHIBCC, DeviceID: primary}
+
+	if len(parts) > 1 {
+		if err := udi.parseHIBCCSecondary(parts[1]); err != nil {
+			return nil, err
+		}
+	}
+	// Supplementary data elements follow, each after its own "/".
+	for i := 2; i < len(parts); i++ {
+		part := parts[i]
+		var err error
+		switch {
+		case strings.HasPrefix(part, "S"):
+			udi.SerialNumber = part[1:]
+		case strings.HasPrefix(part, "14D"):
+			udi.ExpiryDate, err = supplementaryDate(part[3:])
+		case strings.HasPrefix(part, "16D"):
+			udi.ManufactureDate, err = supplementaryDate(part[3:])
+		}
+		if err != nil {
+			return nil, err
+		}
+	}
+	return udi, nil
+}
+
+// parseHIBCCSecondary parses a HIBCC secondary data structure.
+func (udi *UDI) parseHIBCCSecondary(data string) error {
+	if !strings.HasPrefix(data, "$") {
+		// A Julian date (YYJJJ) and a lot number
+		expiry, n, err := hibccDate('5', data)
+		udi.ExpiryDate, udi.LotNumber = expiry, data[n:]
+		return err
+	}
+
+	data = data[1:]
+	dated := strings.HasPrefix(data, "$")
+	if dated {
+		data = data[1:]
+	}
+	serial := strings.HasPrefix(data, "+")
+	if serial {
+		data = data[1:]
+	}
+	if dated {
+		// A digit tells the date format, except for the default, MMYY.
+		format := byte('0')
+		if len(data) > 0 && data[0] >= '2' && data[0] <= '9' {
+			format, data = data[0], data[1:]
+		}
+		expiry, n, err := hibccDate(format, data)
+		if err != nil {
+			return err
+		}
+		udi.ExpiryDate, data = expiry, data[n:]
+	}
+	if serial {
+		udi.SerialNumber = data
+	} else {
+		udi.LotNumber = data
+	}
+	return nil
+}
+
+// hibccDate converts the date at the start of HIBCC secondary data, in the
+// given format, to YYYYMMDD.  It returns the length of the date as well.
+// Hours are ignored.
+func hibccDate(format byte, data string) (string, int, error) {
+	lengths := map[byte]int{'0': 4, '2': 6, '3': 6, '4': 8, '5': 5, '6': 7, '7': 0}
+	length, ok := lengths[format]
+	if !ok {
+		return "", 0, fmt.Errorf("HIBCC UDI quantities are not supported")
+	}
+	if len(data) < length {
+		return "", 0, fmt.Errorf("Bad HIBCC UDI date")
+	}
+	if length == 0 {
+		return "", 0, nil
+	}
+	var date string
+	switch format {
+	case '0': // MMYY, meaning the end of the month
+		mm, ok1 := number(data[:2])
+		yy, ok2 := number(data[2:4])
+		date, ok = udiDate(2000+yy, mm, 0)
+		ok = ok && ok1 && ok2
+	case '2': // MMDDYY
+		mm, ok1 := number(data[:2])
+		dd, ok2 := number(data[2:4])
+		yy, ok3 := number(data[4:6])
+		date, ok = udiDate(2000+yy, mm, dd)
+		ok = ok && ok1 && ok2 && ok3 && dd > 0
+	case '3', '4': // YYMMDD[HH]
+		yy, ok1 := number(data[:2])
+		mm, ok2 := number(data[2:4])
+		dd, ok3 := number(data[4:6])
+		date, ok = udiDate(2000+yy, mm, dd)
+		ok = ok && ok1 && ok2 && ok3 && dd > 0
+	case '5', '6': // YYJJJ[HH]
+		yy, ok1 := number(data[:2])
+		jjj, ok2 := number(data[2:5])
+		date, ok = udiJulianDate(2000+yy, jjj)
+		ok = ok && ok1 && ok2
+	}
+	if !ok {
+		return "", 0, fmt.Errorf("Bad HIBCC UDI date")
+	}
+	return date, length, nil
+}
+
+// supplementaryDate converts a HIBCC supplementary date (YYYYMMDD).
+func supplementaryDate(data string) (string, error) {
+	if len(data) == 8 {
+		yyyy, ok1 := number(data[:4])
+		mm, ok2 := number(data[4:6])
+		dd, ok3 := number(data[6:8])
+		if date, ok := udiDate(yyyy, mm, dd); ok && ok1 && ok2 && ok3 && dd > 0 {
+			return date, nil
+		}
+	}
+	return "", fmt.Errorf("Bad HIBCC UDI date")
+}
+
+// ICCBBA (ISBT 128) data identifiers that we understand, and the lengths of
+// their data
+var iccbbaElements = []struct {
+	identifier string
+	length     int
+}{
+	{"=/", 16},  // processor product identification code, the device identifier
+	{"&,1", 18}, // lot number
+	{"=>", 6},   // expiration date, cyyjjj
+	{"&>", 10},  // expiration date and time, cyyjjjhhmm
+	{"=}", 6},   // production date, cyyjjj
+	{"&}", 10},  // production date and time, cyyjjjhhmm
+	{"=", 13},   // donation identification number, with optional flags
+}
+
+// parseICCBBA parses an ICCBBA UDI, a sequence of ISBT 128 data structures
+// each beginning with its data identifier.
+func parseICCBBA(carrier string) (*UDI, error) {
+	udi := &UDI{Issuer: udiICCBBA}
+	for rest := strings.Replace(carrier, " ", "", -1); rest != ""; {
+		found := false
+		for _, element := range iccbbaElements {
+			if !strings.HasPrefix(rest, element.identifier) {
+				continue
+			}
+			rest = rest[len(element.identifier):]
+			if len(rest) < element.length {
+				return nil, fmt.Errorf("Bad ICCBBA UDI element (%s)", element.identifier)
+			}
+			value := rest[:element.length]
+			rest = rest[element.length:]
+
+			var err error
+			switch element.identifier {
+			case "=/":
+				udi.DeviceID = value
+			case "&,1":
+				udi.LotNumber = value
+			case "=>", "&>":
+				udi.ExpiryDate, err = iccbbaDate(value[:6])
+			case "=}", "&}":
+				udi.ManufactureDate, err = iccbbaDate(value[:6])
+			case "=":
+				if !isAlphanumeric(value[0]) {
+					return nil, fmt.Errorf("Unknown ICCBBA UDI element")
+				}
+				// Two flag characters may follow the number.
+				if len(rest) >= 2 && !strings.ContainsAny(rest[:2], "=&") {
+					rest = rest[2:]
+				}
+				udi.DonationID = value
+			}
+			if err != nil {
+				return nil, err
+			}
+			found = true
+			break
+		}
+		if !found {
+			return nil, fmt.Errorf("Unknown ICCBBA UDI element")
+		}
+	}
+	if udi.DeviceID == "" {
+		return nil, fmt.Errorf("ICCBBA UDI without a device identifier")
+	}
+	return udi, nil
+}
+
+// iccbbaDate converts an ISBT 128 date (cyyjjj: century, year, day of year) to
+// YYYYMMDD.
+func iccbbaDate(date string) (string, error) {
+	cyy, ok1 := number(date[:3])
+	jjj, ok2 := number(date[3:6])
+	if ymd, ok := udiJulianDate(2000+cyy, jjj); ok && ok1 && ok2 {
+		return ymd, nil
+	}
+	return "", fmt.Errorf("Bad ICCBBA UDI date")
+}
+
+// udiDate formats a date as YYYYMMDD, if it exists.  A day of 0 means the
+// last day of the month.
+func udiDate(year, month, day int) (string, bool) {
+	if month < 1 || month > 12 || day < 0 || day > 31 {
+		return "", false
+	}
+	t := time.Date(year, time.Month(month), day, 0, 0, 0, 0, time.UTC)
+	if day == 0 {
+		t = time.Date(year, time.Month(month)+1, 0, 0, 0, 0, 0, time.UTC)
+	} else if t.Day() != day {
+		return "", false
+	}
+	return t.Format("20060102"), true
+}
+
+// udiJulianDate formats a year and day of the year as YYYYMMDD, if they exist.
+func udiJulianDate(year, dayOfYear int) (string, bool) {
+	t := time.Date(year, time.January, dayOfYear, 0, 0, 0, 0, time.UTC)
+	if dayOfYear < 1 || t.Year() != year {
+		return "", false
+	}
+	return t.Format("20060102"), true
+}
+
+// number parses a string of decimal digits.
+func number(digits string) (int, bool) {
+	if digits == "" {
+		return 0, false
+	}
+	n := 0
+	for i := 0; i < len(digits); i++ {
+		if digits[i] < '0' || digits[i] > '9' {
+			return 0, false
+		}
+		n = n*10 + int(digits[i]-'0')
+	}
+	return n, true
+}
+
+// isAlphanumeric returns true for ASCII letters and digits.
+func isAlphanumeric(c byte) bool {
+	return (c >= '0' && c <= '9') || (c >= 'A' && c <= 'Z') || (c >= 'a' && c <= 'z')
+}
@@ -0,0 +1,154 @@
+/*
+Unit tests for parsing Unique Device Identifiers.
+*/
+package main
+
+import (
+	"testing"
+)
+
+func TestParseUDI(t *testing.T) {
+	cases := []struct {
+		carrier string
+		udi     UDI
+	}{
+		{
+			"(01)00643169007222(17)230101(10)LOT123(21)SN456",
+			UDI{Issuer: udiGS1, DeviceID: "00643169007222", ExpiryDate: "20230101",
+				LotNumber: "LOT123", SerialNumber: "SN456"},
+		},
+		{
+			// As read from a barcode, with a group separator ending the lot
+			"]d20100643169007222" + "11180215" + "10LOT123\x1d" + "17230100",
+			UDI{Issuer: udiGS1, DeviceID: "00643169007222", ManufactureDate: "20180215",
+				LotNumber: "LOT123", ExpiryDate: "20230131"},
+		},
+		{
+			"(01)00643169007222(240)PART-9(10)LOT123",
+			UDI{Issuer: udiGS1, DeviceID: "00643169007222", LotNumber: "LOT123"},
+		},
+		{
+			// Primary data only
+			"+A123BJC5D6E71G",
+			UDI{Issuer: udiHIBCC, DeviceID: "A123BJC5D6E71"},
+		},
+		{
+			"+A99912345/$$3230101LOT123/SSN4565",
+			UDI{Issuer: udiHIBCC, DeviceID: "A99912345", ExpiryDate: "20230101",
+				LotNumber: "LOT123", SerialNumber: "SN456"},
+		},
+		{
+			"+H123ABC01234567890/$$+3230101SERIAL98",
+			UDI{Issuer: udiHIBCC, DeviceID: "H123ABC01234567890", ExpiryDate: "20230101",
+				SerialNumber: "SERIAL9"},
+		},
+		{
+			"+A99912345/$$0623LOT50",
+			UDI{Issuer: udiHIBCC, DeviceID: "A99912345", ExpiryDate: "20230630", LotNumber: "LOT5"},
+		},
+		{
+			"+A99912345/19032LOT7E",
+			UDI{Issuer: udiHIBCC, DeviceID: "A99912345", ExpiryDate: "20190201", LotNumber: "LOT7"},
+		},
+		{
+			"+A99912345/$LOT7/S1234/16D20190315P",
+			UDI{Issuer: udiHIBCC, DeviceID: "A99912345", LotNumber: "LOT7", SerialNumber: "1234",
+				ManufactureDate: "20190315"},
+		},
+		{
+			"=/A9999XYZ100T0944=A99971312345600=>014032&,1000000000000XYZ123",
+			UDI{Issuer: udiICCBBA, DeviceID: "A9999XYZ100T0944", DonationID: "A999713123456",
+				ExpiryDate: "20140201", LotNumber: "000000000000XYZ123"},
+		},
+	}
+	for _, c := range cases {
+		udi, err := ParseUDI(c.carrier)
+		if err != nil {
+			t.Errorf("%q: %v", c.carrier, err)
+			continue
+		}
+		if *udi != c.udi {
+			t.Errorf("%q: expected %+v, got %+v", c.carrier, c.udi, *udi)
+		}
+	}
+}
+
+func TestParseUDIErrors(t *testing.T) {
+	for _, carrier := range []string{
+		"",
+		"Grospira Peach B+",
+		"(01)00643169007223(10)LOT123",       // bad check digit
+		"(01)0064316900722(10)LOT123",        // short GTIN
+		"(10)LOT123",                         // no GTIN
+		"0100643169007222(17)230101",         // mixed forms
+		"(01)00643169007222(17)231301",       // no such month
+		"01006431690072229912345",            // unknown element
+		"+A99912345/$$3230101LOT123/SSN456C", // bad check character
+		"+A99912345/$$3231301LOT123/SSN4566", // no such month
+		"=/A9999XYZ100T09",                   // short device identifier
+		"=>014032",                           // no device identifier
+		"=/A9999XYZ100T0944=>014400",         // no such day
+	} {
+		if udi, err := ParseUDI(carrier); err == nil {
+			t.Errorf("Bad UDI %q was accepted as %+v", carrier, *udi)
+		}
+	}
+}
+
+func TestHL7UDILabel(t *testing.T) {
+	// PRT-10 holds a GS1 label; PRT-19 gives a different lot number, which
+	// wins over the one in the label.
+	str := okHL7Header + "PRT|" + getNRecordString(9) +
+		"|(01)00643169007222(17)230101(10)LOT123(21)SN456|||||||||LOT999\r"
+	obs := obsFromString(str)
+
+	expected := map[string]string{
+		AttrUDIDI:        "00643169007222",
+		AttrUDIIssuer:    udiGS1,
+		AttrExpiryDate:   "20230101",
+		AttrLotNumber:    "LOT999",
+		AttrSerialNumber: "SN456",
+	}
+	for name, value := range expected {
+		if attr := obs.Attributes[name]; attr.Value != value {
+			t.Errorf("Wrong %s: expected '%s', got '%s'", name, value, attr.Value)
+		}
+	}
+	if attr := obs.Attributes[AttrUDIDI]; attr.Provenance != "HL7 PRT-10" {
+		t.Errorf("Wrong provenance for device identifier: '%s'", attr.Provenance)
+	}
+
+	// ICCBBA labels escape HL7's subcomponent separator.
+	str = okHL7Header + "PRT|" + getNRecordString(9) +
+		`|=/A9999XYZ100T0944=A99971312345600\T\,1000000000000XYZ123` + "\r"
+	obs = obsFromString(str)
+	if attr := obs.Attributes[AttrLotNumber]; attr.Value != "000000000000XYZ123" {
+		t.Errorf("Wrong ICCBBA lot number '%s'", attr.Value)
+	}
+
+	// A garbled label is ignored.
+	str = okHL7Header + "PRT|" + getNRecordString(9) + "|(01)00643169007223\r"
+	obs = obsFromString(str)
+	if _, ok := obs.Attributes[AttrUDIIssuer]; ok {
+		t.Errorf("Got attributes from a bad UDI: %+v", obs.Attributes)
+	}
+}
+
+func FuzzParseUDI(f *testing.F) {
+	for _, carrier := range []string{
+		"(01)00643169007222(17)230101(10)LOT123(21)SN456",
+		"0100643169007222" + "11180215" + "10LOT123\x1d" + "17230100",
+		"+A123BJC5D6E71G",
+		"+A99912345/$$3230101LOT123/SSN4565",
+		"+A99912345/$LOT7/S1234/16D20190315P",
+		"=/A9999XYZ100T0944=A99971312345600=>014032&,1000000000000XYZ123",
+	} {
+		f.Add(carrier)
+	}
+	f.Fuzz(func(t *testing.T, carrier string) {
+		// Labels come from the network, so nothing may make us panic.
+		if udi, err := ParseUDI(carrier); err == nil && udi.Issuer == "" {
+			t.Errorf("%q parsed without an issuer", carrier)
+		}
+	})
+}
@@ -0,0 +1,120 @@
+// Copyright 2019 Virta Laboratories, Inc.  All rights reserved.
+/*
+Packet worker pool.
+
+Packets are handled by a fixed number of worker goroutines fed from bounded
+queues, so that a busy network cannot make us start an unbounded number of
+goroutines.
+
+Each worker has its own queue, and packets are assigned to workers by a hash of
+their addresses, ports and protocol that is the same in both directions.  Every
+packet of a connection is therefore handled by the same worker, in the order in
+which it was captured, while different connections are handled in parallel.
+
+When a queue is full, we either wait for room (applying backpressure to the
+packet source, which is what we want when reading a file) or drop the packet
+(which keeps a live capture from falling behind).
+*/
+
+package main
+
+import (
+	"sync"
+
+	"github.com/google/gopacket"
+)
+
+// PacketWorkers hands packets to a pool of worker goroutines.
+type PacketWorkers struct {
+	queues []chan gopacket.Packet
+	drop   bool
+	handle func(gopacket.Packet)
+	wg     sync.WaitGroup
+}
+
+// NewPacketWorkers starts workers goroutines, each of which calls handle for
+// packets taken from its own queue.  The queues hold at most queueSize packets
+// between them, but each holds at least one.  If drop is set, packets that
+// arrive when their queue is full are dropped; otherwise Submit waits for room.
+func NewPacketWorkers(
+	workers int,
+	queueSize int,
+	drop bool,
+	handle func(gopacket.Packet),
+) *PacketWorkers {
+	if workers < 1 {
+		workers = 1
+	}
+	// Each queue must hold at least one packet; with drop set, unbuffered
+	// queues would drop nearly every packet.
+	perWorker := queueSize / workers
+	if perWorker < 1 {
+		perWorker = 1
+	}
+	p := new(PacketWorkers)
+	p.queues = make([]chan gopacket.Packet, workers)
+	p.drop = drop
+	p.handle = handle
+	p.wg.Add(workers)
+	for i := range p.queues {
+		p.queues[i] = make(chan gopacket.Packet, perWorker)
+		go p.work(p.queues[i])
+	}
+	return p
+}
+
+// work handles packets until a queue is closed.
+func (p *PacketWorkers) work(queue chan gopacket.Packet) {
+	defer p.wg.Done()
+	for packet := range queue {
+		p.handle(packet)
+	}
+}
+
+// Submit queues a packet for handling by the worker responsible for its flow.
+func (p *PacketWorkers) Submit(packet gopacket.Packet) {
+	queue := p.queues[flowHash(packet)%uint64(len(p.queues))]
+	if p.drop {
+		select {
+		case queue <- packet:
+		default:
+			stats.AddDroppedPacket()
+			return
+		}
+	} else {
+		queue <- packet
+	}
+	stats.UpdateQueueDepth(p.backlog())
+}
+
+// backlog returns the number of packets waiting in all the queues together.
+func (p *PacketWorkers) backlog() int {
+	n := 0
+	for _, queue := range p.queues {
+		n += len(queue)
+	}
+	return n
+}
+
+// Close waits for every queued packet to be handled and stops the workers.
+func (p *PacketWorkers) Close() {
+	for _, queue := range p.queues {
+		close(queue)
+	}
+	p.wg.Wait()
+}
+
+// flowHash returns a hash of a packet's network and transport endpoints that
+// is the same for both directions of a flow.  Packets without a network layer
+// all hash to 0.
+func flowHash(packet gopacket.Packet) uint64 {
+	var hash uint64
+	if net := packet.NetworkLayer(); net != nil {
+		hash = net.NetworkFlow().FastHash()
+		if transport := packet.TransportLayer(); transport != nil {
+			// FastHash is symmetric, and so is this combination of hashes.
+			hash = hash*31 + transport.TransportFlow().FastHash()
+		}
+	}
+	return hash
+}
@@ -0,0 +1,134 @@
+/*
+Unit tests for the packet worker pool.
+*/
+package main
+
+import (
+	"sync"
+	"testing"
+
+	"github.com/google/gopacket"
+	"github.com/google/gopacket/layers"
+)
+
+func TestPacketWorkersHandleEveryPacket(t *testing.T) {
+	stats = *NewStats()
+	var mu sync.Mutex
+	handled := 0
+	workers := NewPacketWorkers(4, 8, false, func(packet gopacket.Packet) {
+		mu.Lock()
+		handled++
+		mu.Unlock()
+	})
+	pkt := gopacket.NewPacket(nil, layers.LayerTypeEthernet, gopacket.Default)
+	for i := 0; i < 100; i++ {
+		workers.Submit(pkt)
+	}
+	workers.Close()
+
+	if handled != 100 {
+		t.Errorf("Expected 100 packets handled, got %d", handled)
+	}
+	if stats.DroppedPackets != 0 {
+		t.Errorf("Expected no dropped packets, got %d", stats.DroppedPackets)
+	}
+	if stats.MaxQueueDepth > 8 {
+		t.Errorf("Queue depth %d exceeds queue size", stats.MaxQueueDepth)
+	}
+}
+
+func TestPacketWorkersDropWhenFull(t *testing.T) {
+	stats = *NewStats()
+	release := make(chan bool)
+	workers := NewPacketWorkers(1, 2, true, func(packet gopacket.Packet) {
+		<-release
+	})
+	pkt := gopacket.NewPacket(nil, layers.LayerTypeEthernet, gopacket.Default)
+
+	// The worker may or may not have taken the first packet off the queue yet,
+	// so at least 10 - (2 + 1) packets are dropped.
+	for i := 0; i < 10; i++ {
+		workers.Submit(pkt)
+	}
+	close(release)
+	workers.Close()
+
+	if stats.DroppedPackets < 7 {
+		t.Errorf("Expected at least 7 dropped packets, got %d", stats.DroppedPackets)
+	}
+}
+
+func TestPacketWorkersQueueDepthCountsEveryQueue(t *testing.T) {
+	setupLogging(false)
+	stats = *NewStats()
+	release := make(chan bool)
+	workers := NewPacketWorkers(2, 8, false, func(packet gopacket.Packet) {
+		<-release
+	})
+
+	// Find two flows handled by different workers.
+	first := buildUDPPacket(40000, 104, "")
+	second := first
+	for port := layers.UDPPort(40001); flowHash(second)%2 == flowHash(first)%2; port++ {
+		second = buildUDPPacket(port, 104, "")
+	}
+
+	// Each worker holds one packet, leaving at least 2 in each queue.
+	for i := 0; i < 3; i++ {
+		workers.Submit(first)
+		workers.Submit(second)
+	}
+	close(release)
+	workers.Close()
+
+	if stats.MaxQueueDepth < 4 {
+		t.Errorf("Expected a queue depth of at least 4, got %d", stats.MaxQueueDepth)
+	}
+}
+
+func TestPacketWorkersQueueSmallerThanWorkers(t *testing.T) {
+	workers := NewPacketWorkers(4, 2, true, func(packet gopacket.Packet) {})
+	defer workers.Close()
+	for i, queue := range workers.queues {
+		if cap(queue) < 1 {
+			t.Errorf("Queue %d is unbuffered", i)
+		}
+	}
+}
+
+func TestFlowHashIsSymmetric(t *testing.T) {
+	setupLogging(false)
+	request := buildTCPPacket(1000, "hello")
+	reply := buildTCPPacketFrom(testServerMAC, testServerIP, testServerPort,
+		testClientMAC, testClientIP, testClientPort, 2000, "world")
+	if flowHash(request) != flowHash(reply) {
+		t.Errorf("Packets of one connection hash differently")
+	}
+	other := buildTCPPacketFrom(testClientMAC, testClientIP, testClientPort+1,
+		testServerMAC, testServerIP, testServerPort, 1000, "hello")
+	if flowHash(request) == flowHash(other) {
+		t.Errorf("Packets of different connections hash the same")
+	}
+}
+
+func TestPacketWorkersPreserveFlowOrder(t *testing.T) {
+	stats = *NewStats()
+	var mu sync.Mutex
+	var order []uint32
+	workers := NewPacketWorkers(4, 64, false, func(packet gopacket.Packet) {
+		tcp := packet.TransportLayer().(*layers.TCP)
+		mu.Lock()
+		order = append(order, tcp.Seq)
+		mu.Unlock()
+	})
+	for seq := uint32(0); seq < 50; seq++ {
+		workers.Submit(buildTCPPacket(seq, "x"))
+	}
+	workers.Close()
+
+	for i, seq := range order {
+		if seq != uint32(i) {
+			t.Fatalf("Packet %d handled out of order (seq %d)", i, seq)
+		}
+	}
+}